@@ -0,0 +1,228 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type repositoryStatus struct {
+	UpstreamURL    string    `json:"upstream_url"`
+	LastUpdateTime time.Time `json:"last_update_time"`
+	DiskUsageBytes int64     `json:"disk_usage_bytes"`
+}
+
+type adminServer struct {
+	config *ServerConfig
+}
+
+// AdminHandler returns an http.Handler that exposes the state of the cache
+// and the /healthz and /readyz probes. This should be served on an address
+// that is not reachable by the Git clients.
+func AdminHandler(config *ServerConfig) http.Handler {
+	s := &adminServer{config}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthzHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	mux.HandleFunc("/repos", s.reposHandler)
+	mux.HandleFunc("/repos/refresh", s.refreshHandler)
+	mux.HandleFunc("/repos/prefetch", s.prefetchHandler)
+	mux.HandleFunc("/drain", s.drainHandler)
+	return mux
+}
+
+// healthzHandler reports that the server is up.
+func (s *adminServer) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "ok\n")
+}
+
+// readyzHandler reports whether the server can serve fetches: the git binary
+// is found and the cache root is writable.
+func (s *adminServer) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.checkReadiness(); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "ok\n")
+}
+
+func (s *adminServer) checkReadiness() error {
+	if gitBinary == "" && s.config.GitBinaryPath == "" {
+		return status.Error(codes.Unavailable, "git binary is not found")
+	}
+	if err := checkCacheRootWritable(s.config.LocalDiskCacheRoot); err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return nil
+}
+
+func (s *adminServer) reposHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listRepos(w, r)
+	case http.MethodDelete:
+		s.evictRepo(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *adminServer) listRepos(w http.ResponseWriter, r *http.Request) {
+	repos := []*repositoryStatus{}
+	managedRepos.Range(func(key, value interface{}) bool {
+		m := value.(*managedRepository)
+		if m.config != s.config {
+			return true
+		}
+		repos = append(repos, m.status())
+		return true
+	})
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].UpstreamURL < repos[j].UpstreamURL
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(repos)
+}
+
+// evictRepo removes a repository from the cache.
+func (s *adminServer) evictRepo(w http.ResponseWriter, r *http.Request) {
+	u, err := repoURL(r)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	if err := EvictManagedRepository(s.config, u); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "ok\n")
+}
+
+// refreshHandler fetches a cached repository from the upstream synchronously.
+func (s *adminServer) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	m, err := s.lookupRepo(r)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	// fetchUpstream holds the repository lock while fetching, so
+	// concurrent refreshes of the same repository run one at a time.
+	if err := m.fetchUpstream(r.Context()); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "ok\n")
+}
+
+// prefetchHandler caches a repository and fetches it from the upstream
+// synchronously. Unlike /repos/refresh, the repository doesn't have to be
+// cached yet.
+func (s *adminServer) prefetchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := repoURL(r)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	m, err := openManagedRepository(s.config, u)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	if err := m.Prefetch(r.Context()); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "ok\n")
+}
+
+// drainHandler starts draining the server on POST and stops it on DELETE. See
+// SetDraining. It reports whether the server is draining.
+func (s *adminServer) drainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		SetDraining(s.config, true)
+	case http.MethodDelete:
+		SetDraining(s.config, false)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if IsDraining(s.config) {
+		io.WriteString(w, "draining\n")
+	} else {
+		io.WriteString(w, "serving\n")
+	}
+}
+
+func (s *adminServer) lookupRepo(r *http.Request) (*managedRepository, error) {
+	u, err := repoURL(r)
+	if err != nil {
+		return nil, err
+	}
+	m, err := lookupManagedRepository(s.config, u)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, status.Errorf(codes.NotFound, "%s is not cached", u)
+	}
+	return m, nil
+}
+
+// repoURL returns the upstream URL in the url parameter.
+func repoURL(r *http.Request) (*url.URL, error) {
+	rawURL := r.URL.Query().Get("url")
+	if rawURL == "" {
+		return nil, status.Error(codes.InvalidArgument, "url parameter is required")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot parse the URL: %v", err)
+	}
+	return u, nil
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	code := codes.Internal
+	if st, ok := status.FromError(err); ok {
+		code = st.Code()
+	}
+	http.Error(w, err.Error(), runtime.HTTPStatusFromCode(code))
+}
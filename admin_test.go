@@ -0,0 +1,284 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAdminHandler_ListRepos(t *testing.T) {
+	config := newTestConfig(t)
+	u := newTestUpstream(t)
+	defer clearManagedRepositories()
+
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(AdminHandler(config))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/repos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	var repos []repositoryStatus
+	if err := json.NewDecoder(resp.Body).Decode(&repos); err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 1 {
+		t.Fatalf("got %d repositories, want 1", len(repos))
+	}
+	if got, want := repos[0].UpstreamURL, u.String(); got != want {
+		t.Errorf("got upstream URL %s, want %s", got, want)
+	}
+	if !repos[0].LastUpdateTime.Equal(m.LastUpdateTime()) {
+		t.Errorf("got last update time %v, want %v", repos[0].LastUpdateTime, m.LastUpdateTime())
+	}
+	if repos[0].DiskUsageBytes <= 0 {
+		t.Errorf("got disk usage %d, want a positive size", repos[0].DiskUsageBytes)
+	}
+}
+
+func TestAdminHandler_RefreshRepo(t *testing.T) {
+	config := newTestConfig(t)
+	u := newTestUpstream(t)
+	defer clearManagedRepositories()
+
+	srv := httptest.NewServer(AdminHandler(config))
+	defer srv.Close()
+	refreshURL := srv.URL + "/repos/refresh?url=" + url.QueryEscape(u.String())
+
+	resp, err := http.Post(refreshURL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d for an uncached repository, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	pushTestCommit(t, u.Path)
+	want := runTestGit(t, u.Path, "rev-parse", "master")
+
+	resp, err = http.Post(refreshURL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := runTestGit(t, m.localDiskPath, "rev-parse", "master"); strings.TrimSpace(got) != strings.TrimSpace(want) {
+		t.Errorf("got master %s after the refresh, want %s", got, want)
+	}
+}
+
+func TestAdminHandler_Probes(t *testing.T) {
+	config := newTestConfig(t)
+	srv := httptest.NewServer(AdminHandler(config))
+	defer srv.Close()
+
+	checkStatus := func(path string, want int) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: got status %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+	checkStatus("/healthz", http.StatusOK)
+	checkStatus("/readyz", http.StatusOK)
+
+	// Replace the cache root with a file so that it's unwritable even for
+	// root.
+	if err := os.Remove(config.LocalDiskCacheRoot); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(config.LocalDiskCacheRoot, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkStatus("/healthz", http.StatusOK)
+	checkStatus("/readyz", http.StatusServiceUnavailable)
+
+	if err := os.Remove(config.LocalDiskCacheRoot); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(config.LocalDiskCacheRoot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	checkStatus("/readyz", http.StatusOK)
+}
+
+func TestAdminHandler_PrefetchRepo(t *testing.T) {
+	config := newTestConfig(t)
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	defer clearManagedRepositories()
+
+	srv := httptest.NewServer(AdminHandler(config))
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/repos/prefetch?url="+url.QueryEscape(u.String()), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	m, err := lookupManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == nil {
+		t.Fatal("the repository is not cached after the prefetch")
+	}
+	if got := strings.TrimSpace(runTestGit(t, m.localDiskPath, "rev-parse", "master")); got != want {
+		t.Errorf("got master %s after the prefetch, want %s", got, want)
+	}
+}
+
+func TestAdminHandler_EvictRepo(t *testing.T) {
+	config := newTestConfig(t)
+	u := newTestUpstream(t)
+	defer clearManagedRepositories()
+
+	srv := httptest.NewServer(AdminHandler(config))
+	defer srv.Close()
+	evict := func() int {
+		req, err := http.NewRequest(http.MethodDelete, srv.URL+"/repos?url="+url.QueryEscape(u.String()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// An in-flight operation blocks the eviction.
+	if err := m.beginOperation(); err != nil {
+		t.Fatal(err)
+	}
+	if got := evict(); got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d while in use, want %d", got, http.StatusServiceUnavailable)
+	}
+	m.endOperation()
+
+	if got := evict(); got != http.StatusOK {
+		t.Fatalf("got status %d, want %d", got, http.StatusOK)
+	}
+	if _, ok := managedRepos.Load(m.localDiskPath); ok {
+		t.Error("the repository is still in memory after the eviction")
+	}
+	if _, err := os.Stat(m.localDiskPath); !os.IsNotExist(err) {
+		t.Errorf("the cache dir still exists after the eviction: %v", err)
+	}
+	if got := evict(); got != http.StatusNotFound {
+		t.Errorf("got status %d for an evicted repository, want %d", got, http.StatusNotFound)
+	}
+}
+
+func TestAdminHandler_Drain(t *testing.T) {
+	config := newTestConfig(t)
+	cached, fresh := newTestUpstream(t), newTestUpstream(t)
+	defer clearManagedRepositories()
+	defer SetDraining(config, false)
+
+	srv := httptest.NewServer(AdminHandler(config))
+	defer srv.Close()
+	do := func(method, path string) (int, string) {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+	prefetch := func(u *url.URL) int {
+		code, _ := do(http.MethodPost, "/repos/prefetch?url="+url.QueryEscape(u.String()))
+		return code
+	}
+
+	if got := prefetch(cached); got != http.StatusOK {
+		t.Fatalf("got status %d, want %d", got, http.StatusOK)
+	}
+	if code, body := do(http.MethodPost, "/drain"); code != http.StatusOK || body != "draining\n" {
+		t.Fatalf("POST /drain = %d, %q", code, body)
+	}
+	if got := prefetch(fresh); got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d for a new repository while draining, want %d", got, http.StatusServiceUnavailable)
+	}
+	// The repositories on the disk are still served when they are opened again.
+	clearManagedRepositories()
+	if got := prefetch(cached); got != http.StatusOK {
+		t.Errorf("got status %d for a cached repository while draining, want %d", got, http.StatusOK)
+	}
+
+	if code, body := do(http.MethodDelete, "/drain"); code != http.StatusOK || body != "serving\n" {
+		t.Fatalf("DELETE /drain = %d, %q", code, body)
+	}
+	if got := prefetch(fresh); got != http.StatusOK {
+		t.Errorf("got status %d after draining, want %d", got, http.StatusOK)
+	}
+	if code, body := do(http.MethodGet, "/drain"); code != http.StatusOK || body != "serving\n" {
+		t.Errorf("GET /drain = %d, %q", code, body)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/gitprotocolio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// bundleURISuffix is the path suffix of the endpoint that serves the bundle of
+// a repository. See ServerConfig.BundleURIBase.
+const bundleURISuffix = "/goblet-bundle"
+
+type bundleURIKey struct{}
+
+// withBundleURI returns a context that carries the bundle URI of the
+// repository requested at path, which the bundle-uri command advertises.
+func withBundleURI(ctx context.Context, config *ServerConfig, path string) context.Context {
+	path = strings.TrimSuffix(path, "/git-upload-pack")
+	return context.WithValue(ctx, bundleURIKey{}, strings.TrimSuffix(config.BundleURIBase, "/")+path+bundleURISuffix)
+}
+
+// writeBundleList writes the response to the bundle-uri command. The list is
+// empty while the repository is empty.
+func writeBundleList(ctx context.Context, repo *managedRepository, w io.Writer) error {
+	lines := []string{"bundle.version=1", "bundle.mode=all"}
+	if uri, ok := ctx.Value(bundleURIKey{}).(string); ok {
+		if empty, err := repo.isEmpty(); err != nil {
+			return status.Errorf(codes.Internal, "%v", err)
+		} else if !empty {
+			lines = append(lines, "bundle.goblet.uri="+uri)
+		}
+	}
+	for _, line := range lines {
+		if err := writePacket(w, gitprotocolio.BytesPacket(line+"\n")); err != nil {
+			return err
+		}
+	}
+	return writePacket(w, gitprotocolio.FlushPacket{})
+}
+
+// isBundleRequest returns true if r asks for the bundle of a repository.
+func isBundleRequest(r *http.Request) bool {
+	return r.Method == "GET" && strings.HasSuffix(r.URL.Path, bundleURISuffix)
+}
+
+// bundleHandler serves the bundle of the repository advertised by the
+// bundle-uri command. The bundle is reused until the repository is updated.
+func (s *httpProxyServer) bundleHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request) {
+	realm, err := s.requestRealm(r)
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	u := *r.URL
+	u.Path = strings.TrimSuffix(u.Path, bundleURISuffix)
+	repo, err := openRealmRepository(s.config, &u, realm)
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	path, err := repo.cachedBundle()
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	// A newer bundle can replace the file. This keeps reading the opened
+	// one.
+	f, err := os.Open(path)
+	if err != nil {
+		reporter.reportError(status.Errorf(codes.Internal, "cannot open the bundle: %v", err))
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		reporter.reportError(status.Errorf(codes.Internal, "cannot open the bundle: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// cachedBundle returns the path of the bundle of the repository. The bundle is
+// written again if the repository is updated after it's written.
+func (r *managedRepository) cachedBundle() (string, error) {
+	r.bundleMu.Lock()
+	defer r.bundleMu.Unlock()
+
+	path := filepath.Join(r.localDiskPath, "goblet.bundle")
+	if fi, err := os.Stat(path); err == nil && !fi.ModTime().Before(r.LastUpdateTime()) {
+		return path, nil
+	}
+	if empty, err := r.isEmpty(); err != nil {
+		return "", status.Errorf(codes.Internal, "%v", err)
+	} else if empty {
+		return "", status.Error(codes.NotFound, "the repository is empty")
+	}
+	// Wait for a running fetch so that the bundle has its refs.
+	r.mu.RLock()
+	err := writeBundleFile(r, path+".tmp")
+	r.mu.RUnlock()
+	if err == nil && r.config.CacheDirMode != 0 {
+		err = os.Chmod(path+".tmp", cacheFileMode(r.config))
+	}
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "cannot write the bundle: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return "", status.Errorf(codes.Internal, "cannot write the bundle: %v", err)
+	}
+	return path, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+func TestBundleURI(t *testing.T) {
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.BundleURIBase = "https://goblet.example.com/"
+	defer clearManagedRepositories()
+
+	bundleList := func() []string {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(pktLine("command=bundle-uri\n")+"00010000"))
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+		lines := []string{}
+		scanner := gitprotocolio.NewPacketScanner(rec.Body)
+		for scanner.Scan() {
+			if p, ok := scanner.Packet().(gitprotocolio.BytesPacket); ok {
+				lines = append(lines, strings.TrimSuffix(string(p), "\n"))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return lines
+	}
+
+	req := httptest.NewRequest("GET", "/repo/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("Git-Protocol", "version=2")
+	rec := httptest.NewRecorder()
+	HTTPHandler(config).ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), "bundle-uri") {
+		t.Errorf("got %q, want bundle-uri advertised", rec.Body)
+	}
+	// Nothing to bundle yet.
+	if got, want := strings.Join(bundleList(), ","), "bundle.version=1,bundle.mode=all"; got != want {
+		t.Errorf("got %q before the fetch, want %q", got, want)
+	}
+
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	lines := bundleList()
+	const wantURI = "https://goblet.example.com/repo/goblet-bundle"
+	if got, want := strings.Join(lines, ","), "bundle.version=1,bundle.mode=all,bundle.goblet.uri="+wantURI; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// The bundle is downloaded without Git protocol v2.
+	rec = httptest.NewRecorder()
+	HTTPHandler(config).ServeHTTP(rec, httptest.NewRequest("GET", wantURI, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	bundle := filepath.Join(newTempDir(t), "repo.bundle")
+	if err := ioutil.WriteFile(bundle, rec.Body.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := runTestGit(t, filepath.Dir(bundle), "bundle", "list-heads", bundle); !strings.Contains(got, want+" refs/heads/master") {
+		t.Errorf("got heads %q, want master at %s", got, want)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net/url"
+	"strings"
+)
+
+// GitHubURLCanonializer is the URL canonicalizer for GitHub. The owner and the
+// repository names are case-insensitive, and ".git" is optional, so
+// "https://github.com/Owner/Repo.git" is "https://github.com/owner/repo".
+func GitHubURLCanonializer(u *url.URL) (*url.URL, error) {
+	ret, err := hostURL(u)
+	if err != nil {
+		return nil, err
+	}
+	ret.Path = strings.ToLower(strings.TrimSuffix(ret.Path, ".git"))
+	return ret, nil
+}
+
+// GitLabURLCanonializer is the URL canonicalizer for GitLab. The group and
+// the project paths, which can have subgroups, are case-insensitive. GitLab
+// redirects the URLs without ".git", so it's added.
+func GitLabURLCanonializer(u *url.URL) (*url.URL, error) {
+	ret, err := hostURL(u)
+	if err != nil {
+		return nil, err
+	}
+	ret.Path = strings.ToLower(strings.TrimSuffix(ret.Path, ".git")) + ".git"
+	return ret, nil
+}
+
+// GerritURLCanonializer is the URL canonicalizer for Gerrit. The "/a/" prefix
+// of the authenticated URLs and ".git" are stripped. The project names are
+// case-sensitive.
+func GerritURLCanonializer(u *url.URL) (*url.URL, error) {
+	ret, err := hostURL(u)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(ret.Path, "/a/") {
+		ret.Path = strings.TrimPrefix(ret.Path, "/a")
+	}
+	ret.Path = strings.TrimSuffix(ret.Path, ".git")
+	return ret, nil
+}
+
+// BitbucketURLCanonializer is the URL canonicalizer for Bitbucket. The
+// workspace and the repository names are case-insensitive, and ".git" is
+// optional. The "/scm/" prefix of Bitbucket Server is kept.
+func BitbucketURLCanonializer(u *url.URL) (*url.URL, error) {
+	ret, err := hostURL(u)
+	if err != nil {
+		return nil, err
+	}
+	ret.Path = strings.ToLower(strings.TrimSuffix(ret.Path, ".git"))
+	return ret, nil
+}
+
+// hostURL is the common part of the host URL canonicalizers. It strips the Git
+// endpoint suffixes, the trailing slashes, and the duplicated slashes. The host
+// name is lower-cased.
+func hostURL(u *url.URL) (*url.URL, error) {
+	ret, err := defaultURLCanonializer(u)
+	if err != nil {
+		return nil, err
+	}
+	ret.Host = strings.ToLower(ret.Host)
+	parts := []string{}
+	for _, p := range strings.Split(ret.Path, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	ret.Path = "/" + strings.Join(parts, "/")
+	return ret, nil
+}
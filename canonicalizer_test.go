@@ -0,0 +1,100 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestHostURLCanonializers(t *testing.T) {
+	config := &ServerConfig{
+		LocalDiskCacheRoot: newTempDir(t),
+		HostURLCanonializers: map[string]func(*url.URL) (*url.URL, error){
+			"github.com":            GitHubURLCanonializer,
+			"gitlab.example.com":    GitLabURLCanonializer,
+			"gerrit.example.com":    GerritURLCanonializer,
+			"bitbucket.org":         BitbucketURLCanonializer,
+			"bitbucket.example.com": BitbucketURLCanonializer,
+		},
+	}
+	for _, tc := range []struct {
+		in   []string
+		want string
+	}{
+		{
+			[]string{
+				"https://github.com/owner/repo/info/refs",
+				"https://github.com/owner/repo.git/info/refs",
+				"https://GitHub.com/Owner/Repo/git-upload-pack",
+				"https://github.com//owner/repo.git/",
+			},
+			"https://github.com/owner/repo",
+		},
+		{
+			[]string{
+				"https://gitlab.example.com/group/subgroup/project/info/refs",
+				"https://gitlab.example.com/Group/SubGroup/Project.git/info/refs",
+				"https://gitlab.example.com/group/subgroup/project.git/git-upload-pack",
+			},
+			"https://gitlab.example.com/group/subgroup/project.git",
+		},
+		{
+			[]string{
+				"https://gerrit.example.com/platform/Build/info/refs",
+				"https://gerrit.example.com/a/platform/Build/info/refs",
+				"https://gerrit.example.com/a/platform/Build.git/git-upload-pack",
+			},
+			"https://gerrit.example.com/platform/Build",
+		},
+		{
+			[]string{
+				"https://bitbucket.org/workspace/repo/info/refs",
+				"https://bitbucket.org/Workspace/Repo.git/info/refs",
+			},
+			"https://bitbucket.org/workspace/repo",
+		},
+		{
+			[]string{
+				"https://bitbucket.example.com/scm/proj/repo/info/refs",
+				"https://bitbucket.example.com/scm/PROJ/repo.git/git-upload-pack",
+			},
+			"https://bitbucket.example.com/scm/proj/repo",
+		},
+	} {
+		paths := map[string]bool{}
+		for _, in := range tc.in {
+			u, err := url.Parse(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := canonicalizeURL(config, u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tc.want {
+				t.Errorf("canonicalizeURL(%s) = %s, want %s", in, got, tc.want)
+			}
+			p, err := getLocalDiskPath(config, got, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths[p] = true
+		}
+		if len(paths) != 1 {
+			t.Errorf("got cache dirs %v for %v, want one", paths, tc.in)
+		}
+	}
+}
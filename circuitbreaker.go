@@ -0,0 +1,162 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultCircuitBreakerCooldown is the default of
+	// ServerConfig.CircuitBreakerCooldown.
+	defaultCircuitBreakerCooldown = 30 * time.Second
+)
+
+// circuitBreakers maps circuitBreakerKey to *circuitBreaker.
+var circuitBreakers sync.Map
+
+type circuitBreakerKey struct {
+	config *ServerConfig
+	host   string
+}
+
+// circuitBreaker counts the consecutive failures to reach an upstream host.
+// See ServerConfig.CircuitBreakerThreshold.
+type circuitBreaker struct {
+	host      string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	// probing is true while the probe of a half-open circuit is in
+	// flight.
+	probing bool
+}
+
+// upstreamCircuitBreaker returns the circuit breaker of the host, or nil if
+// it's disabled.
+func upstreamCircuitBreaker(config *ServerConfig, host string) *circuitBreaker {
+	if config.CircuitBreakerThreshold <= 0 {
+		return nil
+	}
+	cooldown := config.CircuitBreakerCooldown
+	if cooldown <= 0 {
+		cooldown = defaultCircuitBreakerCooldown
+	}
+	v, _ := circuitBreakers.LoadOrStore(circuitBreakerKey{config, host}, &circuitBreaker{
+		host:      host,
+		threshold: config.CircuitBreakerThreshold,
+		cooldown:  cooldown,
+	})
+	return v.(*circuitBreaker)
+}
+
+// allow returns a circuitOpenError while the circuit is open. After the
+// cooldown, the circuit is half-open: one request is let through to probe the
+// upstream, and the others are refused until its result is recorded. The
+// returned function records the result of the allowed request.
+func (b *circuitBreaker) allow() (func(error), error) {
+	if b == nil {
+		return func(error) {}, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return b.record, nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		stats.RecordWithTags(context.Background(), []tag.Mutator{tag.Upsert(UpstreamHostKey, b.host)}, UpstreamShortCircuitCount.M(1))
+		return nil, &circuitOpenError{host: b.host, until: b.openUntil, probing: b.probing}
+	}
+	b.probing = true
+	return b.recordProbe, nil
+}
+
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.recordLocked(err)
+}
+
+// recordProbe records the result of the probe of a half-open circuit. If the
+// probe is canceled, the next request probes again.
+func (b *circuitBreaker) recordProbe(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	b.recordLocked(err)
+}
+
+// recordLocked counts a failure if err shows that the upstream is
+// unavailable, and opens the circuit at the threshold. Any other result
+// closes the circuit. A failed probe opens it again. A canceled request tells
+// nothing.
+func (b *circuitBreaker) recordLocked(err error) {
+	if isCircuitOpen(err) || status.Code(err) == codes.Canceled {
+		return
+	}
+	state := int64(0)
+	if isUpstreamUnavailable(err) {
+		b.failures++
+		if b.failures < b.threshold {
+			return
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+		state = 1
+	} else {
+		if b.failures == 0 {
+			return
+		}
+		b.failures = 0
+		b.openUntil = time.Time{}
+	}
+	stats.RecordWithTags(context.Background(), []tag.Mutator{tag.Upsert(UpstreamHostKey, b.host)}, UpstreamCircuitOpen.M(state))
+}
+
+// circuitOpenError is returned instead of sending a request to an upstream
+// host whose circuit is open.
+type circuitOpenError struct {
+	host    string
+	until   time.Time
+	probing bool
+}
+
+func (e *circuitOpenError) Error() string {
+	if e.probing {
+		return fmt.Sprintf("the upstream host %s is failing, and it's being probed", e.host)
+	}
+	return fmt.Sprintf("the upstream host %s is failing, not retried until %s", e.host, e.until.Format(time.RFC3339))
+}
+
+// GRPCStatus makes the status package recognize the error.
+func (e *circuitOpenError) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, e.Error())
+}
+
+// isCircuitOpen returns true if err is from an open circuit.
+func isCircuitOpen(err error) bool {
+	_, ok := err.(*circuitOpenError)
+	return ok
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	upstreamURL := newTestUpstream(t)
+	var mu sync.Mutex
+	failing := false
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		f := failing
+		mu.Unlock()
+		if f {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		serveGitHTTPBackend(w, r, upstreamURL.Path)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.CircuitBreakerThreshold = 2
+	config.CircuitBreakerCooldown = 500 * time.Millisecond
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	lsRefs := func() (int, string) {
+		body := pktLine("command=ls-refs\n") + "0001" + pktLine("ref-prefix refs/heads/\n") + "0000"
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(body))
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+	upstreamRequests := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	for i := 0; i < config.CircuitBreakerThreshold; i++ {
+		if code, body := lsRefs(); code == http.StatusOK {
+			t.Fatalf("got %d %q from a failing upstream", code, body)
+		}
+	}
+	// The circuit is open. The refs are served from the cache without
+	// asking the upstream.
+	before := upstreamRequests()
+	if code, body := lsRefs(); code != http.StatusOK || !strings.Contains(body, "refs/heads/master") {
+		t.Errorf("got %d %q while the circuit is open, want the cached refs", code, body)
+	}
+	if got := upstreamRequests(); got != before {
+		t.Errorf("got %d upstream requests while the circuit is open", got-before)
+	}
+
+	// After the cooldown, a probe closes the circuit.
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	time.Sleep(config.CircuitBreakerCooldown)
+	if code, body := lsRefs(); code != http.StatusOK {
+		t.Fatalf("got %d %q after the cooldown", code, body)
+	}
+	if got := upstreamRequests(); got == before {
+		t.Error("the upstream is not probed after the cooldown")
+	}
+	if _, err := upstreamCircuitBreaker(config, u.Host).allow(); err != nil {
+		t.Errorf("the circuit is open after a successful probe: %v", err)
+	}
+}
+
+func TestCircuitBreaker_MirrorFailover(t *testing.T) {
+	upstreamDir := newTestUpstream(t).Path
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer mirror.Close()
+	mirrorURL, err := url.Parse(mirror.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A primary that refuses connections.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	u, err := url.Parse(closed.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := newTestConfig(t)
+	config.MirrorURLs = map[string][]*url.URL{u.String(): {mirrorURL}}
+	config.CircuitBreakerThreshold = 2
+	config.CircuitBreakerCooldown = time.Minute
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsRefs := []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "ls-refs"},
+		{EndRequest: true},
+	}
+	// The successes of the mirror don't close the primary's circuit, and
+	// the mirror is still tried after it opens.
+	for i := 0; i < config.CircuitBreakerThreshold+1; i++ {
+		if _, err := m.lsRefsUpstream(context.Background(), lsRefs); err != nil {
+			t.Fatalf("ls-refs %d: %v", i, err)
+		}
+	}
+	if _, err := upstreamCircuitBreaker(config, u.Host).allow(); !isCircuitOpen(err) {
+		t.Errorf("got %v for the dead primary, want an open circuit", err)
+	}
+	if _, err := upstreamCircuitBreaker(config, mirrorURL.Host).allow(); err != nil {
+		t.Errorf("got %v for the mirror, want a closed circuit", err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Errorf("fetch with the primary's circuit open: %v", err)
+	}
+}
+
+func TestCircuitBreaker_HalfOpen(t *testing.T) {
+	config := newTestConfig(t)
+	config.CircuitBreakerThreshold = 1
+	config.CircuitBreakerCooldown = 50 * time.Millisecond
+	defer circuitBreakers.Delete(circuitBreakerKey{config, "git.example.com"})
+	b := upstreamCircuitBreaker(config, "git.example.com")
+	unavailable := status.Error(codes.Unavailable, "down")
+
+	record, err := b.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(unavailable)
+	if _, err := b.allow(); !isCircuitOpen(err) {
+		t.Fatalf("got %v after a failure, want an open circuit", err)
+	}
+
+	// After the cooldown, only one probe is let through.
+	time.Sleep(config.CircuitBreakerCooldown)
+	probe, err := b.allow()
+	if err != nil {
+		t.Fatalf("got %v after the cooldown, want a probe", err)
+	}
+	if _, err := b.allow(); !isCircuitOpen(err) {
+		t.Errorf("got %v during the probe, want an open circuit", err)
+	}
+	// A failed probe opens the circuit again.
+	probe(unavailable)
+	if _, err := b.allow(); !isCircuitOpen(err) {
+		t.Errorf("got %v after a failed probe, want an open circuit", err)
+	}
+
+	// A canceled probe lets the next request probe.
+	time.Sleep(config.CircuitBreakerCooldown)
+	probe, err = b.allow()
+	if err != nil {
+		t.Fatalf("got %v after the cooldown, want a probe", err)
+	}
+	probe(status.Error(codes.Canceled, "canceled"))
+	probe, err = b.allow()
+	if err != nil {
+		t.Fatalf("got %v after a canceled probe, want a probe", err)
+	}
+	// A successful probe closes the circuit.
+	probe(nil)
+	for i := 0; i < 2; i++ {
+		if _, err := b.allow(); err != nil {
+			t.Errorf("got %v after a successful probe, want a closed circuit", err)
+		}
+	}
+}
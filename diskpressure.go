@@ -0,0 +1,52 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"time"
+)
+
+// statfs returns the free and the total bytes of the filesystem of dir. It's
+// replaced in the tests.
+var statfs = diskSpace
+
+// RunDiskPressureProcess starts a background process that calls
+// config.DiskPressureCallback while the free space of the filesystem of
+// LocalDiskCacheRoot is below config.MinFreeDiskBytes. It warns before the
+// disk is full, which the eviction doesn't prevent by itself.
+func RunDiskPressureProcess(config *ServerConfig) {
+	if config.DiskPressureCallback == nil || config.MinFreeDiskBytes <= 0 || config.DiskCheckInterval <= 0 {
+		return
+	}
+	go func() {
+		timer := time.NewTimer(config.DiskCheckInterval)
+		for {
+			<-timer.C
+			checkDiskPressure(config)
+			timer.Reset(config.DiskCheckInterval)
+		}
+	}()
+}
+
+func checkDiskPressure(config *ServerConfig) {
+	free, total, err := statfs(config.LocalDiskCacheRoot)
+	if err != nil {
+		Logf(config, LogLevelError, "Cannot get the free space of %s: %v", config.LocalDiskCacheRoot, err)
+		return
+	}
+	if free < uint64(config.MinFreeDiskBytes) {
+		config.DiskPressureCallback(free, total)
+	}
+}
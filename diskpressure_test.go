@@ -0,0 +1,49 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckDiskPressure(t *testing.T) {
+	defer func(f func(string) (uint64, uint64, error)) { statfs = f }(statfs)
+	var free uint64
+	statfs = func(string) (uint64, uint64, error) { return free, 1000, nil }
+
+	var got [][2]uint64
+	config := newTestConfig(t)
+	config.MinFreeDiskBytes = 100
+	config.DiskPressureCallback = func(freeBytes, totalBytes uint64) {
+		got = append(got, [2]uint64{freeBytes, totalBytes})
+	}
+	for _, free = range []uint64{500, 100, 99, 0} {
+		checkDiskPressure(config)
+	}
+	if want := [][2]uint64{{99, 1000}, {0, 1000}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got callbacks %v, want %v", got, want)
+	}
+}
+
+func TestDiskSpace(t *testing.T) {
+	free, total, err := diskSpace(newTempDir(t))
+	if err != nil {
+		t.Skipf("no free space on this platform: %v", err)
+	}
+	if total == 0 || free > total {
+		t.Errorf("got free %d of total %d", free, total)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// drainingConfigs holds the *ServerConfig keys of the servers that are
+// draining. See SetDraining.
+var drainingConfigs sync.Map
+
+// SetDraining starts or stops draining the server, e.g. before a restart. A
+// draining server doesn't cache new repositories; the requests for them fail
+// with Unavailable so that the clients retry on another server. The cached
+// repositories are served and fetched as usual.
+func SetDraining(config *ServerConfig, draining bool) {
+	if draining {
+		drainingConfigs.Store(config, true)
+	} else {
+		drainingConfigs.Delete(config)
+	}
+}
+
+// IsDraining returns true if the server is draining. See SetDraining.
+func IsDraining(config *ServerConfig) bool {
+	_, ok := drainingConfigs.Load(config)
+	return ok
+}
+
+// checkDraining fails if the server is draining, for a new repository.
+func checkDraining(config *ServerConfig) error {
+	if IsDraining(config) {
+		return status.Error(codes.Unavailable, "the server is draining and doesn't cache new repositories, retry later")
+	}
+	return nil
+}
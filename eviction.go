@@ -0,0 +1,141 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// RunEvictionProcess starts a background process that removes the least
+// recently updated repositories while the cache is larger than
+// config.MaxCacheBytes. The repositories with config.PinnedRefs are kept. The
+// repositories under LocalDiskCacheRoot that are cached before the server
+// started are counted and evicted too.
+func RunEvictionProcess(config *ServerConfig) {
+	if config.MaxCacheBytes <= 0 || config.EvictionInterval <= 0 {
+		return
+	}
+	go func() {
+		timer := time.NewTimer(config.EvictionInterval)
+		for {
+			<-timer.C
+			evictRepositories(config)
+			timer.Reset(config.EvictionInterval)
+		}
+	}()
+}
+
+type evictionCandidate struct {
+	m          *managedRepository
+	lastUpdate time.Time
+	size       int64
+}
+
+func evictRepositories(config *ServerConfig) {
+	loadCachedRepositories(config)
+	var total int64
+	candidates := []evictionCandidate{}
+	managedRepos.Range(func(key, value interface{}) bool {
+		m := value.(*managedRepository)
+		if m.config != config {
+			return true
+		}
+		size, err := m.DiskUsage()
+		if err != nil {
+			Logf(config, LogLevelError, "Cannot get the disk usage of %s: %v", m.localDiskPath, err)
+			return true
+		}
+		total += size
+		if !m.isPinned() {
+			candidates = append(candidates, evictionCandidate{m, m.LastUpdateTime(), size})
+		}
+		return true
+	})
+	if total <= config.MaxCacheBytes {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUpdate.Before(candidates[j].lastUpdate)
+	})
+	for _, c := range candidates {
+		if total <= config.MaxCacheBytes {
+			return
+		}
+		evicted, err := c.m.evict()
+		if err != nil {
+			Logf(config, LogLevelError, "Error while evicting %s: %v", c.m.localDiskPath, err)
+		}
+		if evicted {
+			Logf(config, LogLevelInfo, "Evicted %s", c.m.upstreamURL)
+			total -= c.size
+		}
+	}
+}
+
+// loadCachedRepositories opens the repositories under LocalDiskCacheRoot that
+// haven't been opened since the server started, such as the ones cached before
+// a restart, so that they count toward MaxCacheBytes and can be evicted. A
+// custom StorageBackend is not scanned.
+func loadCachedRepositories(config *ServerConfig) {
+	if config.StorageBackend != nil || config.LocalDiskCacheRoot == "" {
+		return
+	}
+	root := filepath.Clean(config.LocalDiskCacheRoot)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if path == filepath.Join(root, objectStoresDirName) {
+			return filepath.SkipDir
+		}
+		if !isCacheDir(path) {
+			return nil
+		}
+		if _, ok := managedRepos.Load(path); !ok {
+			if _, err := openManagedRepositoryByPath(config, path); err != nil {
+				Logf(config, LogLevelInfo, "Cannot open the cache directory %s: %v", path, err)
+			}
+		}
+		// A repository doesn't have another one inside.
+		return filepath.SkipDir
+	})
+}
+
+// isCacheDir returns true if dir looks like a bare repository.
+func isCacheDir(dir string) bool {
+	if fi, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	fi, err := os.Stat(filepath.Join(dir, "objects"))
+	return err == nil && fi.IsDir()
+}
+
+func diskUsage(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RunGCProcess starts a background process that repacks the cached
+// repositories. Repeated fetches leave loose objects and small packs behind,
+// and they slow down git-upload-pack.
+func RunGCProcess(config *ServerConfig) {
+	if config.GCInterval <= 0 {
+		return
+	}
+	go func() {
+		timer := time.NewTimer(config.GCInterval)
+		for {
+			<-timer.C
+			gcRepositories(config)
+			timer.Reset(config.GCInterval)
+		}
+	}()
+}
+
+func gcRepositories(config *ServerConfig) {
+	repos := []*managedRepository{}
+	managedRepos.Range(func(key, value interface{}) bool {
+		if m := value.(*managedRepository); m.config == config {
+			repos = append(repos, m)
+		}
+		return true
+	})
+	// The pinned repositories are the busiest.
+	sort.SliceStable(repos, func(i, j int) bool {
+		return repos[i].isPinned() && !repos[j].isPinned()
+	})
+	for _, m := range repos {
+		if !m.isFetching() {
+			m.gc()
+		}
+	}
+}
+
+func (r *managedRepository) gc() (err error) {
+	if err := r.beginOperation(); err != nil {
+		return err
+	}
+	defer r.endOperation()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if storeDir := objectStoreDir(r.config, r.upstreamURL); storeDir != "" {
+		if atomic.LoadInt64(&r.refsGen) == r.sharedRefsGen {
+			return nil
+		}
+		op := r.startOperation(context.Background(), "GC")
+		defer func() {
+			op.Done(err)
+		}()
+		err = r.shareObjects(op, storeDir)
+		r.invalidateRefSnapshot()
+		if err == nil {
+			r.sharedRefsGen = atomic.LoadInt64(&r.refsGen)
+		}
+		return
+	}
+
+	if !r.needsRepack() {
+		return nil
+	}
+	op := r.startOperation(context.Background(), "GC")
+	defer func() {
+		op.Done(err)
+	}()
+	err = runGit(r.config, op, r.localDiskPath, "repack", "-a", "-d", "-b")
+	// The unreachable objects are dropped.
+	r.invalidateRefSnapshot()
+	return
+}
+
+// needsRepack returns true if the repository has loose objects or more than
+// one pack.
+func (r *managedRepository) needsRepack() bool {
+	b := new(bytes.Buffer)
+	if err := runGitWithStdOut(r.config, noopOperation{}, b, r.localDiskPath, "count-objects", "-v"); err != nil {
+		// Let git-repack report the error.
+		return true
+	}
+	sc := bufio.NewScanner(b)
+	for sc.Scan() {
+		ss := strings.SplitN(sc.Text(), ": ", 2)
+		if len(ss) != 2 {
+			continue
+		}
+		n, err := strconv.Atoi(ss[1])
+		if err != nil {
+			continue
+		}
+		if (ss[0] == "count" && n > 0) || (ss[0] == "packs" && n > 1) {
+			return true
+		}
+	}
+	return false
+}
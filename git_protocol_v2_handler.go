@@ -17,21 +17,26 @@ package goblet
 import (
 	"context"
 	"io"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/google/gitprotocolio"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 const (
-	checkFrequency = 1 * time.Second
+	defaultWantCheckInterval = 1 * time.Second
 )
 
+// errMaxFetchWait is returned when a fetch waits for the upstream longer than
+// MaxFetchWait.
+var errMaxFetchWait = status.Error(codes.Unavailable, "the upstream fetch is taking long, retry later")
+
 type gitProtocolErrorReporter interface {
 	reportError(context.Context, time.Time, error)
 }
@@ -39,11 +44,16 @@ type gitProtocolErrorReporter interface {
 func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, repo *managedRepository, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) bool {
 	startTime := time.Now()
 	var err error
-	ctx, err = tag.New(ctx, tag.Upsert(CommandTypeKey, command[0].Command))
+	ctx, err = tag.New(ctx,
+		tag.Upsert(CommandTypeKey, command[0].Command),
+		tag.Upsert(UpstreamHostKey, repo.upstreamURL.Host),
+	)
 	if err != nil {
 		reporter.reportError(ctx, startTime, err)
 		return false
 	}
+	span := tracer(repo.config).FromContext(ctx)
+	span.AddAttributes(trace.StringAttribute("goblet.command", command[0].Command))
 
 	cacheState := "locally-served"
 	ctx, err = tag.New(ctx, tag.Upsert(CommandCacheStateKey, cacheState))
@@ -53,14 +63,23 @@ func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, rep
 	}
 	switch command[0].Command {
 	case "ls-refs":
+		if repo.isLsRefsFresh(command) {
+			return serveLocal(ctx, reporter, startTime, repo, command, w)
+		}
 		ctx, err = tag.New(ctx, tag.Update(CommandCacheStateKey, "queried-upstream"))
 		if err != nil {
 			reporter.reportError(ctx, startTime, err)
 			return false
 		}
 
-		resp, err := repo.lsRefsUpstream(command)
+		checkTime := time.Now()
+		resp, err := repo.lsRefsUpstream(ctx, command)
 		if err != nil {
+			if (repo.config.ServeStaleOnUpstreamError && isUpstreamUnavailable(err)) || isCircuitOpen(err) {
+				if empty, emptyErr := repo.isEmpty(); emptyErr == nil && !empty {
+					return serveLocal(ctx, reporter, startTime, repo, command, w)
+				}
+			}
 			reporter.reportError(ctx, startTime, err)
 			return false
 		}
@@ -75,7 +94,11 @@ func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, rep
 			reporter.reportError(ctx, startTime, err)
 			return false
 		} else if hasUpdate {
-			go repo.fetchUpstream()
+			// The fetch updates the cache shared by the other clients.
+			// Do not cancel it with this request.
+			go repo.fetchUpstreamWithServerOptions(detachSpan(repo.config, ctx), parseServerOptions(command))
+		} else {
+			repo.setLsRefsChecked(command, checkTime)
 		}
 
 		writeResp(w, resp)
@@ -83,16 +106,67 @@ func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, rep
 		return true
 
 	case "fetch":
-		wantHashes, wantRefs, err := parseFetchWants(command)
+		// The filter is applied by serveFetchLocal's git-upload-pack.
+		wantHashes, wantRefs, filter, err := parseFetchWants(command, repo.config.MaxWants)
+		if err != nil {
+			reporter.reportError(ctx, startTime, err)
+			return false
+		}
+		// git-upload-pack ignores a shallow commit it doesn't have, and
+		// then the shallow packfile doesn't match the client's
+		// history. Wait for them as well as the wants.
+		shallows, deepenNotRefs, err := parseFetchShallows(command)
 		if err != nil {
 			reporter.reportError(ctx, startTime, err)
 			return false
 		}
+		if len(wantHashes) == 0 && len(wantRefs) == 0 {
+			// Nothing is wanted, e.g. from an empty upstream.
+			// git-upload-pack answers it without the upstream.
+			return serveLocal(ctx, reporter, startTime, repo, command, w)
+		}
+		wants := wantHashes
+		wantHashes = append(append([]string{}, wantHashes...), shallows...)
+		// The cached refs can be behind the upstream. A want-ref is
+		// served only after the ref catches up.
+		refs, err := repo.upstreamRefs(ctx, wantRefs)
+		if err != nil {
+			if !(repo.config.ServeStaleOnUpstreamError && isUpstreamUnavailable(err)) && !isCircuitOpen(err) {
+				reporter.reportError(ctx, startTime, err)
+				return false
+			}
+			refs = map[string]string{}
+			for _, ref := range wantRefs {
+				refs[ref] = ""
+			}
+		}
+		for _, ref := range deepenNotRefs {
+			if _, ok := refs[ref]; !ok {
+				refs[ref] = ""
+			}
+		}
+		for ref := range refs {
+			if !repo.isMirrored(ref) {
+				// The cache never has the ref.
+				recordCacheOutcome(ctx, CacheBypass, 0)
+				return serveUpstream(ctx, reporter, startTime, repo, command, w)
+			}
+		}
 
-		if hasAllWants, err := repo.hasAllWants(wantHashes, wantRefs); err != nil {
+		// Set when the response carries the progress of the upstream
+		// fetch.
+		var pw *progressWriter
+		out := w
+		if hasAllWants, err := repo.hasAllWants(wantHashes, refs); err != nil {
 			reporter.reportError(ctx, startTime, err)
 			return false
-		} else if !hasAllWants {
+		} else if hasAllWants {
+			stats.Record(ctx, CacheHitCount.M(1))
+			span.AddAttributes(trace.BoolAttribute("goblet.cache_hit", true))
+			recordCacheOutcome(ctx, CacheHit, 0)
+		} else {
+			stats.Record(ctx, CacheMissCount.M(1))
+			span.AddAttributes(trace.BoolAttribute("goblet.cache_hit", false))
 			ctx, err = tag.New(ctx, tag.Update(CommandCacheStateKey, "queried-upsteam"))
 			if err != nil {
 				reporter.reportError(ctx, startTime, err)
@@ -102,38 +176,70 @@ func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, rep
 			fetchStartTime := time.Now()
 			fetchDone := make(chan error, 1)
 			go func() {
-				fetchDone <- repo.fetchUpstream()
+				fetchDone <- repo.fetchUpstreamWithServerOptions(detachSpan(repo.config, ctx), parseServerOptions(command))
 			}()
-			timer := time.NewTimer(checkFrequency)
-		LOOP:
-			for {
-				select {
-				case <-ctx.Done():
-					reporter.reportError(ctx, startTime, ctx.Err())
-					return false
-				case err := <-fetchDone:
-					if hasAllWants, checkErr := repo.hasAllWants(wantHashes, wantRefs); checkErr != nil {
-						reporter.reportError(ctx, startTime, checkErr)
-						return false
-					} else if !hasAllWants {
-						reporter.reportError(ctx, startTime, err)
-						return false
-					}
-					break LOOP
-				case <-timer.C:
-					if hasAllWants, err := repo.hasAllWants(wantHashes, wantRefs); err != nil {
-						reporter.reportError(ctx, startTime, err)
-						return false
-					} else if hasAllWants {
-						break LOOP
-					}
-					timer.Reset(checkFrequency)
+			// The wants can be outside of MirrorRefspecs. Then the
+			// fetch is forwarded to the upstream, and the response
+			// must not have the progress.
+			restricted := len(repo.settings.MirrorRefspecs) != 0
+			var progress func(string)
+			if hasOnlyPackfileSection(command) && !restricted {
+				pw = &progressWriter{w: w}
+				progress = pw.progress
+				out = pw
+			}
+			err := waitForWants(ctx, repo, wantHashes, refs, fetchDone, progress)
+			recordCacheOutcome(ctx, CacheMiss, time.Since(fetchStartTime))
+			if err == errMaxFetchWait && filter != "" {
+				// A partial clone can fetch the missing objects
+				// later.
+				var partial []*gitprotocolio.ProtocolV2RequestChunk
+				if partial, err = partialFetch(repo, command, wants, refs); err == nil {
+					command = partial
 				}
 			}
+			if err != nil {
+				if restricted && status.Code(err) == codes.NotFound {
+					return serveUpstream(ctx, reporter, startTime, repo, command, w)
+				}
+				if pw != nil && pw.started {
+					writeSideBandError(w, err)
+				}
+				reporter.reportError(ctx, startTime, err)
+				return false
+			}
 			stats.Record(ctx, UpstreamFetchWaitingTime.M(int64(time.Now().Sub(fetchStartTime)/time.Millisecond)))
 		}
 
-		if err := repo.serveFetchLocal(command, w); err != nil {
+		cw := &countingWriter{w: out}
+		err = repo.serveFetchLocal(ctx, command, cw)
+		stats.Record(ctx, LocallyServedBytes.M(cw.n))
+		span.AddAttributes(trace.Int64Attribute("goblet.served_bytes", cw.n))
+		if err != nil && status.Code(err) == codes.Canceled {
+			// The client disconnected.
+			reporter.reportError(ctx, startTime, err)
+			return false
+		}
+		if err != nil {
+			if cw.n > 0 || (pw != nil && pw.started) {
+				// The client is reading side-band packets of the
+				// packfile section.
+				writeSideBandError(w, err)
+			}
+			// A corrupted cache fails every fetch until it's
+			// recovered.
+			go repo.recoverIfCorrupted(detachSpan(repo.config, ctx))
+			reporter.reportError(ctx, startTime, err)
+			return false
+		}
+		reporter.reportError(ctx, startTime, nil)
+		return true
+
+	case "bundle-uri":
+		if repo.config.BundleURIBase == "" {
+			break
+		}
+		if err := writeBundleList(ctx, repo, w); err != nil {
 			reporter.reportError(ctx, startTime, err)
 			return false
 		}
@@ -144,8 +250,128 @@ func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, rep
 	return false
 }
 
-func parseLsRefsResponse(chunks []*gitprotocolio.ProtocolV2ResponseChunk) (map[string]plumbing.Hash, error) {
-	m := map[string]plumbing.Hash{}
+// serveUpstream answers the fetch command by forwarding it to the upstream.
+func serveUpstream(ctx context.Context, reporter gitProtocolErrorReporter, startTime time.Time, repo *managedRepository, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) bool {
+	ctx, err := tag.New(ctx, tag.Update(CommandCacheStateKey, "forwarded-upstream"))
+	if err != nil {
+		reporter.reportError(ctx, startTime, err)
+		return false
+	}
+	if err := repo.forwardFetch(ctx, command, w); err != nil {
+		reporter.reportError(ctx, startTime, err)
+		return false
+	}
+	reporter.reportError(ctx, startTime, nil)
+	return true
+}
+
+// serveLocal answers the command from the cache.
+func serveLocal(ctx context.Context, reporter gitProtocolErrorReporter, startTime time.Time, repo *managedRepository, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) bool {
+	ctx, err := tag.New(ctx, tag.Update(CommandCacheStateKey, "locally-served"))
+	if err != nil {
+		reporter.reportError(ctx, startTime, err)
+		return false
+	}
+	if err := repo.serveFetchLocal(ctx, command, w); err != nil {
+		reporter.reportError(ctx, startTime, err)
+		return false
+	}
+	reporter.reportError(ctx, startTime, nil)
+	return true
+}
+
+// partialFetch returns the fetch command without the wants that the cache
+// doesn't have. It fails with errMaxFetchWait if the cache has none of them or
+// doesn't have the refs.
+func partialFetch(repo *managedRepository, command []*gitprotocolio.ProtocolV2RequestChunk, wants []string, refs map[string]string) ([]*gitprotocolio.ProtocolV2RequestChunk, error) {
+	if hasRefs, err := repo.hasAllWants(nil, refs); err != nil {
+		return nil, err
+	} else if !hasRefs {
+		return nil, errMaxFetchWait
+	}
+	resolved, err := repo.resolveObjects(wants)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*gitprotocolio.ProtocolV2RequestChunk{}
+	found := false
+	for _, ch := range command {
+		s := string(ch.Argument)
+		if strings.HasPrefix(s, "want ") {
+			if resolved[strings.TrimSpace(strings.TrimPrefix(s, "want "))] == "" {
+				continue
+			}
+			found = true
+		}
+		ret = append(ret, ch)
+	}
+	if !found && len(refs) == 0 {
+		return nil, errMaxFetchWait
+	}
+	return ret, nil
+}
+
+// waitForWants waits until the repository has all the wants, polling every
+// WantCheckInterval while the upstream fetch is running. A want-ref mapped to
+// an object ID must point to it. It returns an error if the fetch ends without
+// bringing the wants, or errMaxFetchWait after MaxFetchWait. If progress is
+// not nil, it's called with the messages of the upstream fetch, and with "" on
+// every poll to keep the connection alive.
+func waitForWants(ctx context.Context, repo *managedRepository, wantHashes []string, wantRefs map[string]string, fetchDone <-chan error, progress func(string)) error {
+	interval := repo.config.WantCheckInterval
+	if interval <= 0 {
+		interval = defaultWantCheckInterval
+	}
+	var maxWait <-chan time.Time
+	if repo.config.MaxFetchWait > 0 {
+		t := time.NewTimer(repo.config.MaxFetchWait)
+		defer t.Stop()
+		maxWait = t.C
+	}
+	var messages <-chan string
+	if progress != nil {
+		ch, unsubscribe := repo.subscribeProgress()
+		defer unsubscribe()
+		messages = ch
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-maxWait:
+			return errMaxFetchWait
+		case msg := <-messages:
+			progress(msg)
+		case err := <-fetchDone:
+			if hasAllWants, checkErr := repo.hasAllWants(wantHashes, wantRefs); checkErr != nil {
+				return checkErr
+			} else if !hasAllWants {
+				if err == nil {
+					err = status.Error(codes.NotFound, "the upstream doesn't have the requested objects")
+				}
+				return err
+			}
+			return nil
+		case <-timer.C:
+			if hasAllWants, err := repo.hasAllWants(wantHashes, wantRefs); err != nil {
+				return err
+			} else if hasAllWants {
+				return nil
+			}
+			if progress != nil {
+				progress("")
+			}
+			timer.Reset(interval)
+		}
+	}
+}
+
+// parseLsRefsResponse returns the object IDs of the refs in an ls-refs
+// response. Unborn refs are skipped.
+func parseLsRefsResponse(chunks []*gitprotocolio.ProtocolV2ResponseChunk) (map[string]string, error) {
+	m := map[string]string{}
 	for _, ch := range chunks {
 		if ch.Response == nil {
 			continue
@@ -154,14 +380,24 @@ func parseLsRefsResponse(chunks []*gitprotocolio.ProtocolV2ResponseChunk) (map[s
 		if len(ss) < 2 {
 			return nil, status.Errorf(codes.Internal, "cannot parse the upstream ls-refs response: got %d component, want at least 2", len(ss))
 		}
-		m[strings.TrimSpace(ss[1])] = plumbing.NewHash(ss[0])
+		if ss[0] == "unborn" {
+			continue
+		}
+		if !isObjectID(ss[0]) {
+			return nil, status.Errorf(codes.Internal, "cannot parse the upstream ls-refs response: invalid object ID %q", ss[0])
+		}
+		m[strings.TrimSpace(ss[1])] = ss[0]
 	}
 	return m, nil
 }
 
-func parseFetchWants(chunks []*gitprotocolio.ProtocolV2RequestChunk) ([]plumbing.Hash, []string, error) {
-	hashes := []plumbing.Hash{}
+// parseFetchWants returns the wanted object IDs, refs, and the partial clone
+// filter spec (empty if none) of a fetch command. A command with more than
+// maxWants wants and want-refs is rejected unless maxWants is zero.
+func parseFetchWants(chunks []*gitprotocolio.ProtocolV2RequestChunk, maxWants int) ([]string, []string, string, error) {
+	hashes := []string{}
 	refs := []string{}
+	filter := ""
 	for _, ch := range chunks {
 		if ch.Argument == nil {
 			continue
@@ -170,16 +406,121 @@ func parseFetchWants(chunks []*gitprotocolio.ProtocolV2RequestChunk) ([]plumbing
 		if strings.HasPrefix(s, "want ") {
 			ss := strings.Split(s, " ")
 			if len(ss) < 2 {
-				return nil, nil, status.Errorf(codes.InvalidArgument, "cannot parse the fetch request: got %d component, want at least 2", len(ss))
+				return nil, nil, "", status.Errorf(codes.InvalidArgument, "cannot parse the fetch request: got %d component, want at least 2", len(ss))
 			}
-			hashes = append(hashes, plumbing.NewHash(strings.TrimSpace(ss[1])))
+			hash := strings.TrimSpace(ss[1])
+			if !isObjectID(hash) {
+				return nil, nil, "", status.Errorf(codes.InvalidArgument, "cannot parse the fetch request: invalid object ID %q", hash)
+			}
+			hashes = append(hashes, hash)
 		} else if strings.HasPrefix(s, "want-ref ") {
 			ss := strings.Split(s, " ")
 			if len(ss) < 2 {
-				return nil, nil, status.Errorf(codes.InvalidArgument, "cannot parse the fetch request: got %d component, want at least 2", len(ss))
+				return nil, nil, "", status.Errorf(codes.InvalidArgument, "cannot parse the fetch request: got %d component, want at least 2", len(ss))
 			}
 			refs = append(refs, strings.TrimSpace(ss[1]))
+		} else if strings.HasPrefix(s, "filter ") {
+			filter = strings.TrimSpace(strings.TrimPrefix(s, "filter "))
+			if filter == "" {
+				return nil, nil, "", status.Error(codes.InvalidArgument, "cannot parse the fetch request: empty filter spec")
+			}
+		}
+		if maxWants > 0 && len(hashes)+len(refs) > maxWants {
+			return nil, nil, "", status.Errorf(codes.InvalidArgument, "cannot parse the fetch request: more than %d wants", maxWants)
+		}
+	}
+	return hashes, refs, filter, nil
+}
+
+// parseFetchShallows returns the client's shallow commits and the deepen-not
+// refs of a fetch command. The other deepen arguments are only validated.
+func parseFetchShallows(chunks []*gitprotocolio.ProtocolV2RequestChunk) ([]string, []string, error) {
+	shallows := []string{}
+	deepenNotRefs := []string{}
+	for _, ch := range chunks {
+		s := strings.TrimSpace(string(ch.Argument))
+		if strings.HasPrefix(s, "shallow ") {
+			hash := strings.TrimPrefix(s, "shallow ")
+			if !isObjectID(hash) {
+				return nil, nil, status.Errorf(codes.InvalidArgument, "cannot parse the fetch request: invalid shallow object ID %q", hash)
+			}
+			shallows = append(shallows, hash)
+		} else if strings.HasPrefix(s, "deepen-not ") {
+			deepenNotRefs = append(deepenNotRefs, strings.TrimPrefix(s, "deepen-not "))
+		} else if strings.HasPrefix(s, "deepen-since ") {
+			if _, err := strconv.ParseInt(strings.TrimPrefix(s, "deepen-since "), 10, 64); err != nil {
+				return nil, nil, status.Errorf(codes.InvalidArgument, "cannot parse the fetch request: invalid deepen-since %q", s)
+			}
+		} else if strings.HasPrefix(s, "deepen ") {
+			if depth, err := strconv.Atoi(strings.TrimPrefix(s, "deepen ")); err != nil || depth <= 0 {
+				return nil, nil, status.Errorf(codes.InvalidArgument, "cannot parse the fetch request: invalid depth %q", s)
+			}
+		}
+	}
+	return shallows, deepenNotRefs, nil
+}
+
+// hasWantRefs returns true if the fetch command has a want-ref, for which the
+// response has the wanted-refs section.
+func hasWantRefs(chunks []*gitprotocolio.ProtocolV2RequestChunk) bool {
+	for _, ch := range chunks {
+		if strings.HasPrefix(string(ch.Argument), "want-ref ") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPackfileURIs returns true if the fetch command accepts packfile URIs.
+func hasPackfileURIs(chunks []*gitprotocolio.ProtocolV2RequestChunk) bool {
+	for _, ch := range chunks {
+		if strings.HasPrefix(string(ch.Argument), "packfile-uris ") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOnlyPackfileSection returns true if the response to the fetch command
+// starts with the packfile section. That is, the client is done with the
+// negotiation and doesn't ask for shallow info, wanted refs, or packfile URIs,
+// and the section header is not multiplexed by sideband-all.
+func hasOnlyPackfileSection(chunks []*gitprotocolio.ProtocolV2RequestChunk) bool {
+	done := false
+	for _, ch := range chunks {
+		s := strings.TrimSpace(string(ch.Argument))
+		switch {
+		case s == "done":
+			done = true
+		case strings.HasPrefix(s, "want-ref "), strings.HasPrefix(s, "shallow "), strings.HasPrefix(s, "deepen"), strings.HasPrefix(s, "packfile-uris "), s == "sideband-all":
+			return false
+		}
+	}
+	return done
+}
+
+// parseServerOptions returns the server options of a command. They are passed
+// to the upstream as is.
+func parseServerOptions(chunks []*gitprotocolio.ProtocolV2RequestChunk) []string {
+	options := []string{}
+	for _, ch := range chunks {
+		if strings.HasPrefix(ch.Capability, "server-option=") {
+			options = append(options, strings.TrimPrefix(ch.Capability, "server-option="))
+		}
+	}
+	return options
+}
+
+// isObjectID returns true if s is a hex object ID of SHA-1 (40 digits) or
+// SHA-256 (64 digits).
+func isObjectID(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
 		}
 	}
-	return hashes, refs, nil
+	return true
 }
@@ -0,0 +1,470 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWaitForWants_WantCheckInterval(t *testing.T) {
+	u := newTestUpstream(t)
+	config := newTestConfig(t)
+	config.WantCheckInterval = 10 * time.Millisecond
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+
+	// The fetch never finishes; the wants arrive by other means.
+	fetchDone := make(chan error)
+	fetched := make(chan error, 1)
+	time.AfterFunc(50*time.Millisecond, func() {
+		fetched <- runGit(config, noopOperation{}, m.localDiskPath, "fetch", "origin")
+	})
+	defer func() {
+		if err := <-fetched; err != nil {
+			t.Error(err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := waitForWants(ctx, m, []string{want}, nil, fetchDone, nil); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d >= defaultWantCheckInterval {
+		t.Errorf("waitForWants took %v, want less than %v", d, defaultWantCheckInterval)
+	}
+}
+
+func TestHandleV2Command_FetchProgress(t *testing.T) {
+	upstreamDir := newTestUpstream(t).Path
+	want := strings.TrimSpace(runTestGit(t, upstreamDir, "rev-parse", "master"))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A slow upstream.
+		time.Sleep(100 * time.Millisecond)
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.WantCheckInterval = 10 * time.Millisecond
+	defer clearManagedRepositories()
+
+	body := pktLine("command=fetch\n") + "0001" + pktLine("want "+want+"\n") + pktLine("done\n") + "0000"
+	req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(body))
+	req.Header.Set("Git-Protocol", "version=2")
+	rec := httptest.NewRecorder()
+	HTTPHandler(config).ServeHTTP(rec, req)
+
+	scanner := gitprotocolio.NewPacketScanner(rec.Body)
+	packets := []string{}
+	for scanner.Scan() {
+		if bp, ok := scanner.Packet().(gitprotocolio.BytesPacket); ok {
+			packets = append(packets, string(bp))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) == 0 || packets[0] != "packfile\n" {
+		t.Fatalf("got %q, want the packfile section", packets)
+	}
+	progress := 0
+	for _, p := range packets[1:] {
+		if p == "packfile\n" {
+			t.Fatalf("got the packfile section header twice: %q", packets)
+		}
+		if p[0] == 1 && strings.HasPrefix(p[1:], "PACK") {
+			break
+		}
+		if p[0] == 2 {
+			progress++
+		}
+	}
+	if progress == 0 {
+		t.Errorf("got no progress before the packfile: %q", packets)
+	}
+}
+
+func TestHandleV2Command_ServeStaleOnUpstreamError(t *testing.T) {
+	upstreamDir := newTestUpstream(t).Path
+	want := strings.TrimSpace(runTestGit(t, upstreamDir, "rev-parse", "master"))
+	// An upstream that is offline.
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, serveStale := range []bool{true, false} {
+		config := newTestConfig(t)
+		config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+		config.ServeStaleOnUpstreamError = serveStale
+		m, err := openManagedRepository(config, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Cached while the upstream was online.
+		runTestGit(t, m.localDiskPath, "fetch", upstreamDir, "+refs/*:refs/*")
+
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(pktLine("command=ls-refs\n")+"00010000"))
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+		resp := rec.Body.String()
+		if got := strings.Contains(resp, want+" refs/heads/master"); got != serveStale {
+			t.Errorf("ServeStaleOnUpstreamError=%v: got refs/heads/master %v in %q", serveStale, got, resp)
+		}
+		clearManagedRepositories()
+	}
+}
+
+func TestHandleV2Command_LsRefsCacheWindow(t *testing.T) {
+	upstreamDir := newTestUpstream(t).Path
+	want := strings.TrimSpace(runTestGit(t, upstreamDir, "rev-parse", "master"))
+	var mu sync.Mutex
+	lsRefs := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			mu.Lock()
+			lsRefs++
+			mu.Unlock()
+		}
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.LsRefsCacheWindow = time.Minute
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, m.localDiskPath, "fetch", upstreamDir, "+refs/*:refs/*")
+
+	for i, tc := range []struct {
+		args         string
+		wantRequests int
+	}{
+		{"", 1},
+		// Answered from the cache.
+		{"", 1},
+		// Different ref prefixes are checked separately.
+		{pktLine("ref-prefix refs/heads/\n"), 2},
+		{pktLine("ref-prefix refs/heads/\n"), 2},
+	} {
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(pktLine("command=ls-refs\n")+"0001"+tc.args+"0000"))
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+		if resp := rec.Body.String(); !strings.Contains(resp, want+" refs/heads/master") {
+			t.Errorf("#%d: got %q, want refs/heads/master", i, resp)
+		}
+		mu.Lock()
+		if lsRefs != tc.wantRequests {
+			t.Errorf("#%d: got %d upstream ls-refs, want %d", i, lsRefs, tc.wantRequests)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestHandleV2Command_EmptyUpstream(t *testing.T) {
+	upstreamDir := newTempDir(t)
+	runTestGit(t, upstreamDir, "init", "--bare")
+	var mu sync.Mutex
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	defer clearManagedRepositories()
+
+	for _, tc := range []struct {
+		body         string
+		want         string
+		wantRequests int
+	}{
+		// No refs, and no fetch for them.
+		{pktLine("command=ls-refs\n") + "0001" + pktLine("ref-prefix refs/heads/\n") + "0000", "0000", 1},
+		// Nothing to want.
+		{pktLine("command=fetch\n") + "0001" + pktLine("done\n") + "0000", "", 1},
+	} {
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(tc.body))
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+		if got := rec.Body.String(); rec.Code != http.StatusOK || got != tc.want {
+			t.Errorf("%q: got %d %q, want %q", tc.body, rec.Code, got, tc.want)
+		}
+		mu.Lock()
+		if requests != tc.wantRequests {
+			t.Errorf("%q: got %d upstream requests, want %d", tc.body, requests, tc.wantRequests)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestHandleV2Command_MirrorRefspecs(t *testing.T) {
+	upstreamURL := newTestUpstream(t)
+	master := strings.TrimSpace(runTestGit(t, upstreamURL.Path, "rev-parse", "master"))
+	change := strings.TrimSpace(runTestGit(t, upstreamURL.Path, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit-tree", "-p", master, "-m", "change", master+"^{tree}"))
+	runTestGit(t, upstreamURL.Path, "update-ref", "refs/changes/01/1/1", change)
+	runTestGit(t, upstreamURL.Path, "config", "uploadpack.allowrefinwant", "true")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveGitHTTPBackend(w, r, upstreamURL.Path)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.MirrorRefspecs = []string{"refs/heads/*:refs/heads/*"}
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if resolved, err := m.resolveObjects([]string{"refs/heads/master", "refs/changes/01/1/1"}); err != nil {
+		t.Fatal(err)
+	} else if resolved["refs/heads/master"] != master || resolved["refs/changes/01/1/1"] != "" {
+		t.Fatalf("got the cached refs %v, want only refs/heads/master", resolved)
+	}
+	// The change is not mirrored, and it's not an update.
+	if hasUpdate, err := m.hasAnyUpdate(map[string]string{"refs/heads/master": master, "refs/changes/01/1/1": change}); err != nil || hasUpdate {
+		t.Errorf("hasAnyUpdate() = %v, %v, want false", hasUpdate, err)
+	}
+
+	// The fetches of the change fall through to the upstream.
+	for _, want := range []string{"want " + change, "want-ref refs/changes/01/1/1"} {
+		body := pktLine("command=fetch\n") + "0001" + pktLine(want+"\n") + pktLine("done\n") + "0000"
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(body))
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "packfile\n") {
+			t.Errorf("%s: got %d %q, want a packfile", want, rec.Code, rec.Body)
+		}
+	}
+	if resolved, err := m.resolveObjects([]string{change}); err != nil {
+		t.Fatal(err)
+	} else if resolved[change] != "" {
+		t.Errorf("the change is fetched into the cache")
+	}
+}
+
+func TestHandleV2Command_MaxFetchWait(t *testing.T) {
+	upstreamURL := newTestUpstream(t)
+	old := strings.TrimSpace(runTestGit(t, upstreamURL.Path, "rev-parse", "master"))
+	var mu sync.Mutex
+	slow := false
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		s := slow
+		mu.Unlock()
+		if s {
+			<-release
+		}
+		serveGitHTTPBackend(w, r, upstreamURL.Path)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.MaxFetchWait = 100 * time.Millisecond
+	config.WantCheckInterval = 10 * time.Millisecond
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	next := strings.TrimSpace(runTestGit(t, upstreamURL.Path, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit-tree", "-p", old, "-m", "second", old+"^{tree}"))
+	runTestGit(t, upstreamURL.Path, "update-ref", "refs/heads/master", next)
+	mu.Lock()
+	slow = true
+	mu.Unlock()
+	defer func() {
+		close(release)
+		for m.isFetching() {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	for _, tc := range []struct {
+		filter string
+		want   string
+	}{
+		// A partial clone gets the cached commit.
+		{pktLine("filter blob:none\n"), "packfile\n"},
+		// The others retry later.
+		{"", "retry later"},
+	} {
+		body := pktLine("command=fetch\n") + "0001" + pktLine("want "+old+"\n") + pktLine("want "+next+"\n") + tc.filter + pktLine("done\n") + "0000"
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(body))
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		HTTPHandler(config).ServeHTTP(rec, req)
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%q: took %v", tc.filter, elapsed)
+		}
+		if !strings.Contains(rec.Body.String(), tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.filter, rec.Body, tc.want)
+		}
+	}
+}
+
+func TestHandleV2Command_LsRefsNoMatchingRefs(t *testing.T) {
+	upstreamDir := newTestUpstream(t).Path
+	var mu sync.Mutex
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.LsRefsCacheWindow = time.Minute
+	defer clearManagedRepositories()
+
+	// The upstream has refs, but none of them matches. The second ls-refs
+	// is answered from the cache without a fetch.
+	body := pktLine("command=ls-refs\n") + "0001" + pktLine("ref-prefix refs/nothing/\n") + "0000"
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(body))
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+		if got := rec.Body.String(); rec.Code != http.StatusOK || got != "0000" {
+			t.Errorf("ls-refs %d: got %d %q, want no refs", i, rec.Code, got)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Errorf("got %d upstream requests, want 1", requests)
+	}
+}
+
+func TestParseFetchShallows(t *testing.T) {
+	hash := strings.Repeat("a", 40)
+	for _, tc := range []struct {
+		args        []string
+		wantShallow []string
+		wantRefs    []string
+		wantCode    codes.Code
+	}{
+		{[]string{"want " + hash, "deepen 1"}, []string{}, []string{}, codes.OK},
+		{[]string{"shallow " + hash, "deepen 1"}, []string{hash}, []string{}, codes.OK},
+		{[]string{"deepen-since 1600000000", "deepen-not refs/tags/v1"}, []string{}, []string{"refs/tags/v1"}, codes.OK},
+		{[]string{"shallow abc"}, nil, nil, codes.InvalidArgument},
+		{[]string{"deepen 0"}, nil, nil, codes.InvalidArgument},
+		{[]string{"deepen-since yesterday"}, nil, nil, codes.InvalidArgument},
+	} {
+		chunks := []*gitprotocolio.ProtocolV2RequestChunk{{Command: "fetch"}, {EndCapability: true}}
+		for _, arg := range tc.args {
+			chunks = append(chunks, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte(arg + "\n")})
+		}
+		shallows, refs, err := parseFetchShallows(chunks)
+		if status.Code(err) != tc.wantCode {
+			t.Errorf("%q: got %v, want %v", tc.args, err, tc.wantCode)
+			continue
+		}
+		if err == nil && (!reflect.DeepEqual(shallows, tc.wantShallow) || !reflect.DeepEqual(refs, tc.wantRefs)) {
+			t.Errorf("%q: got %q and %q, want %q and %q", tc.args, shallows, refs, tc.wantShallow, tc.wantRefs)
+		}
+	}
+}
+
+func TestSectionOrderWriter(t *testing.T) {
+	resp := pktLine("wanted-refs\n") + pktLine("0123 refs/heads/master\n") + "0001" +
+		pktLine("shallow-info\n") + pktLine("shallow 0123\n") + "0001" +
+		pktLine("packfile\n") + pktLine("\x01PACK") + "0000"
+	want := pktLine("shallow-info\n") + pktLine("shallow 0123\n") + "0001" +
+		pktLine("wanted-refs\n") + pktLine("0123 refs/heads/master\n") + "0001" +
+		pktLine("packfile\n") + pktLine("\x01PACK") + "0000"
+
+	var b strings.Builder
+	w := &sectionOrderWriter{w: &b}
+	// Split the writes in the middle of pkt-lines.
+	for i := 0; i < len(resp); i += 7 {
+		end := i + 7
+		if end > len(resp) {
+			end = len(resp)
+		}
+		if n, err := w.Write([]byte(resp[i:end])); err != nil || n != end-i {
+			t.Fatalf("Write() = %d, %v, want %d, nil", n, err, end-i)
+		}
+	}
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
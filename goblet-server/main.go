@@ -16,26 +16,35 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/errorreporting"
 	"cloud.google.com/go/logging"
 	"cloud.google.com/go/storage"
+	"contrib.go.opencensus.io/exporter/prometheus"
 	"contrib.go.opencensus.io/exporter/stackdriver"
 	"github.com/google/goblet"
 	googlehook "github.com/google/goblet/google"
 	"github.com/google/uuid"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/grpc/status"
 
 	logpb "google.golang.org/genproto/googleapis/logging/v2"
 )
@@ -46,12 +55,70 @@ const (
 )
 
 var (
-	port      = flag.Int("port", 8080, "port to listen to")
-	cacheRoot = flag.String("cache_root", "", "Root directory of cached repositories")
+	port        = flag.Int("port", 8080, "port to listen to")
+	bindAddress = flag.String("bind_address", "", "Address of the interface to listen to. Empty means all the interfaces")
+	cacheRoot   = flag.String("cache_root", "", "Root directory of cached repositories")
+	metricsAddr = flag.String("metrics_addr", "", "Address to serve Prometheus metrics at /metrics. Empty disables the endpoint")
+	adminAddr   = flag.String("admin_addr", "", "Address to serve the admin API and the health probes. Empty disables them")
+
+	tlsCertFile     = flag.String("tls_cert_file", "", "TLS certificate file. Empty serves plaintext HTTP")
+	tlsKeyFile      = flag.String("tls_key_file", "", "TLS private key file")
+	tlsClientCAFile = flag.String("tls_client_ca_file", "", "CA file to verify the client certificates with. A client with a verified certificate skips the other authorization")
+
+	allowedHosts = flag.String("allowed_hosts", "", "Comma-separated glob patterns of the upstream hosts to proxy to. Empty allows all the hosts")
+	deniedHosts  = flag.String("denied_hosts", "", "Comma-separated glob patterns of the upstream hosts never to proxy to")
+
+	hmacSecretFile  = flag.String("hmac_secret_file", "", "File of the shared secret that the clients sign the requests with. Empty disables the signature check")
+	allowPush       = flag.Bool("allow_push", false, "Forward git-push to the upstream with the client's credential")
+	rateLimit       = flag.Float64("rate_limit", 0, "Fetch requests per second allowed for each client IP. Zero disables the limit")
+	rateLimitBurst  = flag.Int("rate_limit_burst", 10, "Burst size of the per-client rate limit")
+	maxRequestBytes = flag.Int64("max_request_bytes", 0, "Size limit of a git-upload-pack request body. Zero means no limit")
+	maxWants        = flag.Int("max_wants", 0, "Maximum number of wants and want-refs in a fetch request. Zero means no limit")
+	upstreamHTTP    = flag.String("upstream_http_version", "", "HTTP version for the upstream, HTTP/1.1 or HTTP/2. Empty means HTTP/1.1")
+	upstreamTimeout = flag.Duration("upstream_timeout", 0, "Timeout of each request and git-fetch to the upstream. Zero means no timeout")
+	upstreamUA      = flag.String("upstream_user_agent", "", "User-Agent of the requests and git-fetch to the upstream. Empty sends the defaults of Go and git")
+	upstreamHeaders = flag.String("upstream_extra_headers", "", "Comma-separated \"Name: value\" headers added to the requests and git-fetch to the upstream")
+	maxFetches      = flag.Int("max_concurrent_fetches", 0, "Maximum number of upstream git-fetches running at the same time. Zero means no limit")
+	maxFetchWait    = flag.Duration("max_fetch_wait", 0, "How long a fetch waits for the upstream before a partial clone is served what the cache has and the others are told to retry. Zero means no limit")
+	breakerFailures = flag.Int("circuit_breaker_threshold", 0, "Consecutive failures to reach an upstream host after which its requests fail immediately for the cooldown. Zero disables the circuit breaker")
+	breakerCooldown = flag.Duration("circuit_breaker_cooldown", 30*time.Second, "How long the circuit breaker of an upstream host stays open")
+	serveStale      = flag.Bool("serve_stale_on_upstream_error", false, "Answer ls-refs from the cache when the upstream is unavailable")
+	bundleURIBase   = flag.String("bundle_uri_base", "", "URL of this server seen from the clients. If set, the bundles of the repositories are advertised with bundle-uri")
+	lsRefsWindow    = flag.Duration("ls_refs_cache_window", 0, "How long ls-refs is answered from the cache after the cache matched the upstream. Zero always asks the upstream")
+
+	initialFetchRefspecs = flag.String("initial_fetch_refspecs", "", "Comma-separated refspecs fetched first into an empty cache. Empty means the heads and the Gerrit changes")
+	mirrorRefspecs       = flag.String("mirror_refspecs", "", "Comma-separated refspecs of the refs mirrored into the cache. The fetches of the other refs are forwarded to the upstream. Empty mirrors all the refs")
+	splitInitialFetch    = flag.Bool("split_initial_fetch", true, "Fetch the initial fetch refspecs first into an empty cache")
+	importManifest       = flag.String("import_manifest", "", "Manifest file written by goblet.ExportManifest to import into the cache on startup")
+	manifestBundleDir    = flag.String("manifest_bundle_dir", "", "Directory of the bundles referenced from the imported manifest")
+	seedRepositories     = flag.String("seed_repositories", "", "Comma-separated upstream URLs fetched into the cache on startup")
 
 	stackdriverProject      = flag.String("stackdriver_project", "", "GCP project ID used for the Stackdriver integration")
 	stackdriverLoggingLogID = flag.String("stackdriver_logging_log_id", "", "Stackdriver logging Log ID")
 
+	cacheTTL        = flag.Duration("cache_ttl", 0, "Age after which a cached repository is refreshed in the background. Zero disables the background refresh")
+	refreshInterval = flag.Duration("refresh_interval", time.Minute, "Interval of checking cached repositories for the background refresh")
+
+	jsonOperationLog = flag.Bool("json_operation_log", false, "Log the long running operations to stderr as JSON records with the duration and the error")
+
+	logLevel             = flag.String("log_level", "info", "Verbosity of the log: error, info, or debug. The requests are logged at debug")
+	requestLogSampleRate = flag.Float64("request_log_sample_rate", 0, "Fraction of the requests logged, between 0 and 1. The failed requests are always logged. Zero logs all the requests")
+
+	gcInterval = flag.Duration("gc_interval", 0, "Interval of repacking cached repositories, such as 24h. Zero, the default, disables the repacking")
+
+	gitBinaryPath  = flag.String("git_binary", "", "Path to the git binary. Empty means git in PATH")
+	extraGitConfig = flag.String("git_config", "", "Comma-separated key=value pairs passed to every git invocation with -c")
+
+	maxCacheBytes    = flag.Int64("max_cache_bytes", 0, "Size limit of the cache root. The least recently updated repositories are evicted beyond this. Zero disables the eviction")
+	evictionInterval = flag.Duration("eviction_interval", 10*time.Minute, "Interval of checking the cache size for the eviction")
+	maxRepositories  = flag.Int("max_repositories", 0, "Number of the repositories that can be cached at once. Zero means no limit")
+
+	minFreeDiskBytes  = flag.Int64("min_free_disk_bytes", 0, "Free space of the cache filesystem below which a warning is logged. Zero disables the check")
+	diskCheckInterval = flag.Duration("disk_check_interval", time.Minute, "Interval of checking the free space of the cache filesystem")
+
+	cacheDirMode   = flag.String("cache_dir_mode", "", "Octal permission of the directories created in the cache, such as 0770. The files get it without the execute bits. Empty means 0750 with the umask applied")
+	hashCachePaths = flag.Bool("hash_cache_paths", false, "Name the cache directories with the SHA-256 of the repository path under the host's directory, for the deep paths that are too long for the filesystem. Changing it orphans the existing cache")
+
 	backupBucketName   = flag.String("backup_bucket_name", "", "Name of the GCS bucket for backed-up repositories")
 	backupManifestName = flag.String("backup_manifest_name", "", "Name of the backup manifest")
 
@@ -112,6 +179,57 @@ var (
 			Measure:     goblet.UpstreamFetchWaitingTime,
 			Aggregation: latencyDistributionAggregation,
 		},
+		// The views below are named for Prometheus. They're exported as
+		// goblet_<name>.
+		{
+			Name:        "fetch_total",
+			Description: "Number of git-fetch runs against the upstream",
+			TagKeys:     []tag.Key{goblet.UpstreamHostKey, goblet.CommandCanonicalStatusKey},
+			Measure:     goblet.UpstreamFetchCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "fetch_latency",
+			Description: "Latency of git-fetch runs against the upstream",
+			TagKeys:     []tag.Key{goblet.UpstreamHostKey, goblet.CommandCanonicalStatusKey},
+			Measure:     goblet.UpstreamFetchProcessingTime,
+			Aggregation: latencyDistributionAggregation,
+		},
+		{
+			Name:        "cache_hits_total",
+			Description: "Number of fetch commands served without an upstream fetch",
+			TagKeys:     []tag.Key{goblet.UpstreamHostKey},
+			Measure:     goblet.CacheHitCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "cache_misses_total",
+			Description: "Number of fetch commands that waited for an upstream fetch",
+			TagKeys:     []tag.Key{goblet.UpstreamHostKey},
+			Measure:     goblet.CacheMissCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "served_bytes_total",
+			Description: "Bytes of fetch responses served from the local cache",
+			TagKeys:     []tag.Key{goblet.UpstreamHostKey},
+			Measure:     goblet.LocallyServedBytes,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        "upstream_circuit_open",
+			Description: "Whether the circuit breaker of the upstream host is open",
+			TagKeys:     []tag.Key{goblet.UpstreamHostKey},
+			Measure:     goblet.UpstreamCircuitOpen,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        "upstream_short_circuits_total",
+			Description: "Upstream requests short-circuited by the circuit breaker",
+			TagKeys:     []tag.Key{goblet.UpstreamHostKey},
+			Measure:     goblet.UpstreamShortCircuitCount,
+			Aggregation: view.Count(),
+		},
 	}
 )
 
@@ -129,18 +247,42 @@ func main() {
 	if err := view.Register(views...); err != nil {
 		log.Fatal(err)
 	}
+	if *metricsAddr != "" {
+		pe, err := prometheus.NewExporter(prometheus.Options{Namespace: "goblet"})
+		if err != nil {
+			log.Fatalf("Cannot create a Prometheus exporter: %v", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", pe)
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsAddr, mux))
+		}()
+	}
 
 	var er func(*http.Request, error)
-	var rl func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) = func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) {
+	level, err := goblet.ParseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var rl func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration, info goblet.RequestInfo) = func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration, info goblet.RequestInfo) {
+		if level < goblet.LogLevelDebug {
+			return
+		}
 		dump, err := httputil.DumpRequest(r, false)
 		if err != nil {
 			return
 		}
-		log.Printf("%q %d reqsize: %d, respsize %d, latency: %v", dump, status, requestSize, responseSize, latency)
+		log.Printf("%q %d reqsize: %d, respsize %d, latency: %v, cache: %q, fetch wait: %v", dump, status, requestSize, responseSize, latency, info.CacheOutcome, info.FetchWait)
 	}
-	var lrol func(string, *url.URL) goblet.RunningOperation = func(action string, u *url.URL) goblet.RunningOperation {
-		log.Printf("Starting %s for %s", action, u.String())
-		return &logBasedOperation{action, u}
+	var lrol func(context.Context, string, *url.URL) goblet.RunningOperation = func(ctx context.Context, action string, u *url.URL) goblet.RunningOperation {
+		op := &logBasedOperation{action, u, goblet.RequestID(ctx), level}
+		if level >= goblet.LogLevelInfo {
+			log.Printf("[%s] Starting %s for %s", op.requestID, action, u.String())
+		}
+		return op
+	}
+	if *jsonOperationLog {
+		lrol = goblet.NewJSONOperationLogger(os.Stderr)
 	}
 	var backupLogger *log.Logger = log.New(os.Stderr, "", log.LstdFlags)
 	if *stackdriverProject != "" {
@@ -157,6 +299,10 @@ func main() {
 			}
 		}()
 		er = func(r *http.Request, err error) {
+			if runtime.HTTPStatusFromCode(status.Code(err)) < http.StatusInternalServerError {
+				// Do not report client errors.
+				return
+			}
 			ec.Report(errorreporting.Entry{
 				Req:   r,
 				Error: err,
@@ -177,7 +323,7 @@ func main() {
 
 			// Request logger
 			sdLogger := lc.Logger(*stackdriverLoggingLogID)
-			rl = func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) {
+			rl = func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration, info goblet.RequestInfo) {
 				sdLogger.Log(logging.Entry{
 					HTTPRequest: &logging.HTTPRequest{
 						Request:      r,
@@ -186,21 +332,25 @@ func main() {
 						ResponseSize: responseSize,
 						Latency:      latency,
 						RemoteIP:     r.RemoteAddr,
+						CacheLookup:  info.CacheOutcome != "",
+						CacheHit:     info.CacheOutcome == goblet.CacheHit,
 					},
 				})
 			}
-			lrol = func(action string, u *url.URL) goblet.RunningOperation {
+			lrol = func(ctx context.Context, action string, u *url.URL) goblet.RunningOperation {
 				op := &stackdriverBasedOperation{
 					sdLogger:  sdLogger,
 					action:    action,
 					u:         u,
+					requestID: goblet.RequestID(ctx),
 					startTime: time.Now(),
 					id:        uuid.New().String(),
 				}
 				op.sdLogger.Log(logging.Entry{
-					Payload: &LongRunningOperation{
-						Action: op.action,
-						URL:    op.u.String(),
+					Payload: &goblet.LongRunningOperation{
+						Action:    op.action,
+						URL:       op.u.String(),
+						RequestID: op.requestID,
 					},
 					Operation: &logpb.LogEntryOperation{
 						Id:       op.id,
@@ -224,6 +374,7 @@ func main() {
 		if err = exporter.StartMetricsExporter(); err != nil {
 			log.Fatal(err)
 		}
+		trace.RegisterExporter(exporter)
 	}
 
 	config := &goblet.ServerConfig{
@@ -233,7 +384,98 @@ func main() {
 		TokenSource:                ts,
 		ErrorReporter:              er,
 		RequestLogger:              rl,
+		RequestLogSampleRate:       *requestLogSampleRate,
 		LongRunningOperationLogger: lrol,
+		CacheTTL:                   *cacheTTL,
+		RefreshInterval:            *refreshInterval,
+		MaxCacheBytes:              *maxCacheBytes,
+		EvictionInterval:           *evictionInterval,
+		MaxRepositories:            *maxRepositories,
+		MinFreeDiskBytes:           *minFreeDiskBytes,
+		DiskCheckInterval:          *diskCheckInterval,
+		UpstreamTimeout:            *upstreamTimeout,
+		UpstreamUserAgent:          *upstreamUA,
+		UpstreamHTTPVersion:        *upstreamHTTP,
+		AllowPush:                  *allowPush,
+		GCInterval:                 *gcInterval,
+		GitBinaryPath:              *gitBinaryPath,
+		MaxConcurrentFetches:       *maxFetches,
+		MaxFetchWait:               *maxFetchWait,
+		CircuitBreakerThreshold:    *breakerFailures,
+		CircuitBreakerCooldown:     *breakerCooldown,
+		DisableInitialSplitFetch:   !*splitInitialFetch,
+		ServeStaleOnUpstreamError:  *serveStale,
+		LsRefsCacheWindow:          *lsRefsWindow,
+		BundleURIBase:              *bundleURIBase,
+		MaxRequestBytes:            *maxRequestBytes,
+		MaxWants:                   *maxWants,
+		LogLevel:                   level,
+	}
+	if *minFreeDiskBytes > 0 {
+		config.DiskPressureCallback = func(free, total uint64) {
+			goblet.Logf(config, goblet.LogLevelError, "The cache filesystem is running out of space: %d of %d bytes free", free, total)
+		}
+	}
+	if *cacheDirMode != "" {
+		mode, err := strconv.ParseUint(*cacheDirMode, 8, 32)
+		if err != nil {
+			log.Fatalf("Invalid -cache_dir_mode: %v", err)
+		}
+		config.CacheDirMode = os.FileMode(mode)
+	}
+	if *hashCachePaths {
+		config.CachePathHasher = goblet.HashCachePath
+	}
+	if *rateLimit > 0 {
+		config.RateLimit = &goblet.RateLimit{RequestsPerSecond: *rateLimit, Burst: *rateLimitBurst}
+	}
+	if *extraGitConfig != "" {
+		config.ExtraGitConfig = strings.Split(*extraGitConfig, ",")
+	}
+	if *upstreamHeaders != "" {
+		config.UpstreamExtraHeaders = map[string]string{}
+		for _, h := range strings.Split(*upstreamHeaders, ",") {
+			ss := strings.SplitN(h, ":", 2)
+			if len(ss) != 2 || strings.TrimSpace(ss[0]) == "" {
+				log.Fatalf("Invalid -upstream_extra_headers: %q is not \"Name: value\"", h)
+			}
+			config.UpstreamExtraHeaders[strings.TrimSpace(ss[0])] = strings.TrimSpace(ss[1])
+		}
+	}
+	if *initialFetchRefspecs != "" {
+		config.InitialFetchRefspecs = strings.Split(*initialFetchRefspecs, ",")
+	}
+	if *mirrorRefspecs != "" {
+		config.MirrorRefspecs = strings.Split(*mirrorRefspecs, ",")
+	}
+	if *allowedHosts != "" {
+		config.AllowedHosts = strings.Split(*allowedHosts, ",")
+	}
+	if *deniedHosts != "" {
+		config.DeniedHosts = strings.Split(*deniedHosts, ",")
+	}
+	if *hmacSecretFile != "" {
+		bs, err := ioutil.ReadFile(*hmacSecretFile)
+		if err != nil {
+			log.Fatalf("Cannot read the HMAC secret: %v", err)
+		}
+		config.HMACSecret = []byte(strings.TrimSpace(string(bs)))
+	}
+	if *seedRepositories != "" {
+		config.SeedRepositories = strings.Split(*seedRepositories, ",")
+	}
+	var tlsConfig *tls.Config
+	if *tlsCertFile != "" {
+		tlsConfig, err = goblet.NewTLSConfig(*tlsCertFile, *tlsKeyFile, *tlsClientCAFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *tlsClientCAFile != "" {
+			config.RequestAuthorizer = goblet.ClientCertificateAuthorizer(config.RequestAuthorizer)
+		}
+	}
+	if err := goblet.ValidateConfig(config); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
 	if *backupBucketName != "" && *backupManifestName != "" {
@@ -245,47 +487,80 @@ func main() {
 		googlehook.RunBackupProcess(config, gsClient.Bucket(*backupBucketName), *backupManifestName, backupLogger)
 	}
 
+	if *importManifest != "" {
+		f, err := os.Open(*importManifest)
+		if err != nil {
+			log.Fatalf("Cannot open the manifest: %v", err)
+		}
+		if err := goblet.ImportManifest(config, f, *manifestBundleDir, false); err != nil {
+			log.Printf("Cannot import some repositories: %v", err)
+		}
+		f.Close()
+	}
+
+	goblet.RunRefreshProcess(config)
+	goblet.RunEvictionProcess(config)
+	goblet.RunGCProcess(config)
+	goblet.RunDiskPressureProcess(config)
+	goblet.RunSeedProcess(config)
+
+	if *adminAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*adminAddr, goblet.AdminHandler(config)))
+		}()
+	}
+
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
 		io.WriteString(w, "ok\n")
 	})
 	http.Handle("/", goblet.HTTPHandler(config))
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
-}
-
-type LongRunningOperation struct {
-	Action          string `json:"action"`
-	URL             string `json:"url"`
-	DurationMs      int    `json:"duration_msec,omitempty"`
-	Error           string `json:"error,omitempty"`
-	ProgressMessage string `json:"progress_message,omitempty"`
+	server := &http.Server{
+		Addr:      net.JoinHostPort(*bindAddress, strconv.Itoa(*port)),
+		TLSConfig: tlsConfig,
+	}
+	if tlsConfig != nil {
+		// The certificate is in tlsConfig.
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(server.ListenAndServe())
 }
 
 type logBasedOperation struct {
-	action string
-	u      *url.URL
+	action    string
+	u         *url.URL
+	requestID string
+	level     goblet.LogLevel
 }
 
 func (op *logBasedOperation) Printf(format string, a ...interface{}) {
-	log.Printf("Progress %s (%s): %s", op.action, op.u.String(), fmt.Sprintf(format, a...))
+	if op.level < goblet.LogLevelInfo {
+		return
+	}
+	log.Printf("[%s] Progress %s (%s): %s", op.requestID, op.action, op.u.String(), fmt.Sprintf(format, a...))
 }
 
 func (op *logBasedOperation) Done(err error) {
-	log.Printf("Finished %s for %s: %v", op.action, op.u.String(), err)
+	if err == nil && op.level < goblet.LogLevelInfo {
+		return
+	}
+	log.Printf("[%s] Finished %s for %s: %v", op.requestID, op.action, op.u.String(), err)
 }
 
 type stackdriverBasedOperation struct {
 	sdLogger  *logging.Logger
 	action    string
 	u         *url.URL
+	requestID string
 	startTime time.Time
 	id        string
 }
 
 func (op *stackdriverBasedOperation) Printf(format string, a ...interface{}) {
-	lro := &LongRunningOperation{
+	lro := &goblet.LongRunningOperation{
 		Action:          op.action,
 		URL:             op.u.String(),
+		RequestID:       op.requestID,
 		ProgressMessage: fmt.Sprintf(format, a...),
 	}
 	op.sdLogger.Log(logging.Entry{
@@ -298,10 +573,12 @@ func (op *stackdriverBasedOperation) Printf(format string, a ...interface{}) {
 }
 
 func (op *stackdriverBasedOperation) Done(err error) {
-	lro := &LongRunningOperation{
+	lro := &goblet.LongRunningOperation{
 		Action:     op.action,
 		URL:        op.u.String(),
+		RequestID:  op.requestID,
 		DurationMs: int(time.Since(op.startTime) / time.Millisecond),
+		Done:       true,
 	}
 	if err != nil {
 		lro.Error = err.Error()
@@ -15,14 +15,19 @@
 package goblet
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"time"
 
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -38,6 +43,9 @@ var (
 	// or not ("OK", "Unauthenticated").
 	CommandCanonicalStatusKey = tag.MustNewKey("github.com/google/goblet/command-status")
 
+	// UpstreamHostKey indicates the host of the upstream repository.
+	UpstreamHostKey = tag.MustNewKey("github.com/google/goblet/upstream-host")
+
 	// InboundCommandProcessingTime is a processing time of the inbound
 	// commands.
 	InboundCommandProcessingTime = stats.Int64("github.com/google/goblet/inbound-command-processing-time", "processing time of inbound commands", stats.UnitMilliseconds)
@@ -55,22 +63,409 @@ var (
 
 	// OutboundCommandCount is a count of outbound commands.
 	OutboundCommandCount = stats.Int64("github.com/google/goblet/outbound-command-count", "number of outbound commands", stats.UnitDimensionless)
+
+	// UpstreamFetchCount is a count of git-fetch runs against the upstream.
+	UpstreamFetchCount = stats.Int64("github.com/google/goblet/upstream-fetch-count", "number of upstream fetches", stats.UnitDimensionless)
+
+	// UpstreamFetchProcessingTime is a processing time of git-fetch runs
+	// against the upstream.
+	UpstreamFetchProcessingTime = stats.Int64("github.com/google/goblet/upstream-fetch-processing-time", "processing time of upstream fetches", stats.UnitMilliseconds)
+
+	// CacheHitCount is a count of fetch commands that could be served
+	// without fetching from the upstream.
+	CacheHitCount = stats.Int64("github.com/google/goblet/cache-hit-count", "number of fetch commands served from the cache without an upstream fetch", stats.UnitDimensionless)
+
+	// CacheMissCount is a count of fetch commands that needed to wait for
+	// a fetch from the upstream.
+	CacheMissCount = stats.Int64("github.com/google/goblet/cache-miss-count", "number of fetch commands that needed an upstream fetch", stats.UnitDimensionless)
+
+	// LocallyServedBytes is the size of the fetch responses served from the
+	// local cache.
+	LocallyServedBytes = stats.Int64("github.com/google/goblet/locally-served-bytes", "bytes of fetch responses served from the local cache", stats.UnitBytes)
+
+	// UpstreamCircuitOpen is 1 when the circuit breaker of an upstream host
+	// opens, and 0 when it closes. See
+	// ServerConfig.CircuitBreakerThreshold.
+	UpstreamCircuitOpen = stats.Int64("github.com/google/goblet/upstream-circuit-open", "whether the circuit breaker of the upstream host is open", stats.UnitDimensionless)
+
+	// UpstreamShortCircuitCount is a count of upstream requests that are
+	// not sent because the circuit breaker of the host is open.
+	UpstreamShortCircuitCount = stats.Int64("github.com/google/goblet/upstream-short-circuit-count", "number of upstream requests short-circuited by the circuit breaker", stats.UnitDimensionless)
 )
 
 type ServerConfig struct {
 	LocalDiskCacheRoot string
 
+	// StorageBackend manages the directories of the cached repositories.
+	// If not set, they are kept under LocalDiskCacheRoot.
+	StorageBackend StorageBackend
+
+	// CacheDirMode is the permission of the directories created in the
+	// cache regardless of the umask. The files, including the ones that
+	// git writes, get it without the execute bits. If zero, the
+	// directories are 0750 and the umask applies.
+	CacheDirMode os.FileMode
+
+	// CachePathHasher replaces the path of the upstream URL in the cache
+	// directory under LocalDiskCacheRoot, such as HashCachePath for
+	// bounding the length of deep paths. The host stays readable, and
+	// the upstream URL is written to a file in the directory. Changing
+	// it orphans the existing cache directories.
+	CachePathHasher func(path string) string
+
+	// URLCanonializer converts a request URL to the upstream repository
+	// URL. Request URLs that map to the same upstream URL share a cache.
+	// If not set, HostURLCanonializers are used, and for the other hosts
+	// only the Git endpoint suffixes are stripped.
 	URLCanonializer func(*url.URL) (*url.URL, error)
 
+	// HostURLCanonializers are the URL canonicalizers for the upstream
+	// hosts, such as GitHubURLCanonializer for "github.com". They handle
+	// the URL variations of the hosting service, such as the case of the
+	// names. They are used only if URLCanonializer is not set.
+	HostURLCanonializers map[string]func(*url.URL) (*url.URL, error)
+
+	// GitSuffixHosts are the upstream hosts whose repository URLs need the
+	// ".git" suffix. If URLCanonializer is not set, ".git" is added to the
+	// URLs of these hosts and stripped from the others, so that "repo" and
+	// "repo.git" share a cache.
+	GitSuffixHosts []string
+
+	// AllowedHosts are the glob patterns, as in path.Match, of the upstream
+	// host names that the server proxies to. "*.example.com" matches the
+	// subdomains. If empty, all the hosts are allowed unless denied.
+	AllowedHosts []string
+
+	// DeniedHosts are the glob patterns of the upstream host names that the
+	// server never proxies to. They take precedence over AllowedHosts. The
+	// requests for them fail with PermissionDenied before any upstream
+	// access.
+	DeniedHosts []string
+
+	// RequestAuthorizer checks whether the request is allowed. The cache is
+	// shared and the upstream is accessed with the server's credential, so
+	// this is the only access control. It's called for every request,
+	// including the fetches served from the cache; check per-repository
+	// access here. A plain error is treated as PermissionDenied.
 	RequestAuthorizer func(*http.Request) error
 
+	// HMACSecret, if set, requires the requests to be signed with it.
+	// See HMACSignature. This is checked in addition to RequestAuthorizer.
+	HMACSecret []byte
+
+	// HMACSignatureTTL is how long a signature is valid. Defaults to 5
+	// minutes.
+	HMACSignatureTTL time.Duration
+
+	// CacheRealm returns the realm of a request, such as the group of the
+	// users that share the same access. Each realm has its own cache of
+	// the repositories, so that a client cannot read the objects fetched
+	// with another realm's access. Nil or an empty realm uses the default
+	// cache.
+	CacheRealm func(*http.Request) (string, error)
+
+	// TokenSource provides the server's credential for the upstream. If
+	// not set, the upstream is accessed without a credential.
 	TokenSource oauth2.TokenSource
 
+	// HostConfig overrides the settings for the upstream hosts, keyed by
+	// the host of the canonical URL.
+	HostConfig map[string]HostSettings
+
+	// ErrorReporter is called with every error returned to the clients.
+	// The error has a gRPC status code that tells whether it's a client
+	// error or a server error.
 	ErrorReporter func(*http.Request, error)
 
-	RequestLogger func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration)
+	// RequestLogger is called when a request is done. info tells whether
+	// the fetches are served from the cache.
+	RequestLogger func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration, info RequestInfo)
+
+	// RequestLogSampleRate is the fraction of the requests passed to
+	// RequestLogger, between 0 and 1. The failed requests are always
+	// passed. Zero passes all the requests.
+	RequestLogSampleRate float64
+
+	// LongRunningOperationLogger starts the log of an operation on a
+	// repository, such as an upstream fetch. RequestID of the context
+	// correlates the operation with the request that started it.
+	LongRunningOperationLogger func(context.Context, string, *url.URL) RunningOperation
+
+	// CacheTTL is the age after which RunRefreshProcess fetches a cached
+	// repository from the upstream. Zero disables the background refresh.
+	CacheTTL time.Duration
+
+	// RefreshInterval is how often RunRefreshProcess looks for stale
+	// repositories.
+	RefreshInterval time.Duration
+
+	// PinnedRefs maps a canonical upstream URL to the full names of the
+	// refs that are kept warm, e.g. the branches under heavy CI. On every
+	// RefreshInterval, RunRefreshProcess fetches the repository if one of
+	// them is behind the upstream, even before a client asks for it. The
+	// repository is never evicted, and it's repacked before the others.
+	PinnedRefs map[string][]string
+
+	// MaxCacheBytes is the size limit of LocalDiskCacheRoot enforced by
+	// RunEvictionProcess. Zero disables the eviction.
+	MaxCacheBytes int64
+
+	// MaxRepositories is the number of the repositories that can be cached
+	// at once. Caching another one fails with ResourceExhausted until one
+	// is evicted. This keeps the requests for arbitrary upstreams from
+	// filling the cache. Only the repositories opened since the start of
+	// the server are counted. Zero means no limit.
+	MaxRepositories int
+
+	// EvictionInterval is how often RunEvictionProcess checks the cache
+	// size.
+	EvictionInterval time.Duration
+
+	// MinFreeDiskBytes is the free space of the filesystem of
+	// LocalDiskCacheRoot below which RunDiskPressureProcess calls
+	// DiskPressureCallback. Zero disables the check.
+	MinFreeDiskBytes int64
+
+	// DiskCheckInterval is how often RunDiskPressureProcess checks the free
+	// space.
+	DiskCheckInterval time.Duration
+
+	// DiskPressureCallback is called with the free and the total bytes of
+	// the filesystem when the free space is below MinFreeDiskBytes, e.g. to
+	// alert before the eviction kicks in. It's called on every check until
+	// the space is freed.
+	DiskPressureCallback func(freeBytes, totalBytes uint64)
+
+	// OnRepositoryCreated is called with the canonical URL when a
+	// repository is about to be cached for the first time, e.g. to record
+	// the cache growth. An error rejects the repository, such as for a
+	// per-tenant quota, and a plain error is treated as ResourceExhausted.
+	// It's called once per cache directory; the concurrent opens of the
+	// same repository wait for it. It's called without the repository's
+	// lock, so it can use the other ManagedRepository methods.
+	OnRepositoryCreated func(*url.URL) error
+
+	// ProtocolV1Fallback makes the server forward Git protocol v0/v1
+	// fetch requests to the upstream as is instead of rejecting them.
+	// These requests are not cached.
+	ProtocolV1Fallback bool
+
+	// UpstreamTimeout bounds each request and git-fetch to the upstream.
+	// Zero means no timeout.
+	UpstreamTimeout time.Duration
+
+	// UpstreamHTTPVersion is the HTTP version for the upstream, "HTTP/1.1"
+	// or "HTTP/2". It applies to git-fetch and the requests made by this
+	// server. Defaults to HTTP/1.1, because HTTP/2 of libcurl has been
+	// unreliable with git-fetch.
+	UpstreamHTTPVersion string
+
+	// UpstreamHTTPClient, if set, is used for the requests to the upstream
+	// made by this server, instead of a client with a pooled transport that
+	// follows UpstreamHTTPVersion. Redirects are handled by this server
+	// regardless of its CheckRedirect.
+	UpstreamHTTPClient *http.Client
+
+	// UpstreamUserAgent is the User-Agent of the requests and git-fetch to
+	// the upstream, so that the upstream can tell the traffic of this
+	// server. If not set, Go's and git's defaults are sent.
+	UpstreamUserAgent string
+
+	// UpstreamExtraHeaders are added to the requests and git-fetch to the
+	// upstream, keyed by the header names. Authorization and Git-Protocol
+	// are set by the server and cannot be overridden.
+	UpstreamExtraHeaders map[string]string
+
+	// AllowPush makes the server forward git-push requests to the upstream
+	// with the client's credential. The cache is updated after a push.
+	AllowPush bool
+
+	// GCInterval is how often RunGCProcess repacks the cached
+	// repositories. Zero disables the repacking.
+	GCInterval time.Duration
+
+	// ObjectStoreGroup returns the group of a canonical upstream URL, such
+	// as the base repository of the forks. The repositories in the same
+	// non-empty group share an object store under LocalDiskCacheRoot with
+	// git alternates: git-fetch downloads only the objects missing from
+	// the store, and RunGCProcess moves the new objects of a repository to
+	// the store. The store is never evicted nor pruned.
+	ObjectStoreGroup func(*url.URL) string
+
+	// WantCheckInterval is how often a fetch waiting for the upstream checks
+	// whether the cache already has the wanted objects. Defaults to 1s.
+	WantCheckInterval time.Duration
+
+	// MaxFetchWait is how long a fetch waits for the upstream fetch of the
+	// wants that the cache doesn't have. After that, a partial clone, which
+	// sends a filter, is served the wants that the cache has, and the
+	// client fetches the rest on demand. The other fetches fail with
+	// Unavailable so that the clients retry later. The upstream fetch
+	// continues either way. Zero means no limit.
+	MaxFetchWait time.Duration
+
+	// FetchRetries is how many times a failed upstream git-fetch is retried.
+	// Zero disables the retries.
+	FetchRetries int
+
+	// FetchRetryBackoff is the wait before the first retry of a failed
+	// git-fetch. It doubles on each retry. Defaults to 1s.
+	FetchRetryBackoff time.Duration
+
+	// EnableResponseGzip makes the server gzip the git-upload-pack responses
+	// for the clients that accept it.
+	EnableResponseGzip bool
+
+	// GzipLevel is the compression level of the gzipped responses, from
+	// gzip.BestSpeed to gzip.BestCompression. Zero means
+	// gzip.DefaultCompression.
+	GzipLevel int
+
+	// MinGzipBytes is the response size below which the response is not
+	// gzipped. The response is buffered up to this size. Zero gzips all the
+	// responses.
+	MinGzipBytes int
 
-	LongRunningOperationLogger func(string, *url.URL) RunningOperation
+	// ServeStaleOnUpstreamError makes the server answer ls-refs from the
+	// cache when the upstream is unavailable. The refs can be stale.
+	ServeStaleOnUpstreamError bool
+
+	// LsRefsCacheWindow is how long ls-refs is answered from the cache
+	// without asking the upstream after the cache is known to match the
+	// upstream, by a fetch or by an ls-refs with the same ref prefixes. The
+	// refs can be stale up to this long. Zero always asks the upstream.
+	LsRefsCacheWindow time.Duration
+
+	// NegativeCacheTTL is how long the server remembers that an upstream
+	// repository is not found, answering ls-refs for it without asking the
+	// upstream. Zero disables the negative cache.
+	NegativeCacheTTL time.Duration
+
+	// MirrorURLs maps a canonical upstream URL to its mirrors. The mirrors
+	// are tried in order when the upstream is not reachable, or, for
+	// git-fetch, when the fetch fails. A mirror that answers "not found"
+	// is skipped too, since it can lag behind the upstream; the repository
+	// is treated as not found only if the upstream or all the mirrors say
+	// so.
+	MirrorURLs map[string][]*url.URL
+
+	// GitBinaryPath is the git binary to run. If not set, git is looked up
+	// in PATH.
+	GitBinaryPath string
+
+	// ExtraGitConfig is a list of "key=value" passed as "-c key=value" to
+	// every git invocation, e.g. "pack.threads=4".
+	ExtraGitConfig []string
+
+	// MaxRequestBytes is the size limit of a git-upload-pack request body
+	// after decompression. A larger request is rejected with 413. Zero
+	// means no limit.
+	MaxRequestBytes int64
+
+	// AdvertisedCapabilities are the Git protocol v2 capabilities
+	// advertised in /info/refs, such as "agent=goblet". The object-format
+	// capability is always added with the format of the cache. Nil
+	// advertises "ls-refs", "fetch=filter shallow ref-in-want", and
+	// "server-option". For an HTTP upstream, the fetch features and
+	// "server-option" that the upstream doesn't advertise are dropped.
+	// "packfile-uris" and "sideband-all" are added to the fetch features if
+	// PackfileURIResolver is set.
+	AdvertisedCapabilities []string
+
+	// PackfileURIResolver returns the objects of a repository that are
+	// hosted elsewhere, such as large blobs on a CDN. If set, the fetch
+	// capability advertises "packfile-uris", and the clients that support
+	// it download these objects from the URIs instead of this server.
+	PackfileURIResolver func(*url.URL) ([]PackfileURI, error)
+
+	// BundleURIBase is the URL of this server seen from the clients, e.g.
+	// "https://goblet.example.com". If set, the "bundle-uri" capability
+	// is advertised, and a client can clone from the bundle of the
+	// repository served at BundleURIBase + the repository path +
+	// "/goblet-bundle" before fetching the rest.
+	BundleURIBase string
+
+	// BundleFetcher downloads a bundle given to RecoverFromBundle as a URL
+	// with a scheme other than "file", such as "gs://bucket/repo.bundle",
+	// by writing its content to w. The bundle is saved to a temporary file
+	// before applied. A local path is read directly.
+	BundleFetcher func(ctx context.Context, uri *url.URL, w io.Writer) error
+
+	// LogLevel is the verbosity of the log written through Logf. Defaults
+	// to LogLevelInfo.
+	LogLevel LogLevel
+
+	// MaxWants is the maximum number of wants and want-refs in a fetch
+	// command. A fetch with more is rejected as InvalidArgument. Zero means
+	// no limit.
+	MaxWants int
+
+	// RateLimit limits the fetch requests of each client. Nil disables the
+	// limit.
+	RateLimit *RateLimit
+
+	// CircuitBreakerThreshold is the number of consecutive failures to
+	// reach an upstream host, such as connection errors, timeouts, and
+	// server errors, after which the requests to the host fail immediately
+	// for CircuitBreakerCooldown. Meanwhile the mirrors in MirrorURLs are
+	// tried, and ls-refs is answered from the cache if it has the
+	// repository. After the cooldown, a single request probes the host
+	// again while the others keep failing until its result. Zero disables
+	// the circuit breaker.
+	CircuitBreakerThreshold int
+
+	// CircuitBreakerCooldown is how long the circuit breaker stays open.
+	// Defaults to 30 seconds.
+	CircuitBreakerCooldown time.Duration
+
+	// MaxConcurrentFetches is the maximum number of upstream git-fetches
+	// that run at the same time. Other fetches wait for one of them to
+	// finish. Zero means no limit.
+	MaxConcurrentFetches int
+
+	// InitialFetchRefspecs are fetched first when a repository is fetched
+	// into an empty cache, before all the other refs. This works around
+	// a slow initial fetch of repositories with many refs. Defaults to
+	// "refs/heads/*:refs/heads/*" and "refs/changes/*:refs/changes/*",
+	// which suit Gerrit.
+	InitialFetchRefspecs []string
+
+	// MirrorRefspecs restrict the refs mirrored into the cache, such as
+	// "refs/heads/*:refs/heads/*" and "refs/tags/*:refs/tags/*". A refspec
+	// must keep the ref names. A fetch of a ref or an object outside of
+	// them is forwarded to the upstream. If set, the initial fetch is not
+	// split unless InitialFetchRefspecs is set too. If empty, all the refs
+	// are mirrored.
+	MirrorRefspecs []string
+
+	// DisableInitialSplitFetch makes the initial fetch into an empty cache
+	// fetch all refs at once, ignoring InitialFetchRefspecs.
+	DisableInitialSplitFetch bool
+
+	// SeedRepositories are the upstream URLs fetched into the cache on
+	// startup by RunSeedProcess.
+	SeedRepositories []string
+
+	// Tracer creates the spans of the request handling. Defaults to the
+	// OpenCensus default tracer. An OpenTelemetry bridge can be set here to
+	// export the spans to OpenTelemetry.
+	Tracer trace.Tracer
+}
+
+// PackfileURI is an object that a client downloads from a URI. The URI serves a
+// packfile that has the object.
+type PackfileURI struct {
+	// ObjectID is the blob that is excluded from the packfile sent by this
+	// server.
+	ObjectID string
+
+	// PackHash is the hash of the packfile at URI, which the client
+	// verifies.
+	PackHash string
+
+	// URI is where the packfile is. The protocol must be one that the
+	// client accepts, usually "https".
+	URI string
 }
 
 type RunningOperation interface {
@@ -84,19 +479,105 @@ type ManagedRepository interface {
 
 	LastUpdateTime() time.Time
 
+	// DiskUsage returns the size of the cached repository in bytes. The
+	// result can be a few seconds old.
+	DiskUsage() (int64, error)
+
 	RecoverFromBundle(string) error
 
 	WriteBundle(io.Writer) error
+
+	// WriteIncrementalBundle writes a bundle of the objects that are not
+	// reachable from sinceRefs, the tips of an earlier bundle given as
+	// object IDs or ref names. The bundle applies onto a repository that
+	// has these tips, e.g. for a periodic backup after a full one.
+	WriteIncrementalBundle(w io.Writer, sinceRefs []string) error
+
+	// Prefetch fetches the repository from the upstream synchronously. Use
+	// this to warm the cache before clients fetch it.
+	Prefetch(context.Context) error
+
+	// Stats returns the activity of the repository since the server
+	// started.
+	Stats() RepoStats
+}
+
+// HostSettings overrides ServerConfig settings for an upstream host. A zero
+// field falls back to the ServerConfig setting.
+type HostSettings struct {
+	// UpstreamTimeout overrides ServerConfig.UpstreamTimeout.
+	UpstreamTimeout time.Duration
+
+	// TokenSource overrides ServerConfig.TokenSource.
+	TokenSource oauth2.TokenSource
+
+	// InitialFetchRefspecs overrides ServerConfig.InitialFetchRefspecs.
+	InitialFetchRefspecs []string
+
+	// MirrorRefspecs overrides ServerConfig.MirrorRefspecs.
+	MirrorRefspecs []string
+
+	// HTTPVersion overrides ServerConfig.UpstreamHTTPVersion.
+	HTTPVersion string
+}
+
+// RepoStats is the activity of a cached repository since the server started.
+type RepoStats struct {
+	// FetchCount is the number of fetches from the upstream, including the
+	// failed ones.
+	FetchCount int64
+
+	// LastFetchDuration is how long the last upstream fetch took.
+	LastFetchDuration time.Duration
+
+	// LastFetchError is the error of the last upstream fetch, or nil.
+	LastFetchError error
+
+	// ServeCount is the number of fetch responses served from the cache.
+	ServeCount int64
+
+	// ServedBytes is the total size of the fetch responses served from the
+	// cache.
+	ServedBytes int64
 }
 
 func HTTPHandler(config *ServerConfig) http.Handler {
-	return &httpProxyServer{config}
+	return &httpProxyServer{config: config, limiter: newRateLimiter(config.RateLimit)}
 }
 
 func OpenManagedRepository(config *ServerConfig, u *url.URL) (ManagedRepository, error) {
 	return openManagedRepository(config, u)
 }
 
+// OpenManagedRepositoryByPath opens a repository already cached at
+// localDiskPath, taking the upstream URL from the repository. Use this in the
+// tools that work on the cache directories, such as a backup that calls
+// WriteBundle without the original URLs.
+func OpenManagedRepositoryByPath(config *ServerConfig, localDiskPath string) (ManagedRepository, error) {
+	return openManagedRepositoryByPath(config, localDiskPath)
+}
+
+// EvictManagedRepository removes a cached repository from the memory and the
+// disk. It fails with Unavailable while the repository is being fetched or
+// served, and with NotFound if the repository is not cached.
+func EvictManagedRepository(config *ServerConfig, u *url.URL) error {
+	m, err := lookupManagedRepository(config, u)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return status.Errorf(codes.NotFound, "%s is not cached", u)
+	}
+	evicted, err := m.evict()
+	if err != nil {
+		return err
+	}
+	if !evicted {
+		return status.Errorf(codes.Unavailable, "%s is in use, retry later", u)
+	}
+	return nil
+}
+
 func ListManagedRepositories(fn func(ManagedRepository)) {
 	managedRepos.Range(func(key, value interface{}) bool {
 		m := value.(*managedRepository)
@@ -0,0 +1,102 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// HMACSignatureHeader is the request header that carries the
+	// signature made by HMACSignature.
+	HMACSignatureHeader = "X-Goblet-Signature"
+
+	defaultHMACSignatureTTL = 5 * time.Minute
+)
+
+// HMACSignature returns the value of HMACSignatureHeader that authenticates the
+// requests for a repository path, such as "/host/repo", with the shared
+// secret. The signature is valid for ServerConfig.HMACSignatureTTL from t. A
+// client can set it with "git -c http.extraHeader=...".
+func HMACSignature(secret []byte, repoPath string, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",sig=" + hex.EncodeToString(hmacDigest(secret, ts, repoPath))
+}
+
+func hmacDigest(secret []byte, ts, repoPath string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s", ts, repoPath)
+	return mac.Sum(nil)
+}
+
+// signedRepoPath returns the repository path of a request, which is the path
+// without the Git endpoint suffixes. One signature covers all the requests of
+// a git-fetch.
+func signedRepoPath(r *http.Request) string {
+	for _, suffix := range []string{"/info/refs", "/git-upload-pack", "/git-receive-pack"} {
+		if strings.HasSuffix(r.URL.Path, suffix) {
+			return strings.TrimSuffix(r.URL.Path, suffix)
+		}
+	}
+	return r.URL.Path
+}
+
+// verifyHMACSignature checks the HMACSignatureHeader of a request. It returns
+// Unauthenticated if the signature is missing, expired, or doesn't match.
+func verifyHMACSignature(config *ServerConfig, r *http.Request, now time.Time) error {
+	v := r.Header.Get(HMACSignatureHeader)
+	if v == "" {
+		return status.Errorf(codes.Unauthenticated, "%s is required", HMACSignatureHeader)
+	}
+	var ts, sig string
+	for _, kv := range strings.Split(v, ",") {
+		if strings.HasPrefix(kv, "t=") {
+			ts = strings.TrimPrefix(kv, "t=")
+		} else if strings.HasPrefix(kv, "sig=") {
+			sig = strings.TrimPrefix(kv, "sig=")
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "cannot parse %s", HMACSignatureHeader)
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "cannot parse %s", HMACSignatureHeader)
+	}
+	if !hmac.Equal(got, hmacDigest(config.HMACSecret, ts, signedRepoPath(r))) {
+		return status.Error(codes.Unauthenticated, "invalid signature")
+	}
+
+	ttl := config.HMACSignatureTTL
+	if ttl <= 0 {
+		ttl = defaultHMACSignatureTTL
+	}
+	// Allow the same skew for a client clock ahead of this server.
+	if d := now.Sub(time.Unix(unix, 0)); d > ttl || d < -ttl {
+		return status.Error(codes.Unauthenticated, "the signature is expired")
+	}
+	return nil
+}
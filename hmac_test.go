@@ -0,0 +1,64 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPHandler_HMACSignature(t *testing.T) {
+	u := newTestUpstream(t)
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.HMACSecret = []byte("secret")
+	config.HMACSignatureTTL = time.Minute
+	defer clearManagedRepositories()
+
+	now := time.Now()
+	valid := HMACSignature(config.HMACSecret, "/repo", now)
+	tampered := valid[:len(valid)-1] + "0"
+	if tampered == valid {
+		tampered = valid[:len(valid)-1] + "1"
+	}
+	for _, tc := range []struct {
+		name      string
+		signature string
+		want      int
+	}{
+		{"valid", valid, http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"expired", HMACSignature(config.HMACSecret, "/repo", now.Add(-2*time.Minute)), http.StatusUnauthorized},
+		{"tampered", tampered, http.StatusUnauthorized},
+		{"other repository", HMACSignature(config.HMACSecret, "/other", now), http.StatusUnauthorized},
+		{"other secret", HMACSignature([]byte("other"), "/repo", now), http.StatusUnauthorized},
+		{"retimed", strings.Replace(valid, "t=", "t=1", 1), http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/repo/info/refs?service=git-upload-pack", nil)
+		req.Header.Set("Git-Protocol", "version=2")
+		if tc.signature != "" {
+			req.Header.Set(HMACSignatureHeader, tc.signature)
+		}
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d: %s", tc.name, rec.Code, tc.want, rec.Body)
+		}
+	}
+}
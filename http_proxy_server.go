@@ -15,23 +15,38 @@
 package goblet
 
 import (
+	"bytes"
 	"compress/gzip"
+	"context"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/google/gitprotocolio"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// defaultAdvertisedCapabilities are advertised unless
+// ServerConfig.AdvertisedCapabilities is set.
+var defaultAdvertisedCapabilities = []string{
+	"ls-refs",
+	"fetch=filter shallow ref-in-want",
+	"server-option",
+}
+
 type httpProxyServer struct {
-	config *ServerConfig
+	config  *ServerConfig
+	limiter *rateLimiter
 }
 
 func (s *httpProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w, logCloser := logHTTPRequest(s.config, w, r)
+	w, r, logCloser := logHTTPRequest(s.config, w, r)
 	defer logCloser()
 	reporter := &httpErrorReporter{config: s.config, req: r, w: w}
 
@@ -40,17 +55,45 @@ func (s *httpProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		reporter.reportError(err)
 		return
 	}
-	r = r.WithContext(ctx)
+	r = r.WithContext(withRequestID(ctx, newRequestID()))
 
 	// Technically, this server is an HTTP proxy, and it should use
 	// Proxy-Authorization / Proxy-Authenticate. However, existing
 	// authentication mechanism around Git is not compatible with proxy
 	// authorization. We use normal authentication mechanism here.
-	if err := s.config.RequestAuthorizer(r); err != nil {
-		reporter.reportError(err)
+	if len(s.config.HMACSecret) != 0 {
+		if err := verifyHMACSignature(s.config, r, time.Now()); err != nil {
+			reporter.reportError(err)
+			return
+		}
+	}
+	if s.config.RequestAuthorizer != nil {
+		if err := s.config.RequestAuthorizer(r); err != nil {
+			if _, ok := status.FromError(err); !ok {
+				// Treat an error without a status code as a
+				// policy rejection.
+				err = status.Error(codes.PermissionDenied, err.Error())
+			}
+			reporter.reportError(err)
+			return
+		}
+	}
+	if s.config.AllowPush && isReceivePackRequest(r) {
+		// Pushes are not cached, and git-push doesn't use Git
+		// protocol v2.
+		s.receivePackHandler(reporter, w, r)
+		return
+	}
+	if s.config.BundleURIBase != "" && isBundleRequest(r) {
+		// The bundle is downloaded without Git protocol v2.
+		s.bundleHandler(reporter, w, r)
 		return
 	}
-	if proto := r.Header.Get("Git-Protocol"); proto != "version=2" {
+	if !isProtocolV2(r.Header) {
+		if s.config.ProtocolV1Fallback {
+			s.passThroughHandler(reporter, w, r)
+			return
+		}
 		reporter.reportError(status.Error(codes.InvalidArgument, "accepts only Git protocol v2"))
 		return
 	}
@@ -65,40 +108,161 @@ func (s *httpProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// isProtocolV2 returns true if the Git-Protocol header asks for Git protocol
+// v2. The header is a list of key=value parameters separated with colons, but
+// some clients separate them otherwise, e.g. with semicolons, spaces, or NUL,
+// as in the Git protocol over TCP.
+func isProtocolV2(h http.Header) bool {
+	for _, v := range h["Git-Protocol"] {
+		params := strings.FieldsFunc(v, func(c rune) bool {
+			return c == ':' || c == ';' || c == ',' || c == 0 || unicode.IsSpace(c)
+		})
+		for _, param := range params {
+			if strings.EqualFold(param, "version=2") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (s *httpProxyServer) infoRefsHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request) {
 	if r.URL.Query().Get("service") != "git-upload-pack" {
 		reporter.reportError(status.Error(codes.InvalidArgument, "accepts only git-fetch"))
 		return
 	}
 
+	// The request has no meaningful body, but reject a broken one the same
+	// way as /git-upload-pack.
+	if err := ungzipRequest(r); err != nil {
+		reporter.reportError(err)
+		return
+	}
+
+	repo, err := s.openRepository(r)
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	// Clients assume SHA-1 unless told otherwise.
+	format, err := repo.objectFormat(r.Context())
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+
 	w.Header().Add("Content-Type", "application/x-git-upload-pack-advertisement")
-	rs := []*gitprotocolio.InfoRefsResponseChunk{
-		{ProtocolVersion: 2},
-		{Capabilities: []string{"ls-refs"}},
-		// See managed_repositories.go for not having ref-in-want.
-		{Capabilities: []string{"fetch=filter shallow"}},
-		{Capabilities: []string{"server-option"}},
-		{EndOfRequest: true},
+	capabilities := s.config.AdvertisedCapabilities
+	if capabilities == nil {
+		capabilities = defaultAdvertisedCapabilities
 	}
+	if repo.upstreamURL.Scheme == "http" || repo.upstreamURL.Scheme == "https" {
+		// Without the upstream's capabilities, advertise the configured
+		// ones. The fetches can still be served from the cache.
+		if upstream, err := repo.upstreamCapabilities(r.Context()); err == nil {
+			capabilities = reconcileCapabilities(capabilities, upstream)
+		}
+	}
+	if s.config.PackfileURIResolver != nil {
+		// These are served by this server regardless of the upstream.
+		capabilities = addFetchFeatures(capabilities, "packfile-uris", "sideband-all")
+	}
+	if s.config.BundleURIBase != "" {
+		capabilities = append(append([]string{}, capabilities...), "bundle-uri")
+	}
+	rs := []*gitprotocolio.InfoRefsResponseChunk{{ProtocolVersion: 2}}
+	for _, c := range capabilities {
+		rs = append(rs, &gitprotocolio.InfoRefsResponseChunk{Capabilities: []string{c}})
+	}
+	rs = append(rs,
+		&gitprotocolio.InfoRefsResponseChunk{Capabilities: []string{"object-format=" + format}},
+		&gitprotocolio.InfoRefsResponseChunk{EndOfRequest: true},
+	)
+	// The advertisement is small. Send it with Content-Length instead of
+	// the chunked encoding.
+	var buf bytes.Buffer
 	for _, pkt := range rs {
-		if err := writePacket(w, pkt); err != nil {
-			// Client-side IO error. Treat this as Canceled.
-			reporter.reportError(status.Errorf(codes.Canceled, "client IO error"))
-			return
+		writePacket(&buf, pkt)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		// Client-side IO error. Treat this as Canceled.
+		reporter.reportError(status.Errorf(codes.Canceled, "client IO error"))
+		return
+	}
+}
+
+// reconcileCapabilities drops the capabilities that the upstream doesn't
+// support from the advertised ones, so that a client doesn't ask for what the
+// upstream can't do. The features of "fetch" are intersected, and
+// "server-option", which is passed to the upstream, is dropped if the upstream
+// doesn't have it. The others are advertised as is.
+func reconcileCapabilities(advertised, upstream []string) []string {
+	upstreamFetch := map[string]bool{}
+	upstreamServerOption := false
+	for _, c := range upstream {
+		if c == "fetch" || strings.HasPrefix(c, "fetch=") {
+			for _, f := range strings.Fields(strings.TrimPrefix(strings.TrimPrefix(c, "fetch"), "=")) {
+				upstreamFetch[f] = true
+			}
+		} else if c == "server-option" {
+			upstreamServerOption = true
+		}
+	}
+
+	ret := []string{}
+	for _, c := range advertised {
+		switch {
+		case strings.HasPrefix(c, "fetch="):
+			features := []string{}
+			for _, f := range strings.Fields(strings.TrimPrefix(c, "fetch=")) {
+				if upstreamFetch[f] {
+					features = append(features, f)
+				}
+			}
+			if len(features) == 0 {
+				c = "fetch"
+			} else {
+				c = "fetch=" + strings.Join(features, " ")
+			}
+		case c == "server-option" && !upstreamServerOption:
+			continue
 		}
+		ret = append(ret, c)
 	}
+	return ret
+}
+
+// addFetchFeatures adds the features to the fetch capability.
+func addFetchFeatures(capabilities []string, features ...string) []string {
+	ret := []string{}
+	for _, c := range capabilities {
+		if c == "fetch" {
+			c = "fetch=" + strings.Join(features, " ")
+		} else if strings.HasPrefix(c, "fetch=") {
+			c += " " + strings.Join(features, " ")
+		}
+		ret = append(ret, c)
+	}
+	return ret
 }
 
 func (s *httpProxyServer) uploadPackHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request) {
+	ctx, span := startRequestSpan(s.config, r, "goblet.UploadPack")
+	defer span.End()
+	r = r.WithContext(ctx)
+
 	// /git-upload-pack doesn't recognize text/plain error. Send an error
 	// with ErrorPacket.
 	w.Header().Add("Content-Type", "application/x-git-upload-pack-result")
-	if r.Header.Get("Content-Encoding") == "gzip" {
-		var err error
-		if r.Body, err = gzip.NewReader(r.Body); err != nil {
-			reporter.reportError(status.Errorf(codes.InvalidArgument, "cannot ungzip: %v", err))
-			return
-		}
+	if !s.limiter.allow(r) {
+		gitReporter := &gitProtocolHTTPErrorReporter{config: s.config, req: r, w: w}
+		gitReporter.reportError(r.Context(), time.Now(), status.Error(codes.ResourceExhausted, "too many requests, retry later"))
+		return
+	}
+	if err := ungzipRequest(r); err != nil {
+		reporter.reportError(err)
+		return
 	}
 
 	// HTTP is strictly speaking a request-response protocol, and a server
@@ -111,27 +275,218 @@ func (s *httpProxyServer) uploadPackHandler(reporter *httpErrorReporter, w http.
 	// response. A request with many wants and haves can be large, but
 	// practically there's a limit on the number of haves a client would
 	// send. Compared to that the fetch response can contain a packfile, and
-	// this can easily get large. Read the entire request upfront.
-	commands, err := parseAllCommands(r.Body)
+	// this can easily get large. Read the entire request upfront, and stream
+	// the response to the client as git-upload-pack writes it.
+	var body io.Reader = r.Body
+	var lr *limitedReader
+	if s.config.MaxRequestBytes > 0 {
+		lr = &limitedReader{r: r.Body, n: s.config.MaxRequestBytes}
+		body = lr
+	}
+	commands, err := parseAllCommands(body)
 	if err != nil {
+		if lr != nil && lr.exceeded {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			gitReporter := &gitProtocolHTTPErrorReporter{config: s.config, req: r, w: w}
+			gitReporter.reportError(r.Context(), time.Now(), status.Errorf(codes.ResourceExhausted, "the request is larger than %d bytes", s.config.MaxRequestBytes))
+			return
+		}
 		reporter.reportError(err)
 		return
 	}
 
-	repo, err := openManagedRepository(s.config, r.URL)
+	repo, err := s.openRepository(r)
 	if err != nil {
 		reporter.reportError(err)
 		return
 	}
+	span.AddAttributes(trace.StringAttribute("goblet.host", repo.upstreamURL.Host))
 
-	gitReporter := &gitProtocolHTTPErrorReporter{config: s.config, req: r, w: w}
+	var out io.Writer = w
+	if s.config.EnableResponseGzip && acceptsGzip(r) {
+		level := s.config.GzipLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		gw := &gzipResponseWriter{w: w, level: level, minBytes: s.config.MinGzipBytes}
+		defer gw.Close()
+		out = gw
+	}
+
+	ctx = r.Context()
+	if s.config.BundleURIBase != "" {
+		ctx = withBundleURI(ctx, s.config, r.URL.Path)
+	}
+	gitReporter := &gitProtocolHTTPErrorReporter{config: s.config, req: r, w: out, resp: w}
 	for _, command := range commands {
-		if !handleV2Command(r.Context(), gitReporter, repo, command, w) {
+		if !handleV2Command(ctx, gitReporter, repo, command, out) {
 			return
 		}
 	}
 }
 
+// passThroughHandler forwards a Git protocol v0/v1 fetch request to the
+// upstream without caching.
+func (s *httpProxyServer) passThroughHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request) {
+	var suffix string
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/info/refs") && r.URL.Query().Get("service") == "git-upload-pack":
+		suffix = "/info/refs"
+	case strings.HasSuffix(r.URL.Path, "/git-upload-pack"):
+		suffix = "/git-upload-pack"
+	default:
+		reporter.reportError(status.Error(codes.InvalidArgument, "accepts only git-fetch"))
+		return
+	}
+	// The client credential is for this server. The upstream is accessed
+	// with the server's credential.
+	s.forwardToUpstream(reporter, w, r, suffix, false)
+}
+
+func isReceivePackRequest(r *http.Request) bool {
+	if strings.HasSuffix(r.URL.Path, "/info/refs") {
+		return r.URL.Query().Get("service") == "git-receive-pack"
+	}
+	return strings.HasSuffix(r.URL.Path, "/git-receive-pack")
+}
+
+// receivePackHandler forwards a push to the upstream, and then updates the
+// cache so that the pushed refs can be fetched from this server.
+func (s *httpProxyServer) receivePackHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request) {
+	suffix := "/info/refs"
+	if strings.HasSuffix(r.URL.Path, "/git-receive-pack") {
+		suffix = "/git-receive-pack"
+	}
+	// The push is made as the client, not as this server.
+	statusCode, ok := s.forwardToUpstream(reporter, w, r, suffix, true)
+	if !ok || suffix != "/git-receive-pack" || statusCode != http.StatusOK {
+		return
+	}
+	realm, err := s.requestRealm(r)
+	if err != nil {
+		return
+	}
+	repo, err := lookupRealmRepository(s.config, r.URL, realm)
+	if err != nil || repo == nil {
+		return
+	}
+	go repo.fetchUpstream(context.Background())
+}
+
+// requestRealm returns the cache realm of the request. See
+// ServerConfig.CacheRealm.
+func (s *httpProxyServer) requestRealm(r *http.Request) (string, error) {
+	if s.config.CacheRealm == nil {
+		return "", nil
+	}
+	realm, err := s.config.CacheRealm(r)
+	if err != nil {
+		if _, ok := status.FromError(err); !ok {
+			err = status.Errorf(codes.Internal, "cannot determine the cache realm: %v", err)
+		}
+		return "", err
+	}
+	return realm, nil
+}
+
+// openRepository opens the repository of the request in the request's realm.
+func (s *httpProxyServer) openRepository(r *http.Request) (*managedRepository, error) {
+	realm, err := s.requestRealm(r)
+	if err != nil {
+		return nil, err
+	}
+	return openRealmRepository(s.config, r.URL, realm)
+}
+
+// forwardToUpstream sends the request to the upstream and copies the response
+// back to the client. If clientAuth is true, the client's Authorization header
+// is sent to the upstream instead of the server's credential.
+func (s *httpProxyServer) forwardToUpstream(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request, suffix string, clientAuth bool) (int, bool) {
+	u, err := canonicalizeURL(s.config, r.URL)
+	if err != nil {
+		reporter.reportError(err)
+		return 0, false
+	}
+	settings := hostSettings(s.config, u.Host)
+	upstreamURL := *u
+	upstreamURL.Path += suffix
+	upstreamURL.RawQuery = r.URL.RawQuery
+
+	// The request ends with the client's request or at the
+	// UpstreamTimeout.
+	ctx, cancel := withUpstreamTimeout(r.Context(), settings)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, r.Method, upstreamURL.String(), r.Body)
+	if err != nil {
+		reporter.reportError(status.Errorf(codes.Internal, "cannot construct a request object: %v", err))
+		return 0, false
+	}
+	for k, vs := range r.Header {
+		if !clientAuth && (k == "Authorization" || k == "Cookie") {
+			continue
+		}
+		req.Header[k] = vs
+	}
+	if !clientAuth {
+		authz, err := upstreamAuthorization(settings.TokenSource)
+		if err != nil {
+			reporter.reportError(err)
+			return 0, false
+		}
+		if authz != "" {
+			req.Header.Set("Authorization", authz)
+		}
+	}
+	setUpstreamHeaders(s.config, req.Header)
+
+	resp, err := upstreamHTTPClient(s.config, settings).Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			reporter.reportError(status.FromContextError(ctx.Err()).Err())
+		} else {
+			reporter.reportError(status.Errorf(codes.Unavailable, "cannot send a request to the upstream: %v", err))
+		}
+		return 0, false
+	}
+	defer resp.Body.Close()
+
+	for k, vs := range resp.Header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return resp.StatusCode, false
+	}
+	return resp.StatusCode, true
+}
+
+// ungzipRequest replaces the request body with the decompressed one if the
+// client sent it gzipped.
+func ungzipRequest(r *http.Request) error {
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return nil
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "cannot ungzip: %v", err)
+	}
+	r.Body = zr
+	return nil
+}
+
+// acceptsGzip returns true if the client accepts a gzipped response.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if i := strings.Index(enc, ";"); i >= 0 {
+			enc = enc[:i]
+		}
+		if strings.TrimSpace(enc) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
 func parseAllCommands(r io.Reader) ([][]*gitprotocolio.ProtocolV2RequestChunk, error) {
 	commands := [][]*gitprotocolio.ProtocolV2RequestChunk{}
 	v2Req := gitprotocolio.NewProtocolV2Request(r)
@@ -143,6 +498,11 @@ func parseAllCommands(r io.Reader) ([][]*gitprotocolio.ProtocolV2RequestChunk, e
 				break
 			}
 			chunks = append(chunks, c)
+			if c.EndArgument {
+				// The flush packet ends the command. Another
+				// command can follow.
+				break
+			}
 		}
 		if len(chunks) == 0 || v2Req.Err() != nil {
 			break
@@ -151,6 +511,7 @@ func parseAllCommands(r io.Reader) ([][]*gitprotocolio.ProtocolV2RequestChunk, e
 		switch chunks[0].Command {
 		case "ls-refs":
 		case "fetch":
+		case "bundle-uri":
 			// Do nothing.
 		default:
 			return nil, status.Errorf(codes.InvalidArgument, "unrecognized command: %v", chunks[0])
@@ -0,0 +1,1140 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestURLCanonializer_CollapsesHosts(t *testing.T) {
+	config := newTestConfig(t)
+	config.URLCanonializer = func(u *url.URL) (*url.URL, error) {
+		ret := *u
+		if ret.Host == "git-mirror.example.com" {
+			ret.Host = "git.example.com"
+		}
+		return &ret, nil
+	}
+	defer clearManagedRepositories()
+
+	m1, err := openManagedRepository(config, &url.URL{Scheme: "https", Host: "git.example.com", Path: "/repo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := openManagedRepository(config, &url.URL{Scheme: "https", Host: "git-mirror.example.com", Path: "/repo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m1 != m2 {
+		t.Errorf("got different repositories %s and %s, want the same one", m1.localDiskPath, m2.localDiskPath)
+	}
+}
+
+func TestURLCanonializer_ErrorIsBadRequest(t *testing.T) {
+	config := newTestConfig(t)
+	config.URLCanonializer = func(u *url.URL) (*url.URL, error) {
+		return nil, errors.New("unknown host")
+	}
+	srv := httptest.NewServer(HTTPHandler(config))
+	defer srv.Close()
+
+	req, err := http.NewRequest("POST", srv.URL+"/repo/git-upload-pack", strings.NewReader("0014command=ls-refs\n00010000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestDefaultURLCanonializer(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"https://git.example.com/repo/info/refs", "https://git.example.com/repo"},
+		{"https://git.example.com/repo/git-upload-pack", "https://git.example.com/repo"},
+		{"//git.example.com/repo", "https://git.example.com/repo"},
+	} {
+		u, err := url.Parse(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := defaultURLCanonializer(u)
+		if err != nil {
+			t.Errorf("defaultURLCanonializer(%s) returned %v", tc.in, err)
+			continue
+		}
+		if got.String() != tc.want {
+			t.Errorf("defaultURLCanonializer(%s) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+// maxWriteRecorder is an http.ResponseWriter that discards the body and records
+// the largest single write.
+type maxWriteRecorder struct {
+	header   http.Header
+	code     int
+	total    int64
+	maxWrite int
+}
+
+func (r *maxWriteRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *maxWriteRecorder) WriteHeader(code int) {
+	r.code = code
+}
+
+func (r *maxWriteRecorder) Write(p []byte) (int, error) {
+	if len(p) > r.maxWrite {
+		r.maxWrite = len(p)
+	}
+	r.total += int64(len(p))
+	return len(p), nil
+}
+
+func TestUploadPackHandler_StreamsResponse(t *testing.T) {
+	const blobSize = 8 << 20
+	u := newTestUpstream(t)
+	work := newTempDir(t)
+	runTestGit(t, work, "init")
+	blob := make([]byte, blobSize)
+	if _, err := rand.Read(blob); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(work, "blob"), blob, 0644); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, work, "add", "blob")
+	runTestGit(t, work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--message=blob")
+	runTestGit(t, work, "push", "-f", u.Path, "HEAD:refs/heads/master")
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	body := pktLine("command=fetch\n") + "0001" + pktLine("want "+want+"\n") + pktLine("done\n") + "0000"
+	req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(body))
+	req.Header.Set("Git-Protocol", "version=2")
+	rec := &maxWriteRecorder{header: http.Header{}}
+	HTTPHandler(config).ServeHTTP(rec, req)
+
+	if rec.total < blobSize {
+		t.Fatalf("got %d bytes, want at least %d", rec.total, blobSize)
+	}
+	if rec.maxWrite > 1<<20 {
+		t.Errorf("got a %d bytes write, want the response streamed in small writes", rec.maxWrite)
+	}
+}
+
+func TestUploadPackHandler_ClientDisconnectKillsUploadPack(t *testing.T) {
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+
+	// A git wrapper whose git-upload-pack records its PID and hangs, as if
+	// it's slow to produce the packfile.
+	dir := newTempDir(t)
+	pidFile := filepath.Join(dir, "pid")
+	wrapper := filepath.Join(dir, "git")
+	script := "#!/bin/sh\ncase \"$*\" in *upload-pack*) echo $$ > " + pidFile + ".tmp; mv " + pidFile + ".tmp " + pidFile + "; exec sleep 60;; esac\nexec " + gitBinary + " \"$@\"\n"
+	if err := ioutil.WriteFile(wrapper, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.GitBinaryPath = wrapper
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(HTTPHandler(config))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body := pktLine("command=fetch\n") + "0001" + pktLine("want "+want+"\n") + pktLine("done\n") + "0000"
+	req, err := http.NewRequest("POST", srv.URL+"/repo/git-upload-pack", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := http.DefaultClient.Do(req.WithContext(ctx)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	var pid int
+	for deadline := time.Now().Add(10 * time.Second); pid == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("git-upload-pack is not started")
+		}
+		if bs, err := ioutil.ReadFile(pidFile); err == nil {
+			pid, _ = strconv.Atoi(strings.TrimSpace(string(bs)))
+		}
+	}
+	// Disconnect.
+	cancel()
+	<-done
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); p.Signal(syscall.Signal(0)) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			p.Kill()
+			t.Fatal("git-upload-pack is running after the client disconnected")
+		}
+	}
+}
+
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+func TestIsProtocolV2(t *testing.T) {
+	for _, tc := range []struct {
+		values []string
+		want   bool
+	}{
+		{[]string{"version=2"}, true},
+		{[]string{" version=2 "}, true},
+		{[]string{"Version=2"}, true},
+		{[]string{"version=2:object-format=sha256"}, true},
+		{[]string{"object-format=sha256; version=2"}, true},
+		{[]string{"version=2\x00something"}, true},
+		{[]string{"version=1", "version=2"}, true},
+		{[]string{"version=1"}, false},
+		{[]string{"version=20"}, false},
+		{[]string{"noversion=2"}, false},
+		{[]string{""}, false},
+		{nil, false},
+	} {
+		h := http.Header{}
+		for _, v := range tc.values {
+			h.Add("Git-Protocol", v)
+		}
+		if got := isProtocolV2(h); got != tc.want {
+			t.Errorf("isProtocolV2(%q) = %v, want %v", tc.values, got, tc.want)
+		}
+	}
+}
+
+func TestInfoRefsHandler_GzipRequest(t *testing.T) {
+	config := newTestConfig(t)
+	srv := httptest.NewServer(HTTPHandler(config))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name string
+		body []byte
+		want int
+	}{
+		{"valid", gzipBytes(t, nil), http.StatusOK},
+		{"broken", []byte("not gzip"), http.StatusBadRequest},
+	} {
+		req, err := http.NewRequest("GET", srv.URL+"/repo/info/refs?service=git-upload-pack", bytes.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Git-Protocol", "version=2")
+		req.Header.Set("Content-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestUploadPackHandler_GzipResponse(t *testing.T) {
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.EnableResponseGzip = true
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(HTTPHandler(config))
+	defer srv.Close()
+
+	// Don't let the client add Accept-Encoding and decompress by itself.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	body := pktLine("command=fetch\n") + "0001" + pktLine("want "+want+"\n") + pktLine("done\n") + "0000"
+	for _, acceptEncoding := range []string{"", "deflate, gzip"} {
+		req, err := http.NewRequest("POST", srv.URL+"/repo/git-upload-pack", bytes.NewReader(gzipBytes(t, []byte(body))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Git-Protocol", "version=2")
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = resp.Body
+		gzipped := resp.Header.Get("Content-Encoding") == "gzip"
+		if gzipped {
+			if r, err = gzip.NewReader(resp.Body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bs, err := ioutil.ReadAll(r)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wantGzip := acceptEncoding != ""; gzipped != wantGzip {
+			t.Errorf("Accept-Encoding %q: got gzipped %v, want %v", acceptEncoding, gzipped, wantGzip)
+		}
+		if !bytes.Contains(bs, []byte("packfile")) {
+			t.Errorf("Accept-Encoding %q: got %q, want a packfile section", acceptEncoding, bs)
+		}
+	}
+}
+
+func TestUploadPackHandler_GzipThreshold(t *testing.T) {
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.EnableResponseGzip = true
+	config.GzipLevel = gzip.BestCompression
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	body := pktLine("command=fetch\n") + "0001" + pktLine("want "+want+"\n") + pktLine("done\n") + "0000"
+	for _, tc := range []struct {
+		minBytes int
+		wantGzip bool
+	}{
+		{1 << 20, false},
+		{100, true},
+	} {
+		config.MinGzipBytes = tc.minBytes
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(body))
+		req.Header.Set("Git-Protocol", "version=2")
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+
+		bs := rec.Body.Bytes()
+		gzipped := rec.Header().Get("Content-Encoding") == "gzip"
+		if gzipped != tc.wantGzip {
+			t.Fatalf("MinGzipBytes %d: got gzipped %v for %d bytes, want %v", tc.minBytes, gzipped, len(bs), tc.wantGzip)
+		}
+		if gzipped {
+			// The XFL flag of the gzip header is 2 for the best
+			// compression.
+			if len(bs) < 10 || bs[8] != 2 {
+				t.Error("got a gzip header without the best compression flag")
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(bs))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bs, err = ioutil.ReadAll(zr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Contains(bs, []byte("packfile")) {
+			t.Errorf("MinGzipBytes %d: got %q, want a packfile section", tc.minBytes, bs)
+		}
+	}
+}
+
+func gzipBytes(t *testing.T, bs []byte) []byte {
+	t.Helper()
+	b := new(bytes.Buffer)
+	zw := gzip.NewWriter(b)
+	if _, err := zw.Write(bs); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestUploadPackHandler_PathTraversalIsBadRequest(t *testing.T) {
+	config := newTestConfig(t)
+	config.URLCanonializer = func(u *url.URL) (*url.URL, error) {
+		return &url.URL{Scheme: "https", Host: "git.example.com", Path: strings.TrimSuffix(u.Path, "/git-upload-pack")}, nil
+	}
+	defer clearManagedRepositories()
+
+	req := httptest.NewRequest("POST", "/../../etc/git-upload-pack", strings.NewReader(pktLine("command=ls-refs\n")+"00010000"))
+	req.Header.Set("Git-Protocol", "version=2")
+	rec := httptest.NewRecorder()
+	HTTPHandler(config).ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(config.LocalDiskCacheRoot), "etc")); !os.IsNotExist(err) {
+		t.Errorf("a directory is created outside of the cache root: %v", err)
+	}
+}
+
+func TestUploadPackHandler_UpstreamStatusPassthrough(t *testing.T) {
+	for _, code := range []int{http.StatusForbidden, http.StatusServiceUnavailable} {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "upstream error", code)
+		}))
+		u, err := url.Parse(upstream.URL + "/repo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := newTestConfig(t)
+		config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(pktLine("command=ls-refs\n")+"00010000"))
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("ls-refs: got status %d, want %d: %s", rec.Code, code, rec.Body)
+		}
+
+		m, err := openManagedRepository(config, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.fetchUpstream(context.Background()); err == nil {
+			t.Errorf("fetch: got no error for %d", code)
+		} else if ue, ok := err.(*upstreamError); !ok || ue.code != code {
+			t.Errorf("fetch: got %v, want an upstream error with %d", err, code)
+		}
+
+		upstream.Close()
+		clearManagedRepositories()
+	}
+}
+
+func TestPassThroughHandler_UpstreamTimeout(t *testing.T) {
+	hung := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	defer close(hung)
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.ProtocolV1Fallback = true
+	config.UpstreamTimeout = 100 * time.Millisecond
+
+	req := httptest.NewRequest("GET", "/repo/info/refs?service=git-upload-pack", nil)
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		HTTPHandler(config).ServeHTTP(rec, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the pass-through request outlives the UpstreamTimeout")
+	}
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("got status %d, want %d: %s", rec.Code, http.StatusGatewayTimeout, rec.Body)
+	}
+}
+
+func TestUploadPackHandler_FetchErrorIsErrPacket(t *testing.T) {
+	u := newTestUpstream(t)
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	defer clearManagedRepositories()
+
+	missing := strings.Repeat("1", 40)
+	body := pktLine("command=fetch\n") + "0001" + pktLine("want "+missing+"\n") + pktLine("done\n") + "0000"
+	req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(body))
+	req.Header.Set("Git-Protocol", "version=2")
+	rec := httptest.NewRecorder()
+	HTTPHandler(config).ServeHTTP(rec, req)
+
+	resp := rec.Body.String()
+	scanner := gitprotocolio.NewPacketScanner(rec.Body)
+	for scanner.Scan() {
+	}
+	// The scanner stops at an ERR packet and returns it as the error.
+	if _, ok := scanner.Err().(gitprotocolio.ErrorPacket); !ok {
+		t.Errorf("got %v, want an ERR packet in %q", scanner.Err(), resp)
+	}
+}
+
+func TestWriteSideBandError(t *testing.T) {
+	b := new(bytes.Buffer)
+	if err := writeSideBandError(b, errors.New("broken")); err != nil {
+		t.Fatal(err)
+	}
+	scanner := gitprotocolio.NewPacketScanner(b)
+	if !scanner.Scan() {
+		t.Fatalf("got no packet: %v", scanner.Err())
+	}
+	bp, ok := scanner.Packet().(gitprotocolio.BytesPacket)
+	if !ok {
+		t.Fatalf("got %#v, want a bytes packet", scanner.Packet())
+	}
+	if got, ok := gitprotocolio.ParseSideBandPacket(bp).(gitprotocolio.SideBandErrorPacket); !ok || string(got) != "broken\n" {
+		t.Errorf("got %#v, want a side-band error packet", gitprotocolio.ParseSideBandPacket(bp))
+	}
+}
+
+func TestHTTPHandler_SHA256Repository(t *testing.T) {
+	upstreamDir := newTempDir(t)
+	runTestGit(t, upstreamDir, "init", "--bare", "--object-format=sha256")
+	work := newTempDir(t)
+	runTestGit(t, work, "init", "--object-format=sha256")
+	runTestGit(t, work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--allow-empty", "--message=test")
+	runTestGit(t, work, "push", upstreamDir, "HEAD:refs/heads/master")
+	want := strings.TrimSpace(runTestGit(t, upstreamDir, "rev-parse", "master"))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	defer clearManagedRepositories()
+	proxy := httptest.NewServer(HTTPHandler(config))
+	defer proxy.Close()
+
+	clone := newTempDir(t)
+	runTestGit(t, clone, "-c", "protocol.version=2", "clone", "--bare", proxy.URL+"/repo", ".")
+	if got := strings.TrimSpace(runTestGit(t, clone, "rev-parse", "--show-object-format")); got != "sha256" {
+		t.Errorf("clone object format: got %s, want sha256", got)
+	}
+	if got := strings.TrimSpace(runTestGit(t, clone, "rev-parse", "master")); got != want {
+		t.Errorf("clone: got %s, want %s", got, want)
+	}
+
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(runTestGit(t, m.localDiskPath, "rev-parse", "--show-object-format")); got != "sha256" {
+		t.Errorf("cache object format: got %s, want sha256", got)
+	}
+}
+
+func TestUploadPackHandler_ServerOptionPassthrough(t *testing.T) {
+	upstreamURL := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, upstreamURL.Path, "rev-parse", "master"))
+	var mu sync.Mutex
+	upstreamBodies := []string{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		upstreamBodies = append(upstreamBodies, string(bs))
+		mu.Unlock()
+		r.Body = ioutil.NopCloser(bytes.NewReader(bs))
+		serveGitHTTPBackend(w, r, upstreamURL.Path)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	defer clearManagedRepositories()
+
+	// Fetch first so that ls-refs doesn't start a fetch in the background.
+	for _, body := range []string{
+		pktLine("command=fetch\n") + pktLine("server-option=fetch-option\n") + "0001" + pktLine("want "+want+"\n") + pktLine("done\n") + "0000",
+		pktLine("command=ls-refs\n") + pktLine("server-option=ls-refs-option\n") + "0001" + "0000",
+	} {
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(body))
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, option := range []string{"ls-refs-option", "fetch-option"} {
+		found := false
+		for _, body := range upstreamBodies {
+			if strings.Contains(body, "server-option="+option) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("server option %s didn't reach the upstream: %q", option, upstreamBodies)
+		}
+	}
+}
+
+func TestCanonicalizeURL_GitSuffix(t *testing.T) {
+	config := &ServerConfig{
+		LocalDiskCacheRoot: newTempDir(t),
+		GitSuffixHosts:     []string{"gitlab.example.com"},
+	}
+	for _, tc := range []struct {
+		in   []string
+		want string
+	}{
+		{
+			[]string{"https://git.example.com/repo/info/refs", "https://git.example.com/repo.git/info/refs"},
+			"https://git.example.com/repo",
+		},
+		{
+			[]string{"https://gitlab.example.com/repo/info/refs", "https://gitlab.example.com/repo.git/info/refs"},
+			"https://gitlab.example.com/repo.git",
+		},
+	} {
+		paths := map[string]bool{}
+		for _, in := range tc.in {
+			u, err := url.Parse(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := canonicalizeURL(config, u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tc.want {
+				t.Errorf("canonicalizeURL(%s) = %s, want %s", in, got, tc.want)
+			}
+			p, err := getLocalDiskPath(config, got, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths[p] = true
+		}
+		if len(paths) != 1 {
+			t.Errorf("got cache dirs %v for %v, want one", paths, tc.in)
+		}
+	}
+}
+
+func TestCanonicalizeURL_AllowedHosts(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		allowed []string
+		denied  []string
+		host    string
+		want    bool
+	}{
+		{"default", nil, nil, "git.example.com", true},
+		{"allowed", []string{"*.example.com"}, nil, "git.example.com", true},
+		{"not allowed", []string{"*.example.com"}, nil, "git.example.org", false},
+		{"allowed case-insensitively", []string{"git.example.com"}, nil, "GIT.example.com", true},
+		{"denied", nil, []string{"evil.example.com"}, "evil.example.com", false},
+		{"denied over allowed", []string{"*.example.com"}, []string{"evil.*"}, "evil.example.com", false},
+		{"allowed with a port", []string{"git.example.com"}, nil, "git.example.com:8443", true},
+	} {
+		config := &ServerConfig{
+			LocalDiskCacheRoot: newTempDir(t),
+			AllowedHosts:       tc.allowed,
+			DeniedHosts:        tc.denied,
+		}
+		_, err := canonicalizeURL(config, &url.URL{Scheme: "https", Host: tc.host, Path: "/repo"})
+		if tc.want && err != nil {
+			t.Errorf("%s: got %v, want no error", tc.name, err)
+		} else if !tc.want && status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%s: got %v, want PermissionDenied", tc.name, err)
+		}
+	}
+}
+
+func TestInfoRefsHandler_DeniedHost(t *testing.T) {
+	config := newTestConfig(t)
+	config.URLCanonializer = nil
+	config.DeniedHosts = []string{"evil.example.com"}
+	defer clearManagedRepositories()
+
+	req := httptest.NewRequest("GET", "https://evil.example.com/repo/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("Git-Protocol", "version=2")
+	rec := httptest.NewRecorder()
+	HTTPHandler(config).ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if fis, err := ioutil.ReadDir(config.LocalDiskCacheRoot); err != nil {
+		t.Fatal(err)
+	} else if len(fis) != 0 {
+		t.Errorf("got %d entries in the cache root, want none", len(fis))
+	}
+}
+
+func TestInfoRefsHandler_UpstreamWithoutFilter(t *testing.T) {
+	upstreamDir := newTestUpstream(t).Path
+	runTestGit(t, upstreamDir, "config", "uploadpack.allowfilter", "false")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	defer clearManagedRepositories()
+
+	req := httptest.NewRequest("GET", "/repo/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("Git-Protocol", "version=2")
+	rec := httptest.NewRecorder()
+	HTTPHandler(config).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	got := []string{}
+	resp := gitprotocolio.NewInfoRefsResponse(rec.Body)
+	for resp.Scan() {
+		got = append(got, resp.Chunk().Capabilities...)
+	}
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ls-refs", "fetch=shallow", "server-option", "object-format=sha1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReconcileCapabilities(t *testing.T) {
+	for _, tc := range []struct {
+		upstream []string
+		want     []string
+	}{
+		{
+			[]string{"ls-refs=unborn", "fetch=shallow wait-for-done filter", "server-option", "object-format=sha1"},
+			[]string{"ls-refs", "fetch=filter shallow", "server-option", "agent=goblet"},
+		},
+		{
+			[]string{"ls-refs", "fetch"},
+			[]string{"ls-refs", "fetch", "agent=goblet"},
+		},
+	} {
+		got := reconcileCapabilities([]string{"ls-refs", "fetch=filter shallow ref-in-want", "server-option", "agent=goblet"}, tc.upstream)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("reconcileCapabilities(%q) = %q, want %q", tc.upstream, got, tc.want)
+		}
+	}
+}
+
+func TestUploadPackHandler_MultipleCommands(t *testing.T) {
+	upstreamURL := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, upstreamURL.Path, "rev-parse", "master"))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveGitHTTPBackend(w, r, upstreamURL.Path)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	body := pktLine("command=ls-refs\n") + "0001" + pktLine("ref-prefix refs/heads/\n") + "0000" +
+		pktLine("command=fetch\n") + "0001" + pktLine("want "+want+"\n") + pktLine("done\n") + "0000"
+	req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(body))
+	req.Header.Set("Git-Protocol", "version=2")
+	rec := httptest.NewRecorder()
+	HTTPHandler(config).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	// Each response ends with a flush packet.
+	resp := rec.Body.String()
+	responses := []string{}
+	start := 0
+	for i := 0; i < len(resp); {
+		if i+4 > len(resp) {
+			t.Fatalf("got a truncated packet at %d: %q", i, resp)
+		}
+		n, err := strconv.ParseInt(resp[i:i+4], 16, 32)
+		if err != nil {
+			t.Fatalf("got an invalid packet at %d: %q", i, resp)
+		}
+		if n == 0 {
+			responses = append(responses, resp[start:i+4])
+			start = i + 4
+			n = 4
+		}
+		i += int(n)
+	}
+	if len(responses) != 2 || start != len(resp) {
+		t.Fatalf("got %d responses %q, want 2", len(responses), resp)
+	}
+	if !strings.Contains(responses[0], want+" refs/heads/master\n") {
+		t.Errorf("got the ls-refs response %q, want refs/heads/master", responses[0])
+	}
+	if !strings.Contains(responses[1], "packfile\n") {
+		t.Errorf("got the fetch response %q, want a packfile", responses[1])
+	}
+}
+
+func TestUploadPackHandler_MaxRequestBytes(t *testing.T) {
+	u := newTestUpstream(t)
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.MaxRequestBytes = 1024
+	defer clearManagedRepositories()
+
+	haves := ""
+	for i := 0; i < 100; i++ {
+		haves += pktLine(fmt.Sprintf("have %040d\n", i))
+	}
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{pktLine("command=ls-refs\n") + "00010000", http.StatusOK},
+		{pktLine("command=fetch\n") + "0001" + haves + pktLine("done\n") + "0000", http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(tc.body))
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%d bytes: got status %d, want %d: %s", len(tc.body), rec.Code, tc.want, rec.Body)
+		}
+	}
+}
+
+func TestUploadPackHandler_MaxWants(t *testing.T) {
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.MaxWants = 2
+	defer clearManagedRepositories()
+
+	for _, tc := range []struct {
+		wants   int
+		wantErr bool
+	}{
+		{2, false},
+		{3, true},
+	} {
+		body := pktLine("command=fetch\n") + "0001"
+		for i := 0; i < tc.wants; i++ {
+			body += pktLine("want " + want + "\n")
+		}
+		body += pktLine("done\n") + "0000"
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(body))
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+
+		resp := rec.Body.String()
+		scanner := gitprotocolio.NewPacketScanner(rec.Body)
+		for scanner.Scan() {
+		}
+		errPkt, isErr := scanner.Err().(gitprotocolio.ErrorPacket)
+		if isErr != tc.wantErr {
+			t.Errorf("%d wants: got %v, want an ERR packet: %v in %q", tc.wants, scanner.Err(), tc.wantErr, resp)
+		} else if isErr && !strings.Contains(string(errPkt), "more than 2 wants") {
+			t.Errorf("%d wants: got %q, want the limit in the error", tc.wants, errPkt)
+		}
+	}
+}
+
+func TestInfoRefsHandler_AdvertisedCapabilities(t *testing.T) {
+	u := newTestUpstream(t)
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	defer clearManagedRepositories()
+
+	for _, tc := range []struct {
+		capabilities []string
+		want         []string
+	}{
+		{nil, []string{"ls-refs", "fetch=filter shallow ref-in-want", "server-option", "object-format=sha1"}},
+		{[]string{"ls-refs", "fetch=shallow", "agent=goblet"}, []string{"ls-refs", "fetch=shallow", "agent=goblet", "object-format=sha1"}},
+	} {
+		config.AdvertisedCapabilities = tc.capabilities
+		req := httptest.NewRequest("GET", "/repo/info/refs?service=git-upload-pack", nil)
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+		}
+
+		got := []string{}
+		resp := gitprotocolio.NewInfoRefsResponse(rec.Body)
+		for resp.Scan() {
+			got = append(got, resp.Chunk().Capabilities...)
+		}
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestUploadPackHandler_PackfileURIs(t *testing.T) {
+	const uri = "https://cdn.example.com/large.pack"
+	u := newTestUpstream(t)
+	work := newTempDir(t)
+	runTestGit(t, work, "init")
+	if err := ioutil.WriteFile(filepath.Join(work, "large"), []byte("large blob\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, work, "add", "large")
+	runTestGit(t, work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--message=large")
+	runTestGit(t, work, "push", "-f", u.Path, "HEAD:refs/heads/master")
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	blob := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master:large"))
+
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.PackfileURIResolver = func(*url.URL) ([]PackfileURI, error) {
+		return []PackfileURI{{ObjectID: blob, PackHash: strings.Repeat("0", 40), URI: uri}}, nil
+	}
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/repo/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("Git-Protocol", "version=2")
+	rec := httptest.NewRecorder()
+	HTTPHandler(config).ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), "packfile-uris") {
+		t.Errorf("got %q, want packfile-uris advertised", rec.Body)
+	}
+
+	body := pktLine("command=fetch\n") + "0001" + pktLine("sideband-all\n") + pktLine("want "+want+"\n") + pktLine("packfile-uris https\n") + pktLine("done\n") + "0000"
+	req = httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(body))
+	req.Header.Set("Git-Protocol", "version=2")
+	rec = httptest.NewRecorder()
+	HTTPHandler(config).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	if resp := rec.Body.String(); !strings.Contains(resp, "packfile-uris") || !strings.Contains(resp, uri) {
+		t.Errorf("got %q, want the packfile URI", resp)
+	}
+}
+
+func TestRequestLogSampleRate(t *testing.T) {
+	u := newTestUpstream(t)
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.RequestLogSampleRate = 0.25
+	logged := map[int]int{}
+	config.RequestLogger = func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration, info RequestInfo) {
+		logged[status]++
+	}
+	defer clearManagedRepositories()
+
+	const n = 400
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest("GET", "/repo/info/refs?service=git-upload-pack", nil)
+		if i%10 != 0 {
+			// Without this, the request fails.
+			req.Header.Set("Git-Protocol", "version=2")
+		}
+		HTTPHandler(config).ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if got := logged[http.StatusOK]; got < n*9/10/8 || got > n*9/10*3/8 {
+		t.Errorf("got %d of %d successful requests logged, want about a quarter", got, n*9/10)
+	}
+	if got := logged[http.StatusBadRequest]; got != n/10 {
+		t.Errorf("got %d of %d failed requests logged, want all", got, n/10)
+	}
+}
+
+func TestRequestLogger_CacheOutcome(t *testing.T) {
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	var got []RequestInfo
+	config.RequestLogger = func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration, info RequestInfo) {
+		got = append(got, info)
+	}
+	defer clearManagedRepositories()
+
+	fetch := pktLine("command=fetch\n") + "0001" + pktLine("want "+want+"\n") + pktLine("done\n") + "0000"
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/repo/info/refs?service=git-upload-pack", nil),
+		httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(fetch)),
+		httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(fetch)),
+	} {
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		HTTPHandler(config).ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+		}
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %d requests logged, want 3", len(got))
+	}
+	if got[0] != (RequestInfo{}) {
+		t.Errorf("got %+v for the capability advertisement, want no cache outcome", got[0])
+	}
+	if got[1].CacheOutcome != CacheMiss || got[1].FetchWait <= 0 {
+		t.Errorf("got %+v for the first fetch, want a miss with the fetch wait", got[1])
+	}
+	if got[2] != (RequestInfo{CacheOutcome: CacheHit}) {
+		t.Errorf("got %+v for the second fetch, want a hit", got[2])
+	}
+}
+
+func TestHTTPHandler_ContentLength(t *testing.T) {
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.EnableResponseGzip = true
+	// The packfile is buffered under this size.
+	config.MinGzipBytes = 1 << 20
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(HTTPHandler(config))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	for _, tc := range []struct {
+		method, path, body string
+	}{
+		{"GET", "/repo/info/refs?service=git-upload-pack", ""},
+		{"POST", "/repo/git-upload-pack", pktLine("command=fetch\n") + "0001" + pktLine("want "+want+"\n") + pktLine("done\n") + "0000"},
+	} {
+		req, err := http.NewRequest(tc.method, srv.URL+tc.path, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Git-Protocol", "version=2")
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ContentLength != int64(len(bs)) || len(resp.TransferEncoding) != 0 {
+			t.Errorf("%s: got Content-Length %d and Transfer-Encoding %q for %d bytes", tc.path, resp.ContentLength, resp.TransferEncoding, len(bs))
+		}
+		if !bytes.Contains(bs, []byte("0000")) {
+			t.Errorf("%s: got %q", tc.path, bs)
+		}
+	}
+}
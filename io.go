@@ -15,11 +15,22 @@
 package goblet
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"io"
+	"net/http"
+	"strconv"
 
 	"github.com/google/gitprotocolio"
 )
 
+// errLimitExceeded is returned by limitedReader.
+var errLimitExceeded = errors.New("read limit exceeded")
+
+// packfileSectionHeader starts the packfile section of a fetch response.
+var packfileSectionHeader = gitprotocolio.BytesPacket("packfile\n")
+
 func writePacket(w io.Writer, p gitprotocolio.Packet) error {
 	_, err := w.Write(p.EncodeToPktLine())
 	return err
@@ -38,6 +49,212 @@ func writeError(w io.Writer, err error) error {
 	return writePacket(w, gitprotocolio.ErrorPacket(err.Error()))
 }
 
+// writeSideBandError writes err to the side-band error channel, which the
+// client reads in the middle of a packfile section.
+func writeSideBandError(w io.Writer, err error) error {
+	return writePacket(w, gitprotocolio.SideBandErrorPacket(err.Error()+"\n"))
+}
+
+// progressWriter sends progress messages to a client waiting for a fetch
+// response. Progress can be sent only in the packfile section, so the section
+// header is written before the first message, and the header in the
+// git-upload-pack output written through it is dropped.
+type progressWriter struct {
+	w io.Writer
+	// started is set once the packfile section header is written.
+	started bool
+	// pending is the start of the git-upload-pack output that may be the
+	// section header.
+	pending []byte
+	// passThrough is set once the header is dropped or found absent.
+	passThrough bool
+}
+
+// progress writes msg to the side-band progress channel. An empty msg is sent
+// as an empty packet of the pack data channel, which keeps the connection
+// alive without showing anything.
+func (p *progressWriter) progress(msg string) {
+	if !p.started {
+		if err := writePacket(p.w, packfileSectionHeader); err != nil {
+			return
+		}
+		p.started = true
+	}
+	if msg == "" {
+		writePacket(p.w, gitprotocolio.SideBandMainPacket{})
+		return
+	}
+	writePacket(p.w, gitprotocolio.SideBandReportPacket(msg))
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	if !p.started || p.passThrough {
+		return p.w.Write(b)
+	}
+	header := packfileSectionHeader.EncodeToPktLine()
+	p.pending = append(p.pending, b...)
+	if len(p.pending) < len(header) && bytes.HasPrefix(header, p.pending) {
+		return len(b), nil
+	}
+	p.passThrough = true
+	pending := p.pending
+	p.pending = nil
+	if bytes.HasPrefix(pending, header) {
+		pending = pending[len(header):]
+	}
+	if _, err := p.w.Write(pending); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// sectionOrderWriter fixes the order of the sections of a fetch response.
+// git-upload-pack writes wanted-refs before shallow-info, while the client
+// reads them in the documented order, shallow-info first. The sections before
+// the packfile section are buffered and swapped if needed.
+type sectionOrderWriter struct {
+	w io.Writer
+	// buf is the output that is not parsed into sections yet.
+	buf []byte
+	// sections are the complete sections before the packfile section, each
+	// with its delimiter.
+	sections [][]byte
+	// current is the section being read.
+	current []byte
+	// passThrough is set once the sections are written.
+	passThrough bool
+}
+
+func (s *sectionOrderWriter) Write(b []byte) (int, error) {
+	if s.passThrough {
+		return s.w.Write(b)
+	}
+	s.buf = append(s.buf, b...)
+	for len(s.buf) >= 4 {
+		n, err := strconv.ParseUint(string(s.buf[:4]), 16, 16)
+		if err != nil {
+			// Not a pkt-line. Leave it to the client.
+			if err := s.flush(); err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+		if n < 4 {
+			n = 4
+		}
+		if uint64(len(s.buf)) < n {
+			break
+		}
+		pkt := s.buf[:n]
+		s.buf = s.buf[n:]
+		switch {
+		case bytes.Equal(pkt, packfileSectionHeader.EncodeToPktLine()), string(pkt) == "0000":
+			s.current = append(s.current, pkt...)
+			if err := s.flush(); err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		case string(pkt) == "0001":
+			s.sections = append(s.sections, append(s.current, pkt...))
+			s.current = nil
+		default:
+			s.current = append(s.current, pkt...)
+		}
+	}
+	return len(b), nil
+}
+
+// flush writes the buffered output, moving shallow-info before wanted-refs,
+// and passes the rest of the output through.
+func (s *sectionOrderWriter) flush() error {
+	if s.passThrough {
+		return nil
+	}
+	s.passThrough = true
+	wanted, shallow := -1, -1
+	for i, sec := range s.sections {
+		if bytes.HasPrefix(sec, gitprotocolio.BytesPacket("wanted-refs\n").EncodeToPktLine()) {
+			wanted = i
+		} else if bytes.HasPrefix(sec, gitprotocolio.BytesPacket("shallow-info\n").EncodeToPktLine()) {
+			shallow = i
+		}
+	}
+	if wanted >= 0 && wanted < shallow {
+		s.sections[wanted], s.sections[shallow] = s.sections[shallow], s.sections[wanted]
+	}
+	out := bytes.Join(append(s.sections, s.current, s.buf), nil)
+	s.sections, s.current, s.buf = nil, nil, nil
+	_, err := s.w.Write(out)
+	return err
+}
+
+// gzipResponseWriter gzips a response once it reaches minBytes. A smaller
+// response is sent as is when the writer is closed.
+type gzipResponseWriter struct {
+	w        http.ResponseWriter
+	level    int
+	minBytes int
+	// buf is the start of the response until the size reaches minBytes.
+	buf []byte
+	// gw is set once the response is gzipped.
+	gw *gzip.Writer
+	// plain is set once the response is sent without compression.
+	plain bool
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if g.gw != nil {
+		return g.gw.Write(b)
+	}
+	if g.plain {
+		return g.w.Write(b)
+	}
+	g.buf = append(g.buf, b...)
+	if len(g.buf) < g.minBytes {
+		return len(b), nil
+	}
+	if mw, ok := g.w.(*monitoringWriter); ok && mw.status != 0 {
+		// The header is already sent, for example with an upstream
+		// error status. It's too late to set Content-Encoding.
+		return len(b), g.flushPlain()
+	}
+	gw, err := gzip.NewWriterLevel(g.w, g.level)
+	if err != nil {
+		return 0, err
+	}
+	g.w.Header().Set("Content-Encoding", "gzip")
+	g.gw = gw
+	buf := g.buf
+	g.buf = nil
+	if _, err := gw.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// flushPlain writes the buffered response without compression. The rest of
+// the response is not compressed either.
+func (g *gzipResponseWriter) flushPlain() error {
+	g.plain = true
+	buf := g.buf
+	g.buf = nil
+	_, err := g.w.Write(buf)
+	return err
+}
+
+// Close finishes the gzip stream, or writes the response as is if it's smaller
+// than minBytes. A response that is buffered entirely is sent with
+// Content-Length instead of the chunked encoding.
+func (g *gzipResponseWriter) Close() error {
+	if g.gw != nil {
+		return g.gw.Close()
+	}
+	if mw, ok := g.w.(*monitoringWriter); !g.plain && (!ok || mw.status == 0) {
+		g.w.Header().Set("Content-Length", strconv.Itoa(len(g.buf)))
+	}
+	return g.flushPlain()
+}
+
 func copyRequestChunk(c *gitprotocolio.ProtocolV2RequestChunk) *gitprotocolio.ProtocolV2RequestChunk {
 	r := *c
 	if r.Argument != nil {
@@ -57,3 +274,53 @@ func copyResponseChunk(c *gitprotocolio.ProtocolV2ResponseChunk) *gitprotocolio.
 	}
 	return &r
 }
+
+// limitedReader reads up to n bytes, and fails if there are more.
+type limitedReader struct {
+	r io.Reader
+	n int64
+	// exceeded is set when the reader has more than n bytes.
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, errLimitExceeded
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		l.exceeded = true
+		return 0, errLimitExceeded
+	}
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// cancelingWriter calls cancel when a write fails. A failed write to the
+// client means that it's gone.
+type cancelingWriter struct {
+	w      io.Writer
+	cancel func()
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		w.cancel()
+	}
+	return n, err
+}
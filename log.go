@@ -0,0 +1,56 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// LogLevel is the verbosity of the server's log. See ServerConfig.LogLevel.
+type LogLevel int
+
+const (
+	// LogLevelError logs only the errors.
+	LogLevelError LogLevel = -1
+	// LogLevelInfo logs the errors and the progress of the operations,
+	// such as the upstream fetches. This is the default.
+	LogLevelInfo LogLevel = 0
+	// LogLevelDebug logs everything, including every request.
+	LogLevelDebug LogLevel = 1
+)
+
+// ParseLogLevel parses "error", "info", or "debug".
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "error":
+		return LogLevelError, nil
+	case "info", "":
+		return LogLevelInfo, nil
+	case "debug":
+		return LogLevelDebug, nil
+	}
+	return LogLevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Logf logs the message with the standard logger if the config's LogLevel
+// enables level.
+func Logf(config *ServerConfig, level LogLevel, format string, a ...interface{}) {
+	if level > config.LogLevel {
+		return
+	}
+	log.Printf(format, a...)
+}
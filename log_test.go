@@ -0,0 +1,64 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogf_Levels(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tc := range []struct {
+		config string
+		want   []string
+	}{
+		{"error", []string{"error message"}},
+		{"info", []string{"error message", "info message"}},
+		{"debug", []string{"error message", "info message", "debug message"}},
+	} {
+		level, err := ParseLogLevel(tc.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &ServerConfig{LogLevel: level}
+		buf.Reset()
+		Logf(config, LogLevelError, "error message")
+		Logf(config, LogLevelInfo, "info message")
+		Logf(config, LogLevelDebug, "debug message")
+
+		got := []string{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			for _, msg := range []string{"error message", "info message", "debug message"} {
+				if strings.HasSuffix(line, msg) {
+					got = append(got, msg)
+				}
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("level %s: got %q, want %q", tc.config, got, tc.want)
+		}
+	}
+
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("ParseLogLevel(verbose) succeeded, want an error")
+	}
+}
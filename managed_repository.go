@@ -17,41 +17,84 @@ package goblet
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/google/gitprotocolio"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"golang.org/x/oauth2"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+const (
+	// lastUpdateFileName is a file in the cached repository that records
+	// the last successful fetch from the upstream.
+	lastUpdateFileName = ".goblet-last-update"
+
+	// upstreamURLFileName is a file in the cached repository with its
+	// upstream URL if ServerConfig.CachePathHasher hides it from the path.
+	upstreamURLFileName = ".goblet-upstream-url"
+
+	// diskUsageCacheDuration is how long DiskUsage reuses the last result
+	// instead of walking the repository again.
+	diskUsageCacheDuration = 10 * time.Second
+
+	defaultFetchRetryBackoff = 1 * time.Second
+
+	// maxUpstreamRedirects is the number of redirects followed for an
+	// ls-refs.
+	maxUpstreamRedirects = 5
+)
+
 var (
+	// managedRepository uses the server credential for the upstream, so
+	// ManagedRepository users don't have to supply one.
+	_ ManagedRepository = &managedRepository{}
+
+	// defaultInitialFetchRefspecs are the heads and the Gerrit changes. See
+	// ServerConfig.InitialFetchRefspecs.
+	defaultInitialFetchRefspecs = []string{"refs/heads/*:refs/heads/*", "refs/changes/*:refs/changes/*"}
+
+	// gitBinary is the git found in PATH, used unless
+	// ServerConfig.GitBinaryPath is set. Empty if not found.
 	gitBinary string
+	// upstreamStatusPattern matches the git-remote-http error of a non-OK
+	// HTTP status.
+	upstreamStatusPattern = regexp.MustCompile(`The requested URL returned error: (\d{3})`)
 	// *managedRepository map keyed by a cached repository path.
 	managedRepos sync.Map
+	// chan struct{} map keyed by *ServerConfig. A fetch holds a slot of
+	// the channel while running. See ServerConfig.MaxConcurrentFetches.
+	fetchSlots sync.Map
+	// http1Client and http2Client are the default clients for the
+	// upstream. They share the connections among the repositories of a
+	// host.
+	http1Client = &http.Client{Transport: newUpstreamTransport(false)}
+	http2Client = &http.Client{Transport: newUpstreamTransport(true)}
 )
 
 func init() {
-	var err error
-	gitBinary, err = exec.LookPath("git")
-	if err != nil {
-		log.Fatal("Cannot find the git binary: ", err)
-	}
+	// ValidateConfig reports a missing git.
+	gitBinary, _ = exec.LookPath("git")
 }
 
 func getManagedRepo(localDiskPath string, u *url.URL, config *ServerConfig) *managedRepository {
@@ -59,6 +102,7 @@ func getManagedRepo(localDiskPath string, u *url.URL, config *ServerConfig) *man
 		localDiskPath: localDiskPath,
 		upstreamURL:   u,
 		config:        config,
+		settings:      hostSettings(config, u.Host),
 	}
 	newM.mu.Lock()
 	m, loaded := managedRepos.LoadOrStore(localDiskPath, newM)
@@ -66,273 +110,1987 @@ func getManagedRepo(localDiskPath string, u *url.URL, config *ServerConfig) *man
 	if !loaded {
 		ret.mu.Unlock()
 	}
-	return ret
+	return ret
+}
+
+// newUpstreamTransport returns a transport that keeps idle connections to the
+// upstream hosts. HTTP/2 is disabled unless http2 is true.
+func newUpstreamTransport(http2 bool) *http.Transport {
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2:     http2,
+	}
+	if !http2 {
+		// A non-nil empty map disables HTTP/2.
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t
+}
+
+// upstreamHTTPClient returns the client for the requests to an upstream host
+// with the settings.
+func upstreamHTTPClient(config *ServerConfig, settings HostSettings) *http.Client {
+	if config.UpstreamHTTPClient != nil {
+		return config.UpstreamHTTPClient
+	}
+	if settings.HTTPVersion == "HTTP/2" {
+		return http2Client
+	}
+	return http1Client
+}
+
+// hostSettings returns the effective settings for the upstream host.
+func hostSettings(config *ServerConfig, host string) HostSettings {
+	ret := HostSettings{
+		UpstreamTimeout:      config.UpstreamTimeout,
+		TokenSource:          config.TokenSource,
+		InitialFetchRefspecs: config.InitialFetchRefspecs,
+		MirrorRefspecs:       config.MirrorRefspecs,
+		HTTPVersion:          config.UpstreamHTTPVersion,
+	}
+	hs, ok := config.HostConfig[host]
+	if !ok {
+		return ret
+	}
+	if hs.UpstreamTimeout != 0 {
+		ret.UpstreamTimeout = hs.UpstreamTimeout
+	}
+	if hs.TokenSource != nil {
+		ret.TokenSource = hs.TokenSource
+	}
+	if len(hs.InitialFetchRefspecs) != 0 {
+		ret.InitialFetchRefspecs = hs.InitialFetchRefspecs
+	}
+	if len(hs.MirrorRefspecs) != 0 {
+		ret.MirrorRefspecs = hs.MirrorRefspecs
+	}
+	if hs.HTTPVersion != "" {
+		ret.HTTPVersion = hs.HTTPVersion
+	}
+	return ret
+}
+
+// canonicalizeURL converts a request URL to the upstream repository URL with
+// config.URLCanonializer. If it's not set, the host's canonicalizer in
+// config.HostURLCanonializers is used. For the other hosts,
+// defaultURLCanonializer is used and the ".git" suffix is normalized.
+func canonicalizeURL(config *ServerConfig, u *url.URL) (*url.URL, error) {
+	canonicalizer := config.URLCanonializer
+	if canonicalizer == nil {
+		canonicalizer = config.HostURLCanonializers[strings.ToLower(u.Host)]
+	}
+	if canonicalizer == nil {
+		canonicalizer = func(u *url.URL) (*url.URL, error) {
+			ret, err := defaultURLCanonializer(u)
+			if err != nil {
+				return nil, err
+			}
+			normalizeGitSuffix(config, ret)
+			return ret, nil
+		}
+	}
+	ret, err := canonicalizer(u)
+	if err != nil {
+		if _, ok := status.FromError(err); !ok {
+			err = status.Errorf(codes.InvalidArgument, "cannot canonicalize the URL: %v", err)
+		}
+		return nil, err
+	}
+	if !isHostAllowed(config, ret.Hostname()) {
+		return nil, status.Errorf(codes.PermissionDenied, "the upstream host %q is not allowed", ret.Hostname())
+	}
+	return ret, nil
+}
+
+// isHostAllowed checks the host against DeniedHosts and AllowedHosts. The
+// patterns are validated by ValidateConfig, so a bad one matches nothing.
+func isHostAllowed(config *ServerConfig, host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range config.DeniedHosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return false
+		}
+	}
+	if len(config.AllowedHosts) == 0 {
+		return true
+	}
+	for _, pattern := range config.AllowedHosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeGitSuffix makes "repo" and "repo.git" the same URL. The ".git"
+// suffix is added for the hosts in GitSuffixHosts and stripped for the others.
+func normalizeGitSuffix(config *ServerConfig, u *url.URL) {
+	u.Path = strings.TrimSuffix(u.Path, ".git")
+	for _, host := range config.GitSuffixHosts {
+		if u.Host == host {
+			u.Path += ".git"
+			return
+		}
+	}
+}
+
+// defaultURLCanonializer strips the Git endpoint suffixes from u.
+func defaultURLCanonializer(u *url.URL) (*url.URL, error) {
+	ret := url.URL{
+		Scheme: u.Scheme,
+		Host:   u.Host,
+		Path:   u.Path,
+	}
+	if ret.Scheme == "" {
+		ret.Scheme = "https"
+	}
+	if ret.Host == "" {
+		return nil, status.Error(codes.InvalidArgument, "the request URL has no host")
+	}
+	for _, suffix := range []string{"/info/refs", "/git-upload-pack", "/git-receive-pack"} {
+		if strings.HasSuffix(ret.Path, suffix) {
+			ret.Path = strings.TrimSuffix(ret.Path, suffix)
+			break
+		}
+	}
+	return &ret, nil
+}
+
+// getLocalDiskPath returns the cache directory of the repository in the realm.
+// The realm is passed to the StorageBackend as the user name of the URL.
+func getLocalDiskPath(config *ServerConfig, canonicalURL *url.URL, realm string) (string, error) {
+	return storageBackend(config).Path(cacheKey(canonicalURL, realm))
+}
+
+// cacheKey returns the URL passed to StorageBackend.Path for the repository in
+// the realm.
+func cacheKey(canonicalURL *url.URL, realm string) *url.URL {
+	key := *canonicalURL
+	if realm != "" {
+		key.User = url.User(realm)
+	}
+	return &key
+}
+
+// lookupManagedRepository returns the cached repository for u. Unlike
+// openManagedRepository, this returns nil if u is not cached yet.
+func lookupManagedRepository(config *ServerConfig, u *url.URL) (*managedRepository, error) {
+	return lookupRealmRepository(config, u, "")
+}
+
+// lookupRealmRepository is lookupManagedRepository for the repository cached
+// in the realm.
+func lookupRealmRepository(config *ServerConfig, u *url.URL, realm string) (*managedRepository, error) {
+	canonicalURL, err := canonicalizeURL(config, u)
+	if err != nil {
+		return nil, err
+	}
+	localDiskPath, err := getLocalDiskPath(config, canonicalURL, realm)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := managedRepos.Load(localDiskPath); ok {
+		return m.(*managedRepository), nil
+	}
+	if exists, err := storageBackend(config).Open(localDiskPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot check the cache dir: %v", err)
+	} else if !exists {
+		return nil, nil
+	}
+	return openRealmRepository(config, u, realm)
+}
+
+func openManagedRepository(config *ServerConfig, u *url.URL) (*managedRepository, error) {
+	return openRealmRepository(config, u, "")
+}
+
+// openRealmRepository opens the repository cached in the realm. The
+// repositories of different realms don't share the cache even if the upstream
+// is the same. An empty realm is the default one.
+func openRealmRepository(config *ServerConfig, u *url.URL, realm string) (*managedRepository, error) {
+	u, err := canonicalizeURL(config, u)
+	if err != nil {
+		return nil, err
+	}
+
+	localDiskPath, err := getLocalDiskPath(config, u, realm)
+	if err != nil {
+		return nil, err
+	}
+
+	m := getManagedRepo(localDiskPath, u, config)
+	err = m.initialize(func() error {
+		migrateLegacyDir(config, cacheKey(u, realm), localDiskPath)
+		backend := storageBackend(config)
+		if exists, err := backend.Open(localDiskPath); err != nil {
+			return status.Errorf(codes.Internal, "error while initializing local Git repoitory: %v", err)
+		} else if !exists {
+			// The checks and OnRepositoryCreated run without the
+			// lock, so that they can call back into the server.
+			if err := checkDraining(config); err != nil {
+				return err
+			}
+			if err := checkRepositoryQuota(config, m); err != nil {
+				return err
+			}
+			if err := notifyRepositoryCreated(config, u); err != nil {
+				return err
+			}
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if err := backend.Create(localDiskPath); err != nil {
+				return status.Errorf(codes.Internal, "cannot create a cache dir: %v", err)
+			}
+			return initRepository(config, localDiskPath, u)
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.lastUpdate = readLastUpdateFile(localDiskPath)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// checkRepositoryQuota fails if r would exceed MaxRepositories. The
+// repositories being created concurrently are counted too.
+func checkRepositoryQuota(config *ServerConfig, r *managedRepository) error {
+	if config.MaxRepositories <= 0 {
+		return nil
+	}
+	n := 0
+	managedRepos.Range(func(key, value interface{}) bool {
+		if m := value.(*managedRepository); m != r && m.config == config {
+			n++
+		}
+		return true
+	})
+	if n >= config.MaxRepositories {
+		return status.Errorf(codes.ResourceExhausted, "cannot cache %s: the cache holds the maximum of %d repositories", r.upstreamURL, config.MaxRepositories)
+	}
+	return nil
+}
+
+// notifyRepositoryCreated calls OnRepositoryCreated if it's set.
+func notifyRepositoryCreated(config *ServerConfig, u *url.URL) error {
+	if config.OnRepositoryCreated == nil {
+		return nil
+	}
+	if err := config.OnRepositoryCreated(u); err != nil {
+		if _, ok := status.FromError(err); !ok {
+			err = status.Errorf(codes.ResourceExhausted, "cannot cache %s: %v", u, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// initialize runs f once, when the repository is opened for the first time.
+// The concurrent opens wait for it. f takes r.mu itself where it needs it. If f
+// fails, the repository is removed from managedRepos so that the next open
+// retries.
+func (r *managedRepository) initialize(f func() error) error {
+	r.initOnce.Do(func() {
+		if r.initErr = f(); r.initErr != nil {
+			if m, ok := managedRepos.Load(r.localDiskPath); ok && m == r {
+				managedRepos.Delete(r.localDiskPath)
+			}
+		}
+	})
+	return r.initErr
+}
+
+// openManagedRepositoryByPath opens an existing cache directory. The upstream
+// URL is read from the remote of the repository, so this works without the
+// request URL that the cache was made for.
+func openManagedRepositoryByPath(config *ServerConfig, localDiskPath string) (*managedRepository, error) {
+	localDiskPath = filepath.Clean(localDiskPath)
+	if m, ok := managedRepos.Load(localDiskPath); ok {
+		return m.(*managedRepository), nil
+	}
+	if fi, err := os.Stat(localDiskPath); err != nil || !fi.IsDir() {
+		return nil, status.Errorf(codes.NotFound, "%s is not a cache directory", localDiskPath)
+	}
+	out := new(bytes.Buffer)
+	if err := runGitWithStdOut(config, noopOperation{}, out, localDiskPath, "config", "--file", filepath.Join(localDiskPath, "config"), "--get", "remote.origin.url"); err != nil {
+		return nil, status.Errorf(codes.NotFound, "%s has no upstream URL: %v", localDiskPath, err)
+	}
+	u, err := url.Parse(strings.TrimSpace(out.String()))
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot parse the upstream URL of %s: %v", localDiskPath, err)
+	}
+
+	m := getManagedRepo(localDiskPath, u, config)
+	err = m.initialize(func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.lastUpdate = readLastUpdateFile(localDiskPath)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// initRepository creates a bare repository at dir that mirrors u.
+func initRepository(config *ServerConfig, dir string, u *url.URL) error {
+	if err := mkdirAll(dir, config.CacheDirMode); err != nil {
+		return status.Errorf(codes.Internal, "cannot create a cache dir: %v", err)
+	}
+
+	op := noopOperation{}
+	if config.CacheDirMode != 0 {
+		// git applies the permission to the files that it creates.
+		runGit(config, op, dir, "init", "--bare", fmt.Sprintf("--shared=0%o", cacheFileMode(config)))
+	} else {
+		runGit(config, op, dir, "init", "--bare")
+	}
+	runGit(config, op, dir, "config", "protocol.version", "2")
+	runGit(config, op, dir, "config", "uploadpack.allowfilter", "1")
+	runGit(config, op, dir, "config", "uploadpack.allowrefinwant", "1")
+	storeDir := objectStoreDir(config, u)
+	if storeDir == "" {
+		// A bitmap needs all the objects in the pack, so the repositories
+		// that share an object store don't have one.
+		runGit(config, op, dir, "config", "repack.writebitmaps", "1")
+	}
+	// It seems there's a bug in libcurl and HTTP/2 doens't work. See
+	// ServerConfig.UpstreamHTTPVersion for overriding this.
+	runGit(config, op, dir, "config", "http.version", "HTTP/1.1")
+	runGit(config, op, dir, "remote", "add", "--mirror=fetch", "origin", u.String())
+	if config.CachePathHasher != nil {
+		if err := writeCacheFile(config, filepath.Join(dir, upstreamURLFileName), []byte(u.String()+"\n")); err != nil {
+			return status.Errorf(codes.Internal, "cannot write the upstream URL: %v", err)
+		}
+	}
+	if storeDir != "" {
+		return linkObjectStore(config, dir, storeDir)
+	}
+	return nil
+}
+
+type managedRepository struct {
+	localDiskPath string
+	lastUpdate    time.Time
+	upstreamURL   *url.URL
+	config        *ServerConfig
+	mu            sync.RWMutex
+	// initOnce runs the initialization of the cache dir. See initialize.
+	initOnce sync.Once
+	// initErr is the error of the initialization.
+	initErr error
+	// fetching is non-zero while fetchUpstream is running.
+	fetching int32
+	// checking is non-zero while recoverIfCorrupted is running.
+	checking int32
+	// sharedRefsGen is refsGen when the objects were last moved to the
+	// shared object store. See ServerConfig.ObjectStoreGroup.
+	sharedRefsGen int64
+
+	// opMu guards inFlight and evicted.
+	opMu sync.Mutex
+	// inFlight is the number of running operations that use localDiskPath.
+	inFlight int
+	// evicted is set once the repository is removed from the cache.
+	evicted bool
+
+	// diskUsageMu guards cachedDiskUsage and diskUsageCheckTime.
+	diskUsageMu        sync.Mutex
+	cachedDiskUsage    int64
+	diskUsageCheckTime time.Time
+
+	// notFoundMu guards notFoundUntil.
+	notFoundMu sync.Mutex
+	// notFoundUntil is when the last "not found" answer from the upstream
+	// expires. See ServerConfig.NegativeCacheTTL.
+	notFoundUntil time.Time
+
+	// lsRefsMu guards lsRefsCheckTimes.
+	lsRefsMu sync.Mutex
+	// lsRefsCheckTimes maps the ref prefixes of an ls-refs to when the
+	// upstream answered it without an update to the cache. See
+	// isLsRefsFresh.
+	lsRefsCheckTimes map[string]time.Time
+
+	// urlMu guards redirectedURL.
+	urlMu sync.Mutex
+	// redirectedURL is where the upstream moved to. See setRedirectedURL.
+	redirectedURL *url.URL
+
+	// settings are the effective settings for the upstream host.
+	settings HostSettings
+
+	// refsGen is incremented when the refs can have changed. See
+	// loadRefSnapshot.
+	refsGen int64
+	// refs holds the *refSnapshot of the refs. It's read without a lock on
+	// the cache hit path.
+	refs atomic.Value
+
+	// statsMu guards stats.
+	statsMu sync.Mutex
+	stats   RepoStats
+
+	// bundleMu serializes the writes of the bundle. See cachedBundle.
+	bundleMu sync.Mutex
+
+	// progressMu guards progressListeners.
+	progressMu sync.Mutex
+	// progressListeners receive the messages of fetchUpstream.
+	progressListeners map[chan string]bool
+
+	// formatMu guards format and capabilities.
+	formatMu sync.Mutex
+	// format is the object format once it's known. See objectFormat.
+	format string
+	// capabilities are the upstream's capabilities once they're known. See
+	// upstreamCapabilities.
+	capabilities []string
+}
+
+// logStats records an outbound command to the upstream, which can be a mirror.
+func (r *managedRepository) logStats(command string, upstream *url.URL, startTime time.Time, err error) {
+	code := codes.Unavailable
+	if st, ok := status.FromError(err); ok {
+		code = st.Code()
+	}
+	latency := int64(time.Now().Sub(startTime) / time.Millisecond)
+	ms := []stats.Measurement{
+		OutboundCommandCount.M(1),
+		OutboundCommandProcessingTime.M(latency),
+	}
+	if command == "fetch" {
+		ms = append(ms, UpstreamFetchCount.M(1), UpstreamFetchProcessingTime.M(latency))
+	}
+	stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{
+			tag.Insert(CommandTypeKey, command),
+			tag.Insert(CommandCanonicalStatusKey, code.String()),
+			tag.Insert(UpstreamHostKey, upstream.Host),
+		},
+		ms...,
+	)
+}
+
+// upstreamContext returns a context bounded by the UpstreamTimeout.
+func (r *managedRepository) upstreamContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withUpstreamTimeout(ctx, r.settings)
+}
+
+// withUpstreamTimeout returns a context bounded by the UpstreamTimeout of the
+// host settings.
+func withUpstreamTimeout(ctx context.Context, settings HostSettings) (context.Context, context.CancelFunc) {
+	if settings.UpstreamTimeout > 0 {
+		return context.WithTimeout(ctx, settings.UpstreamTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (r *managedRepository) lsRefsUpstream(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk) (_ []*gitprotocolio.ProtocolV2ResponseChunk, err error) {
+	ctx, span := tracer(r.config).StartSpan(ctx, "goblet.LsRefsUpstream", trace.WithSpanKind(trace.SpanKindClient))
+	span.AddAttributes(trace.StringAttribute("goblet.host", r.upstreamURL.Host))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if r.isKnownNotFound() {
+		return nil, status.Errorf(codes.NotFound, "the upstream repository is not found: %s", r.upstreamURL)
+	}
+
+	ctx, cancel := r.upstreamContext(ctx)
+	defer cancel()
+	resp, err := r.sendUpstreamCommand(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	chunks := []*gitprotocolio.ProtocolV2ResponseChunk{}
+	v2Resp := gitprotocolio.NewProtocolV2Response(resp.Body)
+	for v2Resp.Scan() {
+		chunks = append(chunks, copyResponseChunk(v2Resp.Chunk()))
+	}
+	if err := v2Resp.Err(); err != nil {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		return nil, fmt.Errorf("cannot parse the upstream response: %v", err)
+	}
+	return chunks, nil
+}
+
+// forwardFetch sends the fetch command to the upstream and copies the response
+// to w. This is for the fetches of the refs that are not mirrored.
+func (r *managedRepository) forwardFetch(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) (err error) {
+	ctx, span := tracer(r.config).StartSpan(ctx, "goblet.ForwardFetch", trace.WithSpanKind(trace.SpanKindClient))
+	span.AddAttributes(trace.StringAttribute("goblet.host", r.upstreamURL.Host))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	ctx, cancel := r.upstreamContext(ctx)
+	defer cancel()
+	resp, err := r.sendUpstreamCommand(ctx, command)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		return status.Errorf(codes.Unavailable, "cannot read the upstream response: %v", err)
+	}
+	return nil
+}
+
+// sendUpstreamCommand sends the command to the upstream, failing over to the
+// mirrors, and returns the OK response. A mirror can lag behind the upstream,
+// so its "not found" fails over to the next mirror, and the repository is
+// known to be not found only if the upstream or all the mirrors say so.
+func (r *managedRepository) sendUpstreamCommand(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk) (*http.Response, error) {
+	upstreams := r.upstreamURLs()
+	var err error
+	mirrorsNotFound := 0
+	for i, upstream := range upstreams {
+		// A host whose circuit is open is skipped.
+		record, aerr := upstreamCircuitBreaker(r.config, upstream.Host).allow()
+		if aerr != nil {
+			if err == nil {
+				err = aerr
+			}
+			continue
+		}
+		resp, serr := r.sendCommandFollowingRedirects(ctx, upstream, i == 0, command)
+		if serr == nil && resp.StatusCode != http.StatusOK {
+			serr = upstreamResponseError(resp)
+		}
+		record(serr)
+		switch {
+		case serr == nil:
+			return resp, nil
+		case isUpstreamNotFound(serr):
+			if i == 0 {
+				r.setNotFound()
+				return nil, serr
+			}
+			mirrorsNotFound++
+			if err == nil {
+				err = serr
+			}
+		case status.Code(serr) == codes.Unavailable:
+			// Fail over to the next mirror only if the upstream is
+			// not reachable.
+			if err == nil || isUpstreamNotFound(err) {
+				err = serr
+			}
+		default:
+			return nil, serr
+		}
+	}
+	if len(upstreams) > 1 && mirrorsNotFound == len(upstreams)-1 {
+		r.setNotFound()
+		return nil, status.Errorf(codes.NotFound, "the repository is not found in the mirrors: %v", err)
+	}
+	return nil, err
+}
+
+// isUpstreamNotFound returns true if err is a 404 of the upstream.
+func isUpstreamNotFound(err error) bool {
+	ue, ok := err.(*upstreamError)
+	return ok && ue.code == http.StatusNotFound
+}
+
+// upstreamResponseError reads the non-OK response and returns its error.
+func upstreamResponseError(resp *http.Response) error {
+	defer resp.Body.Close()
+	errMessage := ""
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		bs, err := ioutil.ReadAll(resp.Body)
+		if err == nil {
+			errMessage = strings.TrimSpace(string(bs))
+		}
+	}
+	return &upstreamError{code: resp.StatusCode, message: errMessage}
+}
+
+// sendCommand sends the command to the upstream. A connection error is
+// returned as Unavailable.
+func (r *managedRepository) sendCommand(ctx context.Context, upstream *url.URL, command []*gitprotocolio.ProtocolV2RequestChunk) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", upstream.String()+"/git-upload-pack", newGitRequest(command))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot construct a request object: %v", err)
+	}
+	authz, err := upstreamAuthorization(r.settings.TokenSource)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Add("Accept", "application/x-git-upload-pack-result")
+	req.Header.Add("Git-Protocol", "version=2")
+	if authz != "" {
+		req.Header.Set("Authorization", authz)
+	}
+	setUpstreamHeaders(r.config, req.Header)
+	injectSpan(r.config, ctx, req)
+
+	startTime := time.Now()
+	// A redirected POST is replayed as a GET, so
+	// sendCommandFollowingRedirects follows the redirects instead.
+	client := *upstreamHTTPClient(r.config, r.settings)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Do(req)
+	if ctx.Err() != nil {
+		err = status.FromContextError(ctx.Err()).Err()
+	} else if err != nil {
+		err = status.Errorf(codes.Unavailable, "cannot send a request to the upstream: %v", err)
+	}
+	name := ""
+	if len(command) != 0 {
+		name = command[0].Command
+	}
+	r.logStats(name, upstream, startTime, err)
+	return resp, err
+}
+
+// sendCommandFollowingRedirects is sendCommand that follows the redirects
+// within the upstream host. If primary is true and the upstream moved
+// permanently, the repository is re-pointed to the new URL.
+func (r *managedRepository) sendCommandFollowingRedirects(ctx context.Context, upstream *url.URL, primary bool, command []*gitprotocolio.ProtocolV2RequestChunk) (*http.Response, error) {
+	for i := 0; ; i++ {
+		resp, err := r.sendCommand(ctx, upstream, command)
+		if err != nil || !isRedirect(resp.StatusCode) {
+			return resp, err
+		}
+		resp.Body.Close()
+		if i == maxUpstreamRedirects {
+			return nil, status.Errorf(codes.Unavailable, "too many redirects from the upstream %s", r.upstreamURL)
+		}
+		moved, err := redirectedRepoURL(upstream, resp)
+		if err != nil {
+			return nil, err
+		}
+		primary = primary && (resp.StatusCode == http.StatusMovedPermanently || resp.StatusCode == http.StatusPermanentRedirect)
+		if primary {
+			r.setRedirectedURL(moved)
+		}
+		upstream = moved
+	}
+}
+
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectedRepoURL returns the repository URL that a redirect of
+// /git-upload-pack points to. A redirect to another host is not followed so
+// that the server's credential is not sent there.
+func redirectedRepoURL(upstream *url.URL, resp *http.Response) (*url.URL, error) {
+	loc, err := resp.Location()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "cannot parse the redirect from the upstream %s: %v", upstream, err)
+	}
+	if loc.Scheme != upstream.Scheme || loc.Host != upstream.Host || !strings.HasSuffix(loc.Path, "/git-upload-pack") {
+		return nil, status.Errorf(codes.FailedPrecondition, "the upstream %s redirects to an unsupported location %s", upstream, loc)
+	}
+	return &url.URL{Scheme: loc.Scheme, Host: loc.Host, Path: strings.TrimSuffix(loc.Path, "/git-upload-pack")}, nil
+}
+
+// setRedirectedURL re-points the repository to the URL the upstream moved to.
+// The URL is persisted as the origin remote, which git-fetch uses. The
+// repository is still identified by the original URL.
+func (r *managedRepository) setRedirectedURL(u *url.URL) {
+	r.urlMu.Lock()
+	changed := r.redirectedURL == nil || r.redirectedURL.String() != u.String()
+	r.redirectedURL = u
+	r.urlMu.Unlock()
+	if !changed {
+		return
+	}
+	if err := r.beginOperation(); err != nil {
+		return
+	}
+	defer r.endOperation()
+	op := r.startOperation(context.Background(), "Redirect")
+	op.Printf("the upstream moved to %s", u)
+	op.Done(runGit(r.config, op, r.localDiskPath, "config", "remote.origin.url", u.String()))
+}
+
+// upstreamURLs returns the upstream URL followed by its mirrors. The upstream
+// URL is the one it's redirected to, if any.
+func (r *managedRepository) upstreamURLs() []*url.URL {
+	primary := r.upstreamURL
+	r.urlMu.Lock()
+	if r.redirectedURL != nil {
+		primary = r.redirectedURL
+	}
+	r.urlMu.Unlock()
+	return append([]*url.URL{primary}, r.config.MirrorURLs[r.upstreamURL.String()]...)
+}
+
+// fetchUpstream fetches all refs from the upstream. The git-fetch is killed
+// when ctx is done.
+func (r *managedRepository) fetchUpstream(ctx context.Context) error {
+	return r.fetchUpstreamWithServerOptions(ctx, nil)
+}
+
+// fetchUpstreamWithServerOptions is fetchUpstream that sends the client's
+// server options to the upstream.
+func (r *managedRepository) fetchUpstreamWithServerOptions(ctx context.Context, serverOptions []string) (err error) {
+	ctx, span := tracer(r.config).StartSpan(ctx, "goblet.FetchUpstream")
+	span.AddAttributes(trace.StringAttribute("goblet.host", r.upstreamURL.Host))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	atomic.AddInt32(&r.fetching, 1)
+	defer atomic.AddInt32(&r.fetching, -1)
+	if err := r.beginOperation(); err != nil {
+		return err
+	}
+	defer r.endOperation()
+
+	var op RunningOperation = &progressOperation{r.startOperation(ctx, "FetchUpstream"), r}
+	defer func() {
+		op.Done(err)
+	}()
+
+	// Because of
+	// https://public-inbox.org/git/20190915211802.207715-1-masayasuzuki@google.com/T/#t,
+	// the initial git-fetch can be very slow. Split the fetch if there's no
+	// reference (== an empty repo).
+	splitGitFetch, err := r.isEmpty()
+	if err != nil {
+		return err
+	}
+
+	// The slot is taken before the lock, so that the readers of the
+	// repository don't wait for the other repositories' fetches.
+	release, err := acquireFetchSlot(ctx, r.config)
+	if err != nil {
+		return err
+	}
+	defer release()
+	fetchStartTime := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ctx, cancel := r.upstreamContext(ctx)
+	defer cancel()
+	if splitGitFetch {
+		// The object format of a repository can be changed only while
+		// it's empty.
+		r.matchObjectFormat(ctx, op)
+	}
+	for i, upstream := range r.upstreamURLs() {
+		// A host whose circuit is open is skipped.
+		record, aerr := upstreamCircuitBreaker(r.config, upstream.Host).allow()
+		if aerr != nil {
+			if err == nil {
+				err = aerr
+			}
+			continue
+		}
+		// The origin remote is the upstream URL. Mirrors are fetched by
+		// URL.
+		remote := "origin"
+		if i > 0 {
+			op.Printf("failing over to the mirror %s", upstream)
+			remote = upstream.String()
+		}
+		startTime := time.Now()
+		err = r.fetchFrom(ctx, op, remote, splitGitFetch, serverOptions)
+		r.logStats("fetch", upstream, startTime, err)
+		record(err)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	r.invalidateRefSnapshot()
+	r.statsMu.Lock()
+	r.stats.FetchCount++
+	r.stats.LastFetchDuration = time.Since(fetchStartTime)
+	r.stats.LastFetchError = err
+	r.statsMu.Unlock()
+	if err == nil {
+		r.lastUpdate = fetchStartTime
+		// The fetch covers all the refs.
+		r.lsRefsMu.Lock()
+		r.lsRefsCheckTimes = nil
+		r.lsRefsMu.Unlock()
+		if werr := writeLastUpdateFile(r.config, r.localDiskPath, fetchStartTime); werr != nil {
+			op.Printf("cannot record the last update time: %v", werr)
+		}
+	}
+	return err
+}
+
+// subscribeProgress returns a channel that receives the messages of
+// fetchUpstream, such as the git-fetch progress. Messages are dropped while the
+// channel is full. The returned function stops the subscription.
+func (r *managedRepository) subscribeProgress() (<-chan string, func()) {
+	ch := make(chan string, 16)
+	r.progressMu.Lock()
+	defer r.progressMu.Unlock()
+	if r.progressListeners == nil {
+		r.progressListeners = map[chan string]bool{}
+	}
+	r.progressListeners[ch] = true
+	return ch, func() {
+		r.progressMu.Lock()
+		defer r.progressMu.Unlock()
+		delete(r.progressListeners, ch)
+	}
+}
+
+// progressOperation is a fetchUpstream operation that also sends its messages
+// to the progress listeners.
+type progressOperation struct {
+	RunningOperation
+	r *managedRepository
+}
+
+func (op *progressOperation) Printf(format string, a ...interface{}) {
+	op.RunningOperation.Printf(format, a...)
+	msg := fmt.Sprintf(format, a...)
+	op.r.progressMu.Lock()
+	defer op.r.progressMu.Unlock()
+	for ch := range op.r.progressListeners {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// acquireFetchSlot waits until the number of running fetches goes below
+// MaxConcurrentFetches. The returned function releases the slot.
+func acquireFetchSlot(ctx context.Context, config *ServerConfig) (func(), error) {
+	if config.MaxConcurrentFetches <= 0 {
+		return func() {}, nil
+	}
+	v, _ := fetchSlots.LoadOrStore(config, make(chan struct{}, config.MaxConcurrentFetches))
+	slots := v.(chan struct{})
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// fetchFrom fetches the mirrored refs from the remote, either "origin" or a
+// mirror URL.
+func (r *managedRepository) fetchFrom(ctx context.Context, op RunningOperation, remote string, splitGitFetch bool, serverOptions []string) error {
+	options := []string{}
+	for _, o := range serverOptions {
+		options = append(options, "--server-option="+o)
+	}
+	mirrorRefspecs := r.settings.MirrorRefspecs
+	if splitGitFetch && !r.config.DisableInitialSplitFetch && (len(mirrorRefspecs) == 0 || len(r.settings.InitialFetchRefspecs) != 0) {
+		refspecs := r.settings.InitialFetchRefspecs
+		if len(refspecs) == 0 {
+			refspecs = defaultInitialFetchRefspecs
+		}
+		if err := r.runGitFetch(ctx, op, append(append(options, "-n", remote), refspecs...)...); err != nil {
+			return err
+		}
+	}
+	if len(mirrorRefspecs) != 0 {
+		return r.runGitFetch(ctx, op, append(append(options, remote), mirrorRefspecs...)...)
+	}
+	if remote == "origin" {
+		return r.runGitFetch(ctx, op, append(options, remote)...)
+	}
+	// Same as the origin's refspec set by "git remote add --mirror=fetch".
+	return r.runGitFetch(ctx, op, append(options, remote, "+refs/*:refs/*")...)
+}
+
+// isMirrored returns true if the ref is fetched into the cache. See
+// ServerConfig.MirrorRefspecs.
+func (r *managedRepository) isMirrored(ref string) bool {
+	if len(r.settings.MirrorRefspecs) == 0 {
+		return true
+	}
+	for _, refspec := range r.settings.MirrorRefspecs {
+		src := strings.TrimPrefix(refspec, "+")
+		if i := strings.Index(src, ":"); i >= 0 {
+			src = src[:i]
+		}
+		if i := strings.Index(src, "*"); i >= 0 {
+			if len(ref) >= len(src)-1 && strings.HasPrefix(ref, src[:i]) && strings.HasSuffix(ref, src[i+1:]) {
+				return true
+			}
+		} else if ref == src {
+			return true
+		}
+	}
+	return false
+}
+
+// isKnownNotFound returns true if the upstream answered "not found" within
+// NegativeCacheTTL.
+func (r *managedRepository) isKnownNotFound() bool {
+	r.notFoundMu.Lock()
+	defer r.notFoundMu.Unlock()
+	return time.Now().Before(r.notFoundUntil)
+}
+
+func (r *managedRepository) setNotFound() {
+	r.notFoundMu.Lock()
+	defer r.notFoundMu.Unlock()
+	r.notFoundUntil = time.Now().Add(r.config.NegativeCacheTTL)
+}
+
+// runGitFetch runs git-fetch with the server's credential for the upstream.
+func (r *managedRepository) runGitFetch(ctx context.Context, op RunningOperation, arg ...string) error {
+	authz, err := upstreamAuthorization(r.settings.TokenSource)
+	if err != nil {
+		return err
+	}
+	// Pass the credential in the environment so that it doesn't show up in
+	// the process table.
+	kv := upstreamGitConfig(r.config)
+	if authz != "" {
+		kv = append(kv, "http.extraHeader", "Authorization: "+authz)
+	}
+	var env []string
+	if len(kv) != 0 {
+		env = gitConfigEnv(kv...)
+	}
+	var gitArgs []string
+	if r.settings.HTTPVersion != "" {
+		// Overrides the repository's default, HTTP/1.1.
+		gitArgs = append(gitArgs, "-c", "http.version="+r.settings.HTTPVersion)
+	}
+	gitArgs = append(append(gitArgs, "fetch", "--progress", "-f"), arg...)
+
+	backoff := r.config.FetchRetryBackoff
+	if backoff <= 0 {
+		backoff = defaultFetchRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		scanner := &upstreamStatusScanner{RunningOperation: op}
+		err = runGitContextWithEnv(ctx, r.config, scanner, env, r.localDiskPath, gitArgs...)
+		if err != nil && ctx.Err() == nil && scanner.code != 0 {
+			err = &upstreamError{code: scanner.code, message: err.Error()}
+		}
+		if err == nil || ctx.Err() != nil || attempt >= r.config.FetchRetries {
+			return err
+		}
+		if scanner.code >= 400 && scanner.code < 500 && scanner.code != http.StatusTooManyRequests {
+			// Retrying doesn't help.
+			return err
+		}
+		op.Printf("git-fetch failed (attempt %d of %d), retrying in %v: %v", attempt+1, r.config.FetchRetries+1, backoff, err)
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return status.FromContextError(ctx.Err()).Err()
+		case <-t.C:
+		}
+		backoff *= 2
+	}
+}
+
+// upstreamError is a non-OK HTTP status from the upstream. It converts to
+// the gRPC code for the HTTP status, and the HTTP handler passes the status
+// through to the client if possible.
+type upstreamError struct {
+	code    int
+	message string
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("got a non-OK response from the upstream: %d %s", e.code, e.message)
+}
+
+// GRPCStatus makes the status package recognize the error.
+func (e *upstreamError) GRPCStatus() *status.Status {
+	return status.New(httpStatusToCode(e.code), e.Error())
+}
+
+// isUpstreamUnavailable returns true if err is a connection error, a timeout,
+// or a server error of the upstream.
+func isUpstreamUnavailable(err error) bool {
+	if ue, ok := err.(*upstreamError); ok && ue.code >= 500 {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+func httpStatusToCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	return codes.Unknown
+}
+
+// upstreamStatusScanner finds the HTTP status of a failed request in the
+// git-fetch output.
+type upstreamStatusScanner struct {
+	RunningOperation
+	code int
+}
+
+func (s *upstreamStatusScanner) Printf(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	if m := upstreamStatusPattern.FindStringSubmatch(msg); m != nil {
+		s.code, _ = strconv.Atoi(m[1])
+	}
+	s.RunningOperation.Printf("%s", msg)
+}
+
+// setUpstreamHeaders sets UpstreamUserAgent and UpstreamExtraHeaders to the
+// header of a request to the upstream. The reserved headers are not replaced.
+func setUpstreamHeaders(config *ServerConfig, h http.Header) {
+	if config.UpstreamUserAgent != "" {
+		h.Set("User-Agent", config.UpstreamUserAgent)
+	}
+	for k, v := range config.UpstreamExtraHeaders {
+		if !isReservedUpstreamHeader(k) {
+			h.Set(k, v)
+		}
+	}
+}
+
+// isReservedUpstreamHeader returns true if the server sets the header of the
+// upstream requests itself, so UpstreamExtraHeaders cannot have it.
+func isReservedUpstreamHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Authorization", "Git-Protocol":
+		return true
+	}
+	return false
+}
+
+// upstreamGitConfig returns the git config, as key and value pairs, that sends
+// UpstreamUserAgent and UpstreamExtraHeaders in git-fetch.
+func upstreamGitConfig(config *ServerConfig) []string {
+	var kv []string
+	if config.UpstreamUserAgent != "" {
+		kv = append(kv, "http.userAgent", config.UpstreamUserAgent)
+	}
+	names := []string{}
+	for k := range config.UpstreamExtraHeaders {
+		if !isReservedUpstreamHeader(k) {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		kv = append(kv, "http.extraHeader", k+": "+config.UpstreamExtraHeaders[k])
+	}
+	return kv
+}
+
+// upstreamAuthorization returns the Authorization header value for the
+// upstream requests. This is empty if ts is nil.
+func upstreamAuthorization(ts oauth2.TokenSource) (string, error) {
+	if ts == nil {
+		return "", nil
+	}
+	t, err := ts.Token()
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
+	}
+	return t.Type() + " " + t.AccessToken, nil
+}
+
+func readLastUpdateFile(localDiskPath string) time.Time {
+	var t time.Time
+	bs, err := ioutil.ReadFile(filepath.Join(localDiskPath, lastUpdateFileName))
+	if err != nil {
+		return t
+	}
+	if err := t.UnmarshalText(bytes.TrimSpace(bs)); err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func writeLastUpdateFile(config *ServerConfig, localDiskPath string, t time.Time) error {
+	bs, err := t.MarshalText()
+	if err != nil {
+		return err
+	}
+	return writeCacheFile(config, filepath.Join(localDiskPath, lastUpdateFileName), bs)
+}
+
+func (r *managedRepository) isFetching() bool {
+	return atomic.LoadInt32(&r.fetching) != 0
+}
+
+// beginOperation marks the start of an operation that uses localDiskPath. This
+// prevents the repository from being evicted until endOperation is called.
+func (r *managedRepository) beginOperation() error {
+	r.opMu.Lock()
+	defer r.opMu.Unlock()
+	if r.evicted {
+		return status.Error(codes.Unavailable, "the repository has been evicted from the cache")
+	}
+	r.inFlight++
+	return nil
+}
+
+func (r *managedRepository) endOperation() {
+	r.opMu.Lock()
+	defer r.opMu.Unlock()
+	r.inFlight--
+}
+
+// evict removes the repository from the cache. It returns false without
+// removing anything if there's an operation running on the repository.
+func (r *managedRepository) evict() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.opMu.Lock()
+	if r.inFlight != 0 {
+		r.opMu.Unlock()
+		return false, nil
+	}
+	r.evicted = true
+	r.opMu.Unlock()
+
+	managedRepos.Delete(r.localDiskPath)
+	if err := storageBackend(r.config).Delete(r.localDiskPath); err != nil {
+		return true, status.Errorf(codes.Internal, "cannot remove the cache dir: %v", err)
+	}
+	return true, nil
+}
+
+func (r *managedRepository) UpstreamURL() *url.URL {
+	u := *r.upstreamURL
+	return &u
+}
+
+func (r *managedRepository) LastUpdateTime() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.lastUpdate
+}
+
+// isLsRefsFresh returns true if the cache matched the upstream for the refs of
+// the ls-refs command within LsRefsCacheWindow, either by a fetch or by an
+// earlier ls-refs with the same ref prefixes.
+func (r *managedRepository) isLsRefsFresh(command []*gitprotocolio.ProtocolV2RequestChunk) bool {
+	if r.config.LsRefsCacheWindow <= 0 {
+		return false
+	}
+	t := r.LastUpdateTime()
+	r.lsRefsMu.Lock()
+	if checked := r.lsRefsCheckTimes[lsRefsKey(command)]; checked.After(t) {
+		t = checked
+	}
+	r.lsRefsMu.Unlock()
+	return !t.IsZero() && time.Since(t) < r.config.LsRefsCacheWindow
+}
+
+// setLsRefsChecked records that the cache matched the upstream for the refs of
+// the ls-refs command at t.
+func (r *managedRepository) setLsRefsChecked(command []*gitprotocolio.ProtocolV2RequestChunk, t time.Time) {
+	if r.config.LsRefsCacheWindow <= 0 {
+		return
+	}
+	r.lsRefsMu.Lock()
+	defer r.lsRefsMu.Unlock()
+	if r.lsRefsCheckTimes == nil {
+		r.lsRefsCheckTimes = map[string]time.Time{}
+	}
+	r.lsRefsCheckTimes[lsRefsKey(command)] = t
+}
+
+// lsRefsKey returns the sorted ref prefixes of the ls-refs command.
+func lsRefsKey(command []*gitprotocolio.ProtocolV2RequestChunk) string {
+	prefixes := []string{}
+	for _, ch := range command {
+		if s := strings.TrimSuffix(string(ch.Argument), "\n"); strings.HasPrefix(s, "ref-prefix ") {
+			prefixes = append(prefixes, strings.TrimPrefix(s, "ref-prefix "))
+		}
+	}
+	sort.Strings(prefixes)
+	return strings.Join(prefixes, "\n")
+}
+
+func (r *managedRepository) Stats() RepoStats {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	return r.stats
+}
+
+func (r *managedRepository) DiskUsage() (int64, error) {
+	r.diskUsageMu.Lock()
+	defer r.diskUsageMu.Unlock()
+	if time.Since(r.diskUsageCheckTime) < diskUsageCacheDuration {
+		return r.cachedDiskUsage, nil
+	}
+	size, err := diskUsage(r.localDiskPath)
+	if err != nil {
+		return 0, err
+	}
+	r.cachedDiskUsage = size
+	r.diskUsageCheckTime = time.Now()
+	return size, nil
+}
+
+func (r *managedRepository) status() *repositoryStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	st := &repositoryStatus{
+		UpstreamURL:    r.upstreamURL.String(),
+		LastUpdateTime: r.lastUpdate,
+	}
+	// The size is informational. Report zero if it cannot be read.
+	st.DiskUsageBytes, _ = r.DiskUsage()
+	return st
+}
+
+func (r *managedRepository) Prefetch(ctx context.Context) error {
+	// An empty repository is fetched in the same split way as for a client
+	// fetch.
+	return r.fetchUpstream(ctx)
+}
+
+// recoverIfCorrupted checks the cached repository with git-fsck. If it's
+// corrupted, for example by an interrupted fetch, the repository is cloned
+// again from the upstream and swapped in.
+func (r *managedRepository) recoverIfCorrupted(ctx context.Context) (err error) {
+	if !atomic.CompareAndSwapInt32(&r.checking, 0, 1) {
+		// Another check is running.
+		return nil
+	}
+	defer atomic.StoreInt32(&r.checking, 0)
+	if err := r.beginOperation(); err != nil {
+		return err
+	}
+	defer r.endOperation()
+
+	cmd := gitCommand(ctx, r.config, "fsck", "--no-dangling", "--no-progress")
+	cmd.Env = []string{}
+	cmd.Dir = r.localDiskPath
+	fsckOutput, fsckErr := cmd.CombinedOutput()
+	if fsckErr == nil || ctx.Err() != nil {
+		return nil
+	}
+
+	op := r.startOperation(ctx, "Recover")
+	defer func() {
+		op.Done(err)
+	}()
+	op.Printf("git-fsck failed: %v\n%s", fsckErr, fsckOutput)
+
+	// Clone next to the cache dir so that the swap is a rename.
+	tmpDir, err := ioutil.TempDir(filepath.Dir(r.localDiskPath), "."+filepath.Base(r.localDiskPath)+".recover")
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot create a temporary dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	freshDir := filepath.Join(tmpDir, "repo")
+	if err := initRepository(r.config, freshDir, r.upstreamURL); err != nil {
+		return err
+	}
+	fresh := &managedRepository{localDiskPath: freshDir, upstreamURL: r.upstreamURL, config: r.config, settings: r.settings}
+	if err := fresh.fetchUpstream(ctx); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	corruptDir := filepath.Join(tmpDir, "corrupt")
+	if err := os.Rename(r.localDiskPath, corruptDir); err != nil {
+		return status.Errorf(codes.Internal, "cannot move the corrupted repository: %v", err)
+	}
+	if err := os.Rename(freshDir, r.localDiskPath); err != nil {
+		os.Rename(corruptDir, r.localDiskPath)
+		return status.Errorf(codes.Internal, "cannot move the recovered repository: %v", err)
+	}
+	r.lastUpdate = fresh.lastUpdate
+	r.invalidateRefSnapshot()
+	op.Printf("recovered the repository")
+	return nil
+}
+
+func (r *managedRepository) RecoverFromBundle(bundlePath string) (err error) {
+	if err := r.beginOperation(); err != nil {
+		return err
+	}
+	defer r.endOperation()
+
+	op := r.startOperation(context.Background(), "ReadBundle")
+	defer func() {
+		op.Done(err)
+	}()
+
+	bundlePath, remote := parseBundlePath(bundlePath)
+	if remote != nil {
+		if bundlePath, err = r.downloadBundle(op, remote); err != nil {
+			return
+		}
+		defer os.Remove(bundlePath)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err = r.checkBundle(op, bundlePath); err != nil {
+		return
+	}
+	err = runGit(r.config, op, r.localDiskPath, "fetch", "--progress", "-f", bundlePath, "refs/*:refs/*")
+	r.invalidateRefSnapshot()
+	return
+}
+
+// parseBundlePath parses the bundle path given to RecoverFromBundle. It
+// returns the local path, or the URL of a remote bundle. A Windows path with a
+// drive letter is local, and so is a "file" URL.
+func parseBundlePath(bundlePath string) (string, *url.URL) {
+	u, err := url.Parse(bundlePath)
+	if err != nil || len(u.Scheme) < 2 {
+		return bundlePath, nil
+	}
+	if u.Scheme == "file" {
+		return u.Path, nil
+	}
+	return "", u
 }
 
-func openManagedRepository(config *ServerConfig, u *url.URL) (*managedRepository, error) {
-	u, err := config.URLCanonializer(u)
+// downloadBundle saves the bundle at u with BundleFetcher to a temporary file
+// next to the cache dir and returns its path.
+func (r *managedRepository) downloadBundle(op RunningOperation, u *url.URL) (string, error) {
+	if r.config.BundleFetcher == nil {
+		return "", status.Errorf(codes.InvalidArgument, "cannot read the bundle %s without a BundleFetcher", u)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(r.localDiskPath), "."+filepath.Base(r.localDiskPath)+".bundle")
 	if err != nil {
-		return nil, err
+		return "", status.Errorf(codes.Internal, "cannot create a temporary file: %v", err)
 	}
+	op.Printf("downloading the bundle %s", u)
+	err = r.config.BundleFetcher(context.Background(), u, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		if _, ok := status.FromError(err); !ok {
+			err = status.Errorf(codes.Unavailable, "cannot download the bundle %s: %v", u, err)
+		}
+		return "", err
+	}
+	return f.Name(), nil
+}
 
-	localDiskPath := filepath.Join(config.LocalDiskCacheRoot, u.Host, u.Path)
-
-	m := getManagedRepo(localDiskPath, u, config)
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// checkBundle fails if the bundle cannot be applied to the cache, or if it
+// looks like the bundle of another repository. A bundle for a cache that has
+// refs must share the history of at least one of them. This is checked in a
+// temporary repository that borrows the cache's objects, so that a mismatched
+// bundle doesn't leave its objects in the cache.
+func (r *managedRepository) checkBundle(op RunningOperation, bundlePath string) error {
+	if err := runGit(r.config, op, r.localDiskPath, "bundle", "verify", "-q", bundlePath); err != nil {
+		return status.Errorf(codes.FailedPrecondition, "cannot apply the bundle %s: %v", bundlePath, err)
+	}
+	cached, err := r.loadRefSnapshot()
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot read the refs of the local cached repository: %v", err)
+	}
+	if len(cached.refs) == 0 {
+		return nil
+	}
 
-	if _, err := os.Stat(localDiskPath); err != nil {
-		if !os.IsNotExist(err) {
-			return nil, status.Errorf(codes.Internal, "error while initializing local Git repoitory: %v", err)
+	tmpDir, err := ioutil.TempDir(filepath.Dir(r.localDiskPath), "."+filepath.Base(r.localDiskPath)+".bundle")
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot create a temporary dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := runGit(r.config, op, tmpDir, "init", "--bare", "-q"); err != nil {
+		return status.Errorf(codes.Internal, "cannot create a temporary repository: %v", err)
+	}
+	// git resolves a relative path against the temporary repository, not
+	// the working directory.
+	objects, err := filepath.Abs(filepath.Join(r.localDiskPath, "objects"))
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot resolve the objects dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "objects", "info", "alternates"), []byte(objects+"\n"), 0640); err != nil {
+		return status.Errorf(codes.Internal, "cannot create a temporary repository: %v", err)
+	}
+	if err := runGit(r.config, op, tmpDir, "fetch", "-q", bundlePath, "refs/*:refs/*"); err != nil {
+		return status.Errorf(codes.FailedPrecondition, "cannot read the bundle %s: %v", bundlePath, err)
+	}
+	bundled, err := readRefs(r.config, tmpDir)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot read the refs of the bundle: %v", err)
+	}
+	for name, id := range bundled {
+		cachedID, ok := cached.refs[name]
+		if !ok {
+			continue
 		}
-
-		if err := os.MkdirAll(localDiskPath, 0750); err != nil {
-			return nil, status.Errorf(codes.Internal, "cannot create a cache dir: %v", err)
+		if err := runGitWithStdOut(r.config, noopOperation{}, ioutil.Discard, tmpDir, "merge-base", id, cachedID); err == nil {
+			return nil
 		}
+	}
+	return status.Errorf(codes.FailedPrecondition, "the bundle %s has no history in common with the cache of %s", bundlePath, r.upstreamURL)
+}
 
-		op := noopOperation{}
-		runGit(op, localDiskPath, "init", "--bare")
-		runGit(op, localDiskPath, "config", "protocol.version", "2")
-		runGit(op, localDiskPath, "config", "uploadpack.allowfilter", "1")
-		runGit(op, localDiskPath, "config", "uploadpack.allowrefinwant", "1")
-		runGit(op, localDiskPath, "config", "repack.writebitmaps", "1")
-		// It seems there's a bug in libcurl and HTTP/2 doens't work.
-		runGit(op, localDiskPath, "config", "http.version", "HTTP/1.1")
-		runGit(op, localDiskPath, "remote", "add", "--mirror=fetch", "origin", u.String())
+func (r *managedRepository) WriteBundle(w io.Writer) (err error) {
+	if err := r.beginOperation(); err != nil {
+		return err
 	}
+	defer r.endOperation()
 
-	return m, nil
+	op := r.startOperation(context.Background(), "CreateBundle")
+	defer func() {
+		op.Done(err)
+	}()
+	err = runGitWithStdOut(r.config, op, w, r.localDiskPath, "bundle", "create", "-", "--all")
+	return
 }
 
-func logStats(command string, startTime time.Time, err error) {
-	code := codes.Unavailable
-	if st, ok := status.FromError(err); ok {
-		code = st.Code()
+func (r *managedRepository) WriteIncrementalBundle(w io.Writer, sinceRefs []string) (err error) {
+	if err := r.beginOperation(); err != nil {
+		return err
 	}
-	stats.RecordWithTags(context.Background(),
-		[]tag.Mutator{
-			tag.Insert(CommandTypeKey, command),
-			tag.Insert(CommandCanonicalStatusKey, code.String()),
-		},
-		OutboundCommandCount.M(1),
-		OutboundCommandProcessingTime.M(int64(time.Now().Sub(startTime)/time.Millisecond)),
-	)
-}
+	defer r.endOperation()
 
-type managedRepository struct {
-	localDiskPath string
-	lastUpdate    time.Time
-	upstreamURL   *url.URL
-	config        *ServerConfig
-	mu            sync.RWMutex
+	op := r.startOperation(context.Background(), "CreateIncrementalBundle")
+	defer func() {
+		op.Done(err)
+	}()
+	args := []string{"bundle", "create", "-", "--all"}
+	for _, ref := range sinceRefs {
+		args = append(args, "^"+ref)
+	}
+	err = runGitWithStdOut(r.config, op, w, r.localDiskPath, args...)
+	return
 }
 
-func (r *managedRepository) lsRefsUpstream(command []*gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2ResponseChunk, error) {
-	req, err := http.NewRequest("POST", r.upstreamURL.String()+"/git-upload-pack", newGitRequest(command))
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot construct a request object: %v", err)
+// hasAnyUpdate returns true if a mirrored ref of the cache doesn't point to
+// the object ID in refs. The refs that are not mirrored are ignored.
+func (r *managedRepository) hasAnyUpdate(refs map[string]string) (bool, error) {
+	names := []string{}
+	for refName := range refs {
+		if r.isMirrored(refName) {
+			names = append(names, refName)
+		}
 	}
-	t, err := r.config.TokenSource.Token()
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
+	if len(names) == 0 {
+		return false, nil
 	}
-	req.Header.Add("Content-Type", "application/x-git-upload-pack-request")
-	req.Header.Add("Accept", "application/x-git-upload-pack-result")
-	req.Header.Add("Git-Protocol", "version=2")
-	t.SetAuthHeader(req)
-
-	startTime := time.Now()
-	resp, err := http.DefaultClient.Do(req)
-	logStats("ls-refs", startTime, err)
+	resolved, err := r.resolveObjects(names)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot send a request to the upstream: %v", err)
+		return false, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		errMessage := ""
-		if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
-			bs, err := ioutil.ReadAll(resp.Body)
-			if err == nil {
-				errMessage = string(bs)
-			}
+	for _, refName := range names {
+		if resolved[refName] != refs[refName] {
+			return true, nil
 		}
-		return nil, fmt.Errorf("got a non-OK response from the upstream: %v %s", resp.StatusCode, errMessage)
 	}
+	return false, nil
+}
 
-	chunks := []*gitprotocolio.ProtocolV2ResponseChunk{}
-	v2Resp := gitprotocolio.NewProtocolV2Response(resp.Body)
-	for v2Resp.Scan() {
-		chunks = append(chunks, copyResponseChunk(v2Resp.Chunk()))
+// hasAllWants returns true if the cache has all the objects and the refs. A ref
+// mapped to an object ID must point to it.
+func (r *managedRepository) hasAllWants(hashes []string, refs map[string]string) (bool, error) {
+	if r.hasAllWantsInSnapshot(hashes, refs) {
+		return true, nil
 	}
-	if err := v2Resp.Err(); err != nil {
-		return nil, fmt.Errorf("cannot parse the upstream response: %v", err)
+	names := append([]string{}, hashes...)
+	for ref := range refs {
+		names = append(names, ref)
 	}
-	return chunks, nil
+	resolved, err := r.resolveObjects(names)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range resolved {
+		if id == "" {
+			return false, nil
+		}
+	}
+	for ref, want := range refs {
+		if want != "" && resolved[ref] != want {
+			return false, nil
+		}
+	}
+	return true, nil
 }
 
-func (r *managedRepository) fetchUpstream() (err error) {
-	op := r.startOperation("FetchUpstream")
-	defer func() {
-		op.Done(err)
-	}()
+// upstreamRefs returns the object IDs of the refs in the upstream. It fails
+// with NotFound if the upstream doesn't have one of them.
+func (r *managedRepository) upstreamRefs(ctx context.Context, refs []string) (map[string]string, error) {
+	ret := map[string]string{}
+	if len(refs) == 0 {
+		return ret, nil
+	}
+	command := []*gitprotocolio.ProtocolV2RequestChunk{{Command: "ls-refs"}}
+	// The upstream assumes SHA-1 unless told otherwise.
+	if format, err := r.objectFormat(ctx); err != nil {
+		return nil, err
+	} else if format != "sha1" {
+		command = append(command, &gitprotocolio.ProtocolV2RequestChunk{Capability: "object-format=" + format})
+	}
+	command = append(command, &gitprotocolio.ProtocolV2RequestChunk{EndCapability: true})
+	for _, ref := range refs {
+		command = append(command, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("ref-prefix " + ref + "\n")})
+	}
+	command = append(command, &gitprotocolio.ProtocolV2RequestChunk{EndArgument: true})
 
-	// Because of
-	// https://public-inbox.org/git/20190915211802.207715-1-masayasuzuki@google.com/T/#t,
-	// the initial git-fetch can be very slow. Split the fetch if there's no
-	// reference (== an empty repo).
-	g, err := git.PlainOpen(r.localDiskPath)
+	chunks, err := r.lsRefsUpstream(ctx, command)
 	if err != nil {
-		return fmt.Errorf("cannot open the local cached repository: %v", err)
+		return nil, err
+	}
+	upstream, err := parseLsRefsResponse(chunks)
+	if err != nil {
+		return nil, err
 	}
-	splitGitFetch := false
-	if _, err := g.Reference("HEAD", true); err == plumbing.ErrReferenceNotFound {
-		splitGitFetch = true
+	for _, ref := range refs {
+		hash, ok := upstream[ref]
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "the upstream doesn't have %s", ref)
+		}
+		ret[ref] = hash
 	}
+	return ret, nil
+}
 
-	var t *oauth2.Token
-	startTime := time.Now()
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	if splitGitFetch {
-		// Fetch heads and changes first.
-		t, err = r.config.TokenSource.Token()
-		if err != nil {
-			err = status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
-			return err
+// refSnapshot is the refs of the cached repository at some point.
+type refSnapshot struct {
+	gen int64
+	// refs maps the ref names to the object IDs.
+	refs map[string]string
+	// tips are the object IDs that the refs point to.
+	tips map[string]bool
+}
+
+// hasAllWantsInSnapshot is the fast path of hasAllWants for a cache hit. It
+// returns true if the wants are the ref tips of the snapshot, which covers the
+// clients that fetch what ls-refs returned. It doesn't start git and doesn't
+// take r.mu. A false result is not final; check the repository then.
+func (r *managedRepository) hasAllWantsInSnapshot(hashes []string, refs map[string]string) bool {
+	snapshot, err := r.loadRefSnapshot()
+	if err != nil {
+		return false
+	}
+	for _, hash := range hashes {
+		if !snapshot.tips[hash] {
+			return false
 		}
-		err = runGit(op, r.localDiskPath, "-c", "http.extraHeader=Authorization: Bearer "+t.AccessToken, "fetch", "--progress", "-f", "-n", "origin", "refs/heads/*:refs/heads/*", "refs/changes/*:refs/changes/*")
 	}
-	if err == nil {
-		t, err = r.config.TokenSource.Token()
-		if err != nil {
-			err = status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
-			return err
+	for ref, want := range refs {
+		id, ok := snapshot.refs[ref]
+		if !ok || (want != "" && id != want) {
+			return false
 		}
-		err = runGit(op, r.localDiskPath, "-c", "http.extraHeader=Authorization: Bearer "+t.AccessToken, "fetch", "--progress", "-f", "origin")
 	}
-	logStats("fetch", startTime, err)
-	if err == nil {
-		r.lastUpdate = startTime
+	return true
+}
+
+// loadRefSnapshot returns the current snapshot of the refs, reading the refs
+// if they can have changed since the last snapshot. Objects are not removed
+// while they are referenced, so the tips of a snapshot exist until the refs
+// change.
+func (r *managedRepository) loadRefSnapshot() (*refSnapshot, error) {
+	// Read the generation before the refs, so that a change while reading
+	// them makes the snapshot stale.
+	gen := atomic.LoadInt64(&r.refsGen)
+	if snapshot, ok := r.refs.Load().(*refSnapshot); ok && snapshot.gen == gen {
+		return snapshot, nil
 	}
-	return err
+
+	refs, err := readRefs(r.config, r.localDiskPath)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &refSnapshot{gen: gen, refs: refs, tips: map[string]bool{}}
+	for _, id := range refs {
+		snapshot.tips[id] = true
+	}
+	r.refs.Store(snapshot)
+	return snapshot, nil
 }
 
-func (r *managedRepository) UpstreamURL() *url.URL {
-	u := *r.upstreamURL
-	return &u
+// readRefs returns the object IDs of the refs of the repository at gitDir,
+// keyed by the ref names.
+func readRefs(config *ServerConfig, gitDir string) (map[string]string, error) {
+	b := new(bytes.Buffer)
+	if err := runGitWithStdOut(config, noopOperation{}, b, gitDir, "for-each-ref", "--format=%(objectname) %(refname)"); err != nil {
+		return nil, err
+	}
+	refs := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		ss := strings.SplitN(line, " ", 2)
+		if len(ss) != 2 {
+			continue
+		}
+		refs[ss[1]] = ss[0]
+	}
+	return refs, nil
 }
 
-func (r *managedRepository) LastUpdateTime() time.Time {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	return r.lastUpdate
+// invalidateRefSnapshot makes the next loadRefSnapshot read the refs. Call this
+// after the refs or the objects are changed.
+func (r *managedRepository) invalidateRefSnapshot() {
+	atomic.AddInt64(&r.refsGen, 1)
 }
 
-func (r *managedRepository) RecoverFromBundle(bundlePath string) (err error) {
-	op := r.startOperation("ReadBundle")
-	defer func() {
-		op.Done(err)
-	}()
+// resolveObjects resolves object IDs and ref names to the object IDs in the
+// cached repository. A name that cannot be resolved is mapped to "".
+func (r *managedRepository) resolveObjects(names []string) (map[string]string, error) {
+	resolved := map[string]string{}
+	if len(names) == 0 {
+		return resolved, nil
+	}
+	cmd := gitCommand(context.Background(), r.config, "cat-file", "--batch-check=%(objectname)")
+	cmd.Env = []string{}
+	cmd.Dir = r.localDiskPath
+	cmd.Stdin = strings.NewReader(strings.Join(names, "\n") + "\n")
+	bs, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cannot look up objects in the local cached repository: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(bs), "\n"), "\n")
+	if len(lines) != len(names) {
+		return nil, fmt.Errorf("cannot look up objects in the local cached repository: got %d results for %d names", len(lines), len(names))
+	}
+	for i, name := range names {
+		// A missing object is reported as "<name> missing".
+		if isObjectID(lines[i]) {
+			resolved[name] = lines[i]
+		} else {
+			resolved[name] = ""
+		}
+	}
+	return resolved, nil
+}
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	err = runGit(op, r.localDiskPath, "fetch", "--progress", "-f", bundlePath, "refs/*:refs/*")
-	return
+// isEmpty returns true if the cached repository has no refs.
+func (r *managedRepository) isEmpty() (bool, error) {
+	var b bytes.Buffer
+	if err := runGitWithStdOut(r.config, noopOperation{}, &b, r.localDiskPath, "for-each-ref", "--count=1"); err != nil {
+		return false, fmt.Errorf("cannot open the local cached repository: %v", err)
+	}
+	return b.Len() == 0, nil
 }
 
-func (r *managedRepository) WriteBundle(w io.Writer) (err error) {
-	op := r.startOperation("CreateBundle")
-	defer func() {
-		op.Done(err)
-	}()
-	err = runGitWithStdOut(op, w, r.localDiskPath, "bundle", "create", "-", "--all")
-	return
+// localObjectFormat returns the object format of the cached repository.
+func (r *managedRepository) localObjectFormat() (string, error) {
+	var b bytes.Buffer
+	if err := runGitWithStdOut(r.config, noopOperation{}, &b, r.localDiskPath, "rev-parse", "--show-object-format"); err != nil {
+		return "", fmt.Errorf("cannot read the object format of the local cached repository: %v", err)
+	}
+	return strings.TrimSpace(b.String()), nil
 }
 
-func (r *managedRepository) hasAnyUpdate(refs map[string]plumbing.Hash) (bool, error) {
-	g, err := git.PlainOpen(r.localDiskPath)
+// objectFormat returns the object format of the repository, "sha1" or
+// "sha256". While the cached repository is empty, the format is taken from
+// the upstream. An upstream that doesn't advertise one uses SHA-1.
+func (r *managedRepository) objectFormat(ctx context.Context) (string, error) {
+	r.formatMu.Lock()
+	format := r.format
+	r.formatMu.Unlock()
+	if format != "" {
+		return format, nil
+	}
+
+	empty, err := r.isEmpty()
 	if err != nil {
-		return false, fmt.Errorf("cannot open the local cached repository: %v", err)
+		return "", err
 	}
-	for refName, hash := range refs {
-		ref, err := g.Reference(plumbing.ReferenceName(refName), true)
-		if err == plumbing.ErrReferenceNotFound {
-			return true, nil
-		} else if err != nil {
-			return false, fmt.Errorf("cannot open the reference: %v", err)
+	if !empty || (r.upstreamURL.Scheme != "http" && r.upstreamURL.Scheme != "https") {
+		// Only HTTP upstreams advertise the format without a fetch.
+		if format, err = r.localObjectFormat(); err != nil {
+			return "", err
 		}
-		if ref.Hash() != hash {
-			return true, nil
+		if !empty {
+			r.setObjectFormat(format)
 		}
+		return format, nil
 	}
-	return false, nil
+	capabilities, err := r.upstreamCapabilities(ctx)
+	if err != nil {
+		return "", err
+	}
+	format = "sha1"
+	for _, c := range capabilities {
+		if strings.HasPrefix(c, "object-format=") {
+			format = strings.TrimPrefix(c, "object-format=")
+		}
+	}
+	r.setObjectFormat(format)
+	return format, nil
 }
 
-func (r *managedRepository) hasAllWants(hashes []plumbing.Hash, refs []string) (bool, error) {
-	g, err := git.PlainOpen(r.localDiskPath)
-	if err != nil {
-		return false, fmt.Errorf("cannot open the local cached repository: %v", err)
+// upstreamCapabilities returns the Git protocol v2 capabilities that the
+// upstream advertises. They are fetched once and cached.
+func (r *managedRepository) upstreamCapabilities(ctx context.Context) ([]string, error) {
+	r.formatMu.Lock()
+	capabilities := r.capabilities
+	r.formatMu.Unlock()
+	if capabilities != nil {
+		return capabilities, nil
 	}
 
-	for _, hash := range hashes {
-		if _, err := g.Object(plumbing.AnyObject, hash); err == plumbing.ErrObjectNotFound {
-			return false, nil
-		} else if err != nil {
-			return false, fmt.Errorf("error while looking up an object for want check: %v", err)
+	var err error
+	for _, upstream := range r.upstreamURLs() {
+		capabilities, err = r.fetchUpstreamCapabilities(ctx, upstream)
+		if err == nil {
+			r.formatMu.Lock()
+			r.capabilities = capabilities
+			r.formatMu.Unlock()
+			return capabilities, nil
+		}
+		if status.Code(err) != codes.Unavailable {
+			break
 		}
 	}
+	return nil, err
+}
 
-	for _, refName := range refs {
-		if _, err := g.Reference(plumbing.ReferenceName(refName), true); err == plumbing.ErrReferenceNotFound {
-			return false, nil
-		} else if err != nil {
-			return false, fmt.Errorf("error while looking up a reference for want check: %v", err)
-		}
+func (r *managedRepository) setObjectFormat(format string) {
+	r.formatMu.Lock()
+	defer r.formatMu.Unlock()
+	r.format = format
+}
+
+// matchObjectFormat changes the object format of the empty cached repository
+// to the upstream's. This is what git-clone does after learning the format.
+func (r *managedRepository) matchObjectFormat(ctx context.Context, op RunningOperation) {
+	format, err := r.objectFormat(ctx)
+	if err != nil {
+		op.Printf("cannot detect the object format of the upstream: %v", err)
+		return
+	}
+	local, err := r.localObjectFormat()
+	if err != nil {
+		op.Printf("%v", err)
+		return
+	}
+	if local == format {
+		return
 	}
+	op.Printf("changing the object format from %s to %s", local, format)
+	runGit(r.config, op, r.localDiskPath, "config", "core.repositoryformatversion", "1")
+	runGit(r.config, op, r.localDiskPath, "config", "extensions.objectformat", format)
+}
 
-	return true, nil
+// fetchUpstreamCapabilities requests the capability advertisement of the
+// upstream.
+func (r *managedRepository) fetchUpstreamCapabilities(ctx context.Context, upstream *url.URL) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", upstream.String()+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot construct a request object: %v", err)
+	}
+	authz, err := upstreamAuthorization(r.settings.TokenSource)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Git-Protocol", "version=2")
+	if authz != "" {
+		req.Header.Set("Authorization", authz)
+	}
+	setUpstreamHeaders(r.config, req.Header)
+	resp, err := upstreamHTTPClient(r.config, r.settings).Do(req)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "cannot send a request to the upstream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &upstreamError{code: resp.StatusCode, message: fmt.Sprintf("got a non-OK response from the upstream: %v", resp.StatusCode)}
+	}
+
+	capabilities := []string{}
+	ir := gitprotocolio.NewInfoRefsResponse(resp.Body)
+	for ir.Scan() {
+		capabilities = append(capabilities, ir.Chunk().Capabilities...)
+	}
+	if err := ir.Err(); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot parse the upstream capability advertisement: %v", err)
+	}
+	return capabilities, nil
 }
 
-func (r *managedRepository) serveFetchLocal(command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error {
-	// If fetch-upstream is running, it's possible that Git returns
-	// incomplete set of objects when the refs being fetched is updated and
-	// it uses ref-in-want.
-	cmd := exec.Command(gitBinary, "upload-pack", "--stateless-rpc", r.localDiskPath)
+// serveFetchLocal runs git-upload-pack for the command. If the client
+// disconnects, which cancels ctx or fails a write to w, git-upload-pack is
+// killed so that it doesn't produce a packfile nobody reads.
+func (r *managedRepository) serveFetchLocal(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error {
+	if err := r.beginOperation(); err != nil {
+		return err
+	}
+	defer r.endOperation()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// openManagedRepository configures uploadpack.allowfilter, but force it
+	// for repositories that were created otherwise.
+	args := []string{"-c", "uploadpack.allowfilter=true"}
+	if r.config.PackfileURIResolver != nil && hasPackfileURIs(command) {
+		uris, err := r.config.PackfileURIResolver(r.upstreamURL)
+		if err != nil {
+			return err
+		}
+		// git-upload-pack sends the packfile URIs only with sideband-all.
+		args = append(args, "-c", "uploadpack.allowsidebandall=true")
+		for _, u := range uris {
+			args = append(args, "-c", fmt.Sprintf("uploadpack.blobpackfileuri=%s %s %s", u.ObjectID, u.PackHash, u.URI))
+		}
+	}
+	// The request's cancellation and deadline kill git-upload-pack and the
+	// git-pack-objects that it spawns.
+	cmd := gitCommand(ctx, r.config, append(args, "upload-pack", "--stateless-rpc", r.localDiskPath)...)
 	cmd.Env = []string{"GIT_PROTOCOL=version=2"}
 	cmd.Dir = r.localDiskPath
+	cw := &countingWriter{w: &cancelingWriter{w, cancel}}
 	cmd.Stdin = newGitRequest(command)
-	cmd.Stdout = w
+	cmd.Stdout = cw
 	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	var sw *sectionOrderWriter
+	if hasWantRefs(command) {
+		sw = &sectionOrderWriter{w: cw}
+		cmd.Stdout = sw
+	}
+	err := runProcessGroup(ctx, cmd)
+	if sw != nil {
+		if ferr := sw.flush(); err == nil {
+			err = ferr
+		}
+	}
+
+	r.statsMu.Lock()
+	r.stats.ServeCount++
+	r.stats.ServedBytes += cw.n
+	r.statsMu.Unlock()
+	if err != nil && ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	return err
 }
 
-func (r *managedRepository) startOperation(op string) RunningOperation {
-	if r.config.LongRunningOperationLogger != nil {
-		return r.config.LongRunningOperationLogger(op, r.upstreamURL)
+// startOperation starts the log of an operation for the request of ctx. An
+// operation without a request gets a new request ID.
+func (r *managedRepository) startOperation(ctx context.Context, op string) RunningOperation {
+	if r.config.LongRunningOperationLogger == nil {
+		return noopOperation{}
 	}
-	return noopOperation{}
+	if RequestID(ctx) == "" {
+		ctx = withRequestID(ctx, newRequestID())
+	}
+	return r.config.LongRunningOperationLogger(ctx, op, r.upstreamURL)
 }
 
-func runGit(op RunningOperation, gitDir string, arg ...string) error {
-	cmd := exec.Command(gitBinary, arg...)
-	cmd.Env = []string{}
+// gitCommand returns a git command that uses config's git binary and extra
+// config.
+func gitCommand(ctx context.Context, config *ServerConfig, arg ...string) *exec.Cmd {
+	bin := gitBinary
+	if config.GitBinaryPath != "" {
+		bin = config.GitBinaryPath
+	}
+	args := []string{}
+	for _, kv := range config.ExtraGitConfig {
+		args = append(args, "-c", kv)
+	}
+	return exec.CommandContext(ctx, bin, append(args, arg...)...)
+}
+
+func runGit(config *ServerConfig, op RunningOperation, gitDir string, arg ...string) error {
+	return runGitContext(context.Background(), config, op, gitDir, arg...)
+}
+
+func runGitContext(ctx context.Context, config *ServerConfig, op RunningOperation, gitDir string, arg ...string) error {
+	return runGitContextWithEnv(ctx, config, op, nil, gitDir, arg...)
+}
+
+// runGitContextWithEnv runs git with the environment variables. The server's
+// environment is not passed.
+func runGitContextWithEnv(ctx context.Context, config *ServerConfig, op RunningOperation, env []string, gitDir string, arg ...string) error {
+	cmd := gitCommand(ctx, config, arg...)
+	cmd.Env = append([]string{}, env...)
 	cmd.Dir = gitDir
-	cmd.Stderr = &operationWriter{op}
-	cmd.Stdout = &operationWriter{op}
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to run a git command: %v", err)
+	stderr, stdout := &operationWriter{op: op}, &operationWriter{op: op}
+	cmd.Stderr = stderr
+	cmd.Stdout = stdout
+	err := runProcessGroup(ctx, cmd)
+	stderr.flush()
+	stdout.flush()
+	if err != nil {
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		return gitError(err, stderr)
 	}
 	return nil
 }
 
-func runGitWithStdOut(op RunningOperation, w io.Writer, gitDir string, arg ...string) error {
-	cmd := exec.Command(gitBinary, arg...)
+// gitError is the error of a failed git command with the last lines that git
+// wrote to stderr, which tell why it failed.
+func gitError(err error, stderr *operationWriter) error {
+	if len(stderr.tail) == 0 {
+		return fmt.Errorf("failed to run a git command: %v", err)
+	}
+	return fmt.Errorf("failed to run a git command: %v: %s", err, strings.Join(stderr.tail, "; "))
+}
+
+// gitConfigEnv returns the environment variables that set the config, given as
+// key and value pairs. Unlike "-c", they are not visible in the command line.
+// This needs git 2.31 or later.
+func gitConfigEnv(kv ...string) []string {
+	env := []string{fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(kv)/2)}
+	for i := 0; i+1 < len(kv); i += 2 {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i/2, kv[i]),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i/2, kv[i+1]),
+		)
+	}
+	return env
+}
+
+func runGitWithStdOut(config *ServerConfig, op RunningOperation, w io.Writer, gitDir string, arg ...string) error {
+	cmd := gitCommand(context.Background(), config, arg...)
 	cmd.Env = []string{}
 	cmd.Dir = gitDir
 	cmd.Stdout = w
-	cmd.Stderr = &operationWriter{op}
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to run a git command: %v", err)
+	stderr := &operationWriter{op: op}
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	stderr.flush()
+	if err != nil {
+		return gitError(err, stderr)
 	}
 	return nil
 }
@@ -350,11 +2108,57 @@ type noopOperation struct{}
 func (noopOperation) Printf(string, ...interface{}) {}
 func (noopOperation) Done(error)                    {}
 
+// operationWriter passes git's output to the operation line by line. A line
+// ends with "\n", or with "\r" for the progress updates that overwrite the
+// line, and the terminator is kept so that the progress shown to the clients
+// is rendered the same way.
 type operationWriter struct {
 	op RunningOperation
+	// buf is the incomplete last line.
+	buf []byte
+	// tail is the last maxOperationTailLines lines, without the progress
+	// updates.
+	tail []string
 }
 
+// maxOperationTailLines is the number of the lines of git's stderr included in
+// the error of a failed command.
+const maxOperationTailLines = 5
+
 func (w *operationWriter) Write(p []byte) (int, error) {
-	w.op.Printf("%s", string(p))
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		if w.buf[i] == '\r' && i+1 < len(w.buf) && w.buf[i+1] == '\n' {
+			i++
+		}
+		line := string(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+		if strings.Trim(line, "\r\n") != "" {
+			w.op.Printf("%s", line)
+			if strings.HasSuffix(line, "\n") {
+				w.addTail(line)
+			}
+		}
+	}
 	return len(p), nil
 }
+
+func (w *operationWriter) addTail(line string) {
+	w.tail = append(w.tail, strings.TrimSpace(line))
+	if len(w.tail) > maxOperationTailLines {
+		w.tail = w.tail[len(w.tail)-maxOperationTailLines:]
+	}
+}
+
+// flush passes the incomplete last line. Call this after the command exits.
+func (w *operationWriter) flush() {
+	if len(w.buf) != 0 {
+		w.op.Printf("%s", string(w.buf))
+		w.addTail(string(w.buf))
+		w.buf = nil
+	}
+}
@@ -0,0 +1,1905 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestUpstream creates a bare repository with one commit on master that
+// can be used as a file:// upstream.
+func newTestUpstream(t testing.TB) *url.URL {
+	t.Helper()
+	dir := newTempDir(t)
+	runTestGit(t, dir, "init", "--bare")
+	pushTestCommit(t, dir)
+	return &url.URL{Scheme: "file", Path: dir}
+}
+
+func pushTestCommit(t testing.TB, upstreamDir string) {
+	t.Helper()
+	work := newTempDir(t)
+	runTestGit(t, work, "init")
+	runTestGit(t, work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--allow-empty", "--message=test")
+	runTestGit(t, work, "push", "-f", upstreamDir, "HEAD:refs/heads/master")
+}
+
+func newTestConfig(t testing.TB) *ServerConfig {
+	t.Helper()
+	return &ServerConfig{
+		LocalDiskCacheRoot: newTempDir(t),
+		URLCanonializer:    func(u *url.URL) (*url.URL, error) { return u, nil },
+		TokenSource:        oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}),
+	}
+}
+
+func newTempDir(t testing.TB) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "goblet_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func runTestGit(t testing.TB, dir string, arg ...string) string {
+	t.Helper()
+	cmd := exec.Command(gitBinary, arg...)
+	cmd.Dir = dir
+	cmd.Env = []string{}
+	bs, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", arg, err, bs)
+	}
+	return string(bs)
+}
+
+// serveGitHTTPBackend serves upstreamDir as "/repo" over the Git HTTP
+// protocol.
+func serveGitHTTPBackend(w http.ResponseWriter, r *http.Request, upstreamDir string) {
+	h := &cgi.Handler{
+		Path: gitBinary,
+		Dir:  upstreamDir,
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + upstreamDir,
+			"GIT_HTTP_EXPORT_ALL=1",
+		},
+		Args: []string{"http-backend"},
+	}
+	if p := r.Header.Get("Git-Protocol"); p != "" {
+		h.Env = append(h.Env, "GIT_PROTOCOL="+p)
+	}
+	r.URL.Path = strings.TrimPrefix(r.URL.Path, "/repo")
+	h.ServeHTTP(w, r)
+}
+
+func clearManagedRepositories() {
+	managedRepos.Range(func(key, value interface{}) bool {
+		managedRepos.Delete(key)
+		return true
+	})
+}
+
+func TestLastUpdateTime_SurvivesRestart(t *testing.T) {
+	config := newTestConfig(t)
+	u := newTestUpstream(t)
+	defer clearManagedRepositories()
+
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := m.LastUpdateTime()
+	if want.IsZero() {
+		t.Fatal("LastUpdateTime is not set after a fetch")
+	}
+
+	clearManagedRepositories()
+	m, err = openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.LastUpdateTime(); !got.Equal(want) {
+		t.Errorf("LastUpdateTime() = %v, want %v", got, want)
+	}
+}
+
+func TestOpenManagedRepository_Concurrent(t *testing.T) {
+	config := newTestConfig(t)
+	u := newTestUpstream(t)
+	defer clearManagedRepositories()
+
+	const n = 16
+	repos := make([]*managedRepository, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			repos[i], errs[i] = openManagedRepository(config, u)
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if repos[i] != repos[0] {
+			t.Fatalf("got different repositories for the same URL")
+		}
+	}
+	// A second "git remote add" would add the URL again.
+	urls := strings.Fields(runTestGit(t, repos[0].localDiskPath, "config", "--get-all", "remote.origin.url"))
+	if len(urls) != 1 {
+		t.Errorf("got remote URLs %q, want one", urls)
+	}
+	if err := repos[0].fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenManagedRepository_OnRepositoryCreated(t *testing.T) {
+	config := newTestConfig(t)
+	u := newTestUpstream(t)
+	rejected := newTestUpstream(t)
+	var mu sync.Mutex
+	created := []string{}
+	config.OnRepositoryCreated = func(u *url.URL) error {
+		if u.String() == rejected.String() {
+			return errors.New("quota exceeded")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		created = append(created, u.String())
+		return nil
+	}
+	defer clearManagedRepositories()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := openManagedRepository(config, u); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// The cache directory exists after a restart.
+	clearManagedRepositories()
+	if _, err := openManagedRepository(config, u); err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 || created[0] != u.String() {
+		t.Errorf("got the created repositories %q, want [%q]", created, u)
+	}
+
+	if _, err := openManagedRepository(config, rejected); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got %v for the rejected repository, want ResourceExhausted", err)
+	}
+	localDiskPath, err := getLocalDiskPath(config, rejected, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(localDiskPath); !os.IsNotExist(err) {
+		t.Errorf("the rejected repository has a cache directory: %v", err)
+	}
+}
+
+func TestOpenManagedRepository_OnRepositoryCreatedCallsBack(t *testing.T) {
+	config := newTestConfig(t)
+	u := newTestUpstream(t)
+	config.OnRepositoryCreated = func(*url.URL) error {
+		// The hook can read the repositories being created.
+		ListManagedRepositories(func(m ManagedRepository) {
+			m.LastUpdateTime()
+		})
+		return nil
+	}
+	defer clearManagedRepositories()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := openManagedRepository(config, u)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnRepositoryCreated deadlocks with LastUpdateTime")
+	}
+}
+
+func TestOpenManagedRepository_MaxRepositories(t *testing.T) {
+	config := newTestConfig(t)
+	config.MaxRepositories = 2
+	u1, u2, u3 := newTestUpstream(t), newTestUpstream(t), newTestUpstream(t)
+	defer clearManagedRepositories()
+
+	m1, err := openManagedRepository(config, u1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openManagedRepository(config, u2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openManagedRepository(config, u3); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v for the third repository, want ResourceExhausted", err)
+	}
+	// The cached ones can still be opened.
+	if _, err := openManagedRepository(config, u1); err != nil {
+		t.Fatal(err)
+	}
+
+	if evicted, err := m1.evict(); !evicted || err != nil {
+		t.Fatalf("evict() = %v, %v", evicted, err)
+	}
+	if _, err := openManagedRepository(config, u3); err != nil {
+		t.Errorf("got %v after an eviction, want a slot", err)
+	}
+}
+
+func TestEvictRepositories_RemovesLeastRecentlyUpdated(t *testing.T) {
+	config := newTestConfig(t)
+	defer clearManagedRepositories()
+
+	var repos []*managedRepository
+	for i := 0; i < 2; i++ {
+		m, err := openManagedRepository(config, newTestUpstream(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.fetchUpstream(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		repos = append(repos, m)
+	}
+	oldest, newest := repos[0], repos[1]
+	oldest.lastUpdate = time.Now().Add(-time.Hour)
+
+	total, err := diskUsage(config.LocalDiskCacheRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.MaxCacheBytes = total - 1
+	evictRepositories(config)
+
+	if _, err := os.Stat(oldest.localDiskPath); !os.IsNotExist(err) {
+		t.Errorf("the oldest repository still exists: %v", err)
+	}
+	if _, ok := managedRepos.Load(oldest.localDiskPath); ok {
+		t.Error("the oldest repository is still managed")
+	}
+	if _, err := os.Stat(newest.localDiskPath); err != nil {
+		t.Errorf("the newest repository is evicted: %v", err)
+	}
+}
+
+func TestEvictRepositories_CountsReposCachedBeforeStart(t *testing.T) {
+	config := newTestConfig(t)
+	defer clearManagedRepositories()
+
+	var repos []*managedRepository
+	for i := 0; i < 2; i++ {
+		m, err := openManagedRepository(config, newTestUpstream(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.fetchUpstream(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		repos = append(repos, m)
+	}
+	oldest, newest := repos[0], repos[1]
+	if err := writeLastUpdateFile(config, oldest.localDiskPath, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	total, err := diskUsage(config.LocalDiskCacheRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart, only the newest repository is opened.
+	clearManagedRepositories()
+	if _, err := openManagedRepositoryByPath(config, newest.localDiskPath); err != nil {
+		t.Fatal(err)
+	}
+	config.MaxCacheBytes = total - 1
+	evictRepositories(config)
+
+	if _, err := os.Stat(oldest.localDiskPath); !os.IsNotExist(err) {
+		t.Errorf("the repository cached before the start is not evicted: %v", err)
+	}
+	if _, err := os.Stat(newest.localDiskPath); err != nil {
+		t.Errorf("the newest repository is evicted: %v", err)
+	}
+}
+
+func TestRefreshPinnedRepositories(t *testing.T) {
+	upstreamDir := newTestUpstream(t).Path
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.PinnedRefs = map[string][]string{u.String(): {"refs/heads/master"}}
+	defer clearManagedRepositories()
+
+	checkPinnedRef := func() {
+		t.Helper()
+		refreshPinnedRepositories(config)
+		m, err := lookupManagedRepository(config, u)
+		if err != nil || m == nil {
+			t.Fatalf("got %v, %v, want the pinned repository cached", m, err)
+		}
+		want := runTestGit(t, upstreamDir, "rev-parse", "master")
+		if got := runTestGit(t, m.localDiskPath, "rev-parse", "master"); got != want {
+			t.Errorf("got master %s, want %s", got, want)
+		}
+	}
+	// Cached without a client request.
+	checkPinnedRef()
+	old := strings.TrimSpace(runTestGit(t, upstreamDir, "rev-parse", "master"))
+	next := strings.TrimSpace(runTestGit(t, upstreamDir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit-tree", "-p", old, "-m", "second", old+"^{tree}"))
+	runTestGit(t, upstreamDir, "update-ref", "refs/heads/master", next)
+	checkPinnedRef()
+
+	config.MaxCacheBytes = 1
+	evictRepositories(config)
+	if m, err := lookupManagedRepository(config, u); err != nil || m == nil {
+		t.Errorf("got %v, %v, want the pinned repository kept", m, err)
+	}
+}
+
+func TestBundle_RoundTripWithoutCredential(t *testing.T) {
+	config := newTestConfig(t)
+	u := newTestUpstream(t)
+	defer clearManagedRepositories()
+
+	m, err := OpenManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.(*managedRepository).fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := m.WriteBundle(buf); err != nil {
+		t.Fatal(err)
+	}
+	bundlePath := filepath.Join(newTempDir(t), "bundle")
+	if err := ioutil.WriteFile(bundlePath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	clearManagedRepositories()
+	config.LocalDiskCacheRoot = newTempDir(t)
+	restored, err := OpenManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.RecoverFromBundle(bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	want := runTestGit(t, u.Path, "rev-parse", "master")
+	if got := runTestGit(t, restored.(*managedRepository).localDiskPath, "rev-parse", "master"); strings.TrimSpace(got) != strings.TrimSpace(want) {
+		t.Errorf("got master %s after the recovery, want %s", got, want)
+	}
+}
+
+func TestRecoverFromBundle_BundleFetcher(t *testing.T) {
+	config := newTestConfig(t)
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	bundlePath := filepath.Join(newTempDir(t), "bundle")
+	runTestGit(t, u.Path, "bundle", "create", bundlePath, "--all")
+	bundle, err := ioutil.ReadFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetched []string
+	config.BundleFetcher = func(ctx context.Context, uri *url.URL, w io.Writer) error {
+		fetched = append(fetched, uri.String())
+		if uri.String() != "gs://backup/repo.bundle" {
+			return status.Errorf(codes.NotFound, "%s is not found", uri)
+		}
+		_, err := w.Write(bundle)
+		return err
+	}
+	defer clearManagedRepositories()
+
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RecoverFromBundle("gs://backup/missing.bundle"); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v for a missing bundle, want NotFound", err)
+	}
+	if err := m.RecoverFromBundle("gs://backup/repo.bundle"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(runTestGit(t, m.localDiskPath, "rev-parse", "master")); got != want {
+		t.Errorf("got master %s after the recovery, want %s", got, want)
+	}
+	// A local path is read without the fetcher.
+	if err := m.RecoverFromBundle("file://" + bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"gs://backup/missing.bundle", "gs://backup/repo.bundle"}; !reflect.DeepEqual(fetched, want) {
+		t.Errorf("got the fetched bundles %q, want %q", fetched, want)
+	}
+	// The downloaded bundles are removed.
+	if tmps, _ := filepath.Glob(filepath.Join(filepath.Dir(m.localDiskPath), ".*.bundle*")); len(tmps) != 0 {
+		t.Errorf("got the temporary files %q", tmps)
+	}
+
+	config.BundleFetcher = nil
+	if err := m.RecoverFromBundle("gs://backup/repo.bundle"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v without a BundleFetcher, want InvalidArgument", err)
+	}
+}
+
+func TestBundle_Incremental(t *testing.T) {
+	config := newTestConfig(t)
+	u := newTestUpstream(t)
+	defer clearManagedRepositories()
+
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	dir := newTempDir(t)
+	basePath, incrementalPath := filepath.Join(dir, "base"), filepath.Join(dir, "incremental")
+	if err := writeBundleFile(m, basePath); err != nil {
+		t.Fatal(err)
+	}
+	old := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	next := strings.TrimSpace(runTestGit(t, u.Path, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit-tree", "-p", old, "-m", "second", old+"^{tree}"))
+	runTestGit(t, u.Path, "update-ref", "refs/heads/master", next)
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := m.WriteIncrementalBundle(buf, []string{old}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(incrementalPath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out := runTestGit(t, dir, "bundle", "list-heads", incrementalPath); !strings.Contains(out, next) {
+		t.Errorf("got the heads %q, want %s", out, next)
+	}
+
+	clearManagedRepositories()
+	config.LocalDiskCacheRoot = newTempDir(t)
+	restored, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The incremental bundle needs the base.
+	if err := restored.RecoverFromBundle(incrementalPath); err == nil {
+		t.Error("RecoverFromBundle() succeeded for the incremental bundle without the base")
+	}
+	if err := restored.RecoverFromBundle(basePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.RecoverFromBundle(incrementalPath); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(runTestGit(t, restored.localDiskPath, "rev-parse", "master")); got != next {
+		t.Errorf("got master %s after the recovery, want %s", got, next)
+	}
+}
+
+func TestRecoverFromBundle_Mismatch(t *testing.T) {
+	config := newTestConfig(t)
+	u := newTestUpstream(t)
+	defer clearManagedRepositories()
+
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	old := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	dir := newTempDir(t)
+
+	other := newTestUpstream(t).Path
+	unrelated := strings.TrimSpace(runTestGit(t, other, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit-tree", "-m", "other", "master^{tree}"))
+	runTestGit(t, other, "update-ref", "refs/heads/master", unrelated)
+	otherBundle := filepath.Join(dir, "other")
+	runTestGit(t, other, "bundle", "create", otherBundle, "--all")
+	if err := m.RecoverFromBundle(otherBundle); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("got %v for the bundle of another repository, want FailedPrecondition", err)
+	}
+	if resolved, err := m.resolveObjects([]string{"refs/heads/master", unrelated}); err != nil {
+		t.Fatal(err)
+	} else if resolved["refs/heads/master"] != old || resolved[unrelated] != "" {
+		t.Errorf("the cache is changed by the mismatched bundle: %v", resolved)
+	}
+
+	next := strings.TrimSpace(runTestGit(t, u.Path, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit-tree", "-p", old, "-m", "second", old+"^{tree}"))
+	runTestGit(t, u.Path, "update-ref", "refs/heads/master", next)
+	bundle := filepath.Join(dir, "bundle")
+	runTestGit(t, u.Path, "bundle", "create", bundle, "--all")
+	if err := m.RecoverFromBundle(bundle); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(runTestGit(t, m.localDiskPath, "rev-parse", "master")); got != next {
+		t.Errorf("got master %s after the recovery, want %s", got, next)
+	}
+}
+
+func TestRecoverFromBundle_IncrementalWithRelativeCacheRoot(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(newTempDir(t)); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	config := newTestConfig(t)
+	config.LocalDiskCacheRoot = "cache"
+	if err := os.Mkdir(config.LocalDiskCacheRoot, 0750); err != nil {
+		t.Fatal(err)
+	}
+	u := newTestUpstream(t)
+	defer clearManagedRepositories()
+
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	old := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	next := strings.TrimSpace(runTestGit(t, u.Path, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit-tree", "-p", old, "-m", "second", old+"^{tree}"))
+	runTestGit(t, u.Path, "update-ref", "refs/heads/master", next)
+	// The prerequisite of the bundle is in the cache.
+	bundle := filepath.Join(newTempDir(t), "bundle")
+	runTestGit(t, u.Path, "bundle", "create", bundle, "master", "^"+old)
+	if err := m.RecoverFromBundle(bundle); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(runTestGit(t, m.localDiskPath, "rev-parse", "master")); got != next {
+		t.Errorf("got master %s after the recovery, want %s", got, next)
+	}
+}
+
+func TestUpstreamCalls_Cancellation(t *testing.T) {
+	// An upstream that never responds.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := m.lsRefsUpstream(ctx, nil); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("lsRefsUpstream returned %v, want DeadlineExceeded", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	done := make(chan error, 1)
+	go func() {
+		done <- m.fetchUpstream(ctx)
+	}()
+	select {
+	case err := <-done:
+		if status.Code(err) != codes.Canceled {
+			t.Errorf("fetchUpstream returned %v, want Canceled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("fetchUpstream is not cancelled")
+	}
+}
+
+type fakeTokenSource struct {
+	token string
+	err   error
+}
+
+func (ts *fakeTokenSource) Token() (*oauth2.Token, error) {
+	if ts.err != nil {
+		return nil, ts.err
+	}
+	return &oauth2.Token{AccessToken: ts.token}, nil
+}
+
+func TestUpstreamCalls_TokenSource(t *testing.T) {
+	authzs := make(chan string, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authzs <- r.Header.Get("Authorization")
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &fakeTokenSource{token: "fake-token"}
+	config := newTestConfig(t)
+	config.TokenSource = ts
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.lsRefsUpstream(context.Background(), nil)
+	if got, want := <-authzs, "Bearer fake-token"; got != want {
+		t.Errorf("ls-refs sent Authorization %q, want %q", got, want)
+	}
+	m.fetchUpstream(context.Background())
+	if got, want := <-authzs, "Bearer fake-token"; got != want {
+		t.Errorf("fetch sent Authorization %q, want %q", got, want)
+	}
+
+	ts.err = errors.New("token refresh failure")
+	if _, err := m.lsRefsUpstream(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "token refresh failure") {
+		t.Errorf("lsRefsUpstream returned %v, want the token error", err)
+	}
+	if err := m.fetchUpstream(context.Background()); err == nil || !strings.Contains(err.Error(), "token refresh failure") {
+		t.Errorf("fetchUpstream returned %v, want the token error", err)
+	}
+}
+
+func TestUpstreamCalls_UserAgentAndExtraHeaders(t *testing.T) {
+	type headers struct{ userAgent, extra, authz string }
+	got := make(chan headers, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- headers{r.Header.Get("User-Agent"), r.Header.Get("X-Goblet-Tenant"), r.Header.Get("Authorization")}
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.UpstreamUserAgent = "goblet-test/1.0"
+	// The reserved headers are not replaced.
+	config.UpstreamExtraHeaders = map[string]string{"X-Goblet-Tenant": "tenant-a", "Authorization": "Bearer other"}
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.ProtocolV1Fallback = true
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := headers{"goblet-test/1.0", "tenant-a", "Bearer token"}
+	m.lsRefsUpstream(context.Background(), nil)
+	if h := <-got; h != want {
+		t.Errorf("ls-refs sent %+v, want %+v", h, want)
+	}
+	m.fetchUpstream(context.Background())
+	if h := <-got; h != want {
+		t.Errorf("fetch sent %+v, want %+v", h, want)
+	}
+	HTTPHandler(config).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/repo/info/refs?service=git-upload-pack", nil))
+	if h := <-got; h != want {
+		t.Errorf("pass-through sent %+v, want %+v", h, want)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	config := newTestConfig(t)
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, newTestUpstream(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := m.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before <= 0 {
+		t.Fatalf("got disk usage %d, want a positive size", before)
+	}
+	if err := ioutil.WriteFile(filepath.Join(m.localDiskPath, "objects", "test-object"), make([]byte, 1000), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := m.DiskUsage(); err != nil {
+		t.Fatal(err)
+	} else if got != before {
+		t.Errorf("got disk usage %d within the cache duration, want the cached %d", got, before)
+	}
+
+	m.diskUsageCheckTime = time.Time{}
+	if got, err := m.DiskUsage(); err != nil {
+		t.Fatal(err)
+	} else if got != before+1000 {
+		t.Errorf("got disk usage %d, want %d", got, before+1000)
+	}
+}
+
+func TestGCRepositories_PacksLooseObjects(t *testing.T) {
+	config := newTestConfig(t)
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, newTestUpstream(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Small fetches leave loose objects.
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !m.needsRepack() {
+		t.Fatal("no loose objects to pack after a fetch")
+	}
+
+	gcRepositories(config)
+
+	packs, err := filepath.Glob(filepath.Join(m.localDiskPath, "objects", "pack", "*.pack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packs) != 1 {
+		t.Errorf("got %d packs, want 1", len(packs))
+	}
+	if m.needsRepack() {
+		t.Error("loose objects remain after GC")
+	}
+}
+
+func TestGCRepositories_ObjectStoreGroup(t *testing.T) {
+	config := newTestConfig(t)
+	base := newTestUpstream(t)
+	fork := &url.URL{Scheme: "file", Path: filepath.Join(newTempDir(t), "fork")}
+	runTestGit(t, base.Path, "clone", "-q", "--bare", base.Path, fork.Path)
+	shared := strings.TrimSpace(runTestGit(t, base.Path, "rev-parse", "master"))
+	forked := strings.TrimSpace(runTestGit(t, fork.Path, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit-tree", "-p", shared, "-m", "fork", shared+"^{tree}"))
+	runTestGit(t, fork.Path, "update-ref", "refs/heads/master", forked)
+	config.ObjectStoreGroup = func(*url.URL) string { return "base" }
+	defer clearManagedRepositories()
+
+	// hasLocalObject returns true if the object is in the repository
+	// without the shared object store.
+	hasLocalObject := func(dir, id string) bool {
+		alternates := filepath.Join(dir, "objects", "info", "alternates")
+		if err := os.Rename(alternates, alternates+".bak"); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Rename(alternates+".bak", alternates)
+		return exec.Command("git", "-C", dir, "cat-file", "-e", id).Run() == nil
+	}
+
+	mBase, err := openManagedRepository(config, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mBase.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	gcRepositories(config)
+	if hasLocalObject(mBase.localDiskPath, shared) {
+		t.Error("the base repository has its own copy of a shared object after GC")
+	}
+
+	mFork, err := openManagedRepository(config, fork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mFork.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if hasLocalObject(mFork.localDiskPath, shared) {
+		t.Error("the fork downloaded an object of the shared object store")
+	}
+	if !hasLocalObject(mFork.localDiskPath, forked) {
+		t.Error("the fork doesn't have its own object")
+	}
+	if got := strings.TrimSpace(runTestGit(t, mFork.localDiskPath, "rev-parse", "master^")); got != shared {
+		t.Errorf("got master^ %s of the fork, want %s", got, shared)
+	}
+}
+
+func TestFetchUpstream_RetriesTransientErrors(t *testing.T) {
+	upstreamDir := newTestUpstream(t).Path
+	want := strings.TrimSpace(runTestGit(t, upstreamDir, "rev-parse", "master"))
+	failures := 2
+	var mu sync.Mutex
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := strings.HasSuffix(r.URL.Path, "/info/refs") && failures > 0
+		if fail {
+			failures--
+		}
+		mu.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := newTestConfig(t)
+	config.FetchRetries = 2
+	config.FetchRetryBackoff = 10 * time.Millisecond
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(runTestGit(t, m.localDiskPath, "rev-parse", "master")); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if failures != 0 {
+		t.Errorf("%d failures are left, want 0", failures)
+	}
+}
+
+func TestGetLocalDiskPath_RejectsTraversal(t *testing.T) {
+	config := newTestConfig(t)
+	for _, tc := range []struct {
+		host string
+		path string
+		ok   bool
+	}{
+		{"git.example.com", "/repo", true},
+		{"git.example.com", "/a/../repo", true},
+		{"git.example.com", "/../../etc", false},
+		{"git.example.com", "/repo/../../other.example.com/repo", false},
+		{"git.example.com", "/..", false},
+		{"git.example.com", "/", true},
+		{"..", "/etc", false},
+		{"", "/repo", true},
+		{"", "/", false},
+	} {
+		_, err := getLocalDiskPath(config, &url.URL{Scheme: "https", Host: tc.host, Path: tc.path}, "")
+		if tc.ok && err != nil {
+			t.Errorf("%s%s: got %v, want no error", tc.host, tc.path, err)
+		} else if !tc.ok && status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s%s: got %v, want InvalidArgument", tc.host, tc.path, err)
+		}
+	}
+}
+
+func TestGetLocalDiskPath_HostAndPort(t *testing.T) {
+	config := newTestConfig(t)
+	for _, tc := range []struct {
+		host string
+		want string
+	}{
+		{"git.example.com", "git.example.com"},
+		{"git.example.com:8443", "git.example.com%3A8443"},
+		{"127.0.0.1:8080", "127.0.0.1%3A8080"},
+		{"[::1]", "%5B%3A%3A1%5D"},
+		{"[::1]:8443", "%5B%3A%3A1%5D%3A8443"},
+		{"[2001:db8::1]:443", "%5B2001%3Adb8%3A%3A1%5D%3A443"},
+		{"[fe80::1%25eth0]", "%5Bfe80%3A%3A1%2525eth0%5D"},
+		// Doesn't collide with [fe80::1].
+		{"fe80--1", "fe80--1"},
+	} {
+		p, err := getLocalDiskPath(config, &url.URL{Scheme: "https", Host: tc.host, Path: "/repo"}, "")
+		if err != nil {
+			t.Errorf("%s: %v", tc.host, err)
+			continue
+		}
+		if want := filepath.Join(config.LocalDiskCacheRoot, tc.want, "repo"); p != want {
+			t.Errorf("%s: got %s, want %s", tc.host, p, want)
+		}
+	}
+}
+
+func TestOpenManagedRepository_MigratesLegacyHostDir(t *testing.T) {
+	config := newTestConfig(t)
+	u := &url.URL{Scheme: "https", Host: "git.example.com:8443", Path: "/repo"}
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	defer clearManagedRepositories()
+	legacy := filepath.Join(config.LocalDiskCacheRoot, "git.example.com:8443", "repo")
+	runTestGit(t, newTempDir(t), "init", "--bare", legacy)
+
+	p, err := getLocalDiskPath(config, u, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(config.LocalDiskCacheRoot, "git.example.com%3A8443", "repo"); p != want {
+		t.Fatalf("got %s, want %s", p, want)
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		t.Fatalf("the legacy directory is moved before the repository is opened: %v", err)
+	}
+
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.localDiskPath != p {
+		t.Errorf("got %s, want %s", m.localDiskPath, p)
+	}
+	if _, err := os.Stat(filepath.Join(p, "HEAD")); err != nil {
+		t.Errorf("the legacy directory is not moved: %v", err)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("the legacy directory remains: %v", err)
+	}
+}
+
+func TestGetLocalDiskPath_Realms(t *testing.T) {
+	config := newTestConfig(t)
+	u := &url.URL{Scheme: "https", Host: "git.example.com", Path: "/repo"}
+	seen := map[string]string{}
+	for _, realm := range []string{"", "team-a", "team-b", "../team-a"} {
+		p, err := getLocalDiskPath(config, u, realm)
+		if err != nil {
+			t.Fatalf("%q: %v", realm, err)
+		}
+		if other, ok := seen[p]; ok {
+			t.Errorf("realms %q and %q share %s", other, realm, p)
+		}
+		seen[p] = realm
+		if !isSubpath(config.LocalDiskCacheRoot, p) {
+			t.Errorf("%q: %s is outside of the cache root", realm, p)
+		}
+	}
+	if p, _ := getLocalDiskPath(config, u, ""); p != filepath.Join(config.LocalDiskCacheRoot, "git.example.com", "repo") {
+		t.Errorf("got %s for the default realm, want the directory of the URL", p)
+	}
+}
+
+func TestGetLocalDiskPath_HashedPath(t *testing.T) {
+	config := newTestConfig(t)
+	config.CachePathHasher = HashCachePath
+	hostDir := filepath.Join(config.LocalDiskCacheRoot, "git.example.com")
+	long := "/" + strings.Repeat("monorepo/deeply-nested-directory/", 200) + "repo"
+	seen := map[string]string{}
+	for _, p := range []string{long, long + "2", "/repo", "/a/../repo"} {
+		dir, err := getLocalDiskPath(config, &url.URL{Scheme: "https", Host: "git.example.com", Path: p}, "")
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		if filepath.Dir(dir) != hostDir {
+			t.Errorf("%s: %s is not directly under %s", p, dir, hostDir)
+		}
+		if n := len(filepath.Base(dir)); n != sha256.Size*2 {
+			t.Errorf("%s: got a directory name of %d characters, want %d", p, n, sha256.Size*2)
+		}
+		if other, ok := seen[dir]; ok && path.Clean(other) != path.Clean(p) {
+			t.Errorf("%s and %s share %s", other, p, dir)
+		}
+		seen[dir] = p
+	}
+	if len(seen) != 3 {
+		t.Errorf("got %d directories, want 3", len(seen))
+	}
+
+	u := newTestUpstream(t)
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadFile(filepath.Join(m.localDiskPath, upstreamURLFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(bs)); got != u.String() {
+		t.Errorf("got %s in the mapping file, want %s", got, u)
+	}
+}
+
+func TestLsRefsUpstream_NegativeCache(t *testing.T) {
+	upstreamDir := newTestUpstream(t).Path
+	var mu sync.Mutex
+	exists := false
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		e := exists
+		mu.Unlock()
+		if !e {
+			http.NotFound(w, r)
+			return
+		}
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := newTestConfig(t)
+	config.NegativeCacheTTL = 200 * time.Millisecond
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsRefs := []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "ls-refs"},
+		{EndRequest: true},
+	}
+	checkLsRefs := func(wantCode codes.Code, wantRequests int) {
+		t.Helper()
+		if _, err := m.lsRefsUpstream(context.Background(), lsRefs); status.Code(err) != wantCode {
+			t.Errorf("got %v, want %v", err, wantCode)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if requests != wantRequests {
+			t.Errorf("got %d upstream requests, want %d", requests, wantRequests)
+		}
+	}
+
+	checkLsRefs(codes.NotFound, 1)
+	// Served from the negative cache even after the repository appears.
+	mu.Lock()
+	exists = true
+	mu.Unlock()
+	checkLsRefs(codes.NotFound, 1)
+
+	time.Sleep(config.NegativeCacheTTL)
+	checkLsRefs(codes.OK, 2)
+	checkLsRefs(codes.OK, 3)
+}
+
+func TestUpstreamCalls_MirrorFailover(t *testing.T) {
+	upstreamDir := newTestUpstream(t).Path
+	want := strings.TrimSpace(runTestGit(t, upstreamDir, "rev-parse", "master"))
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer mirror.Close()
+	mirrorURL, err := url.Parse(mirror.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A primary that refuses connections.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	u, err := url.Parse(closed.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := newTestConfig(t)
+	config.MirrorURLs = map[string][]*url.URL{u.String(): {mirrorURL}}
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsRefs := []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "ls-refs"},
+		{EndRequest: true},
+	}
+	chunks, err := m.lsRefsUpstream(context.Background(), lsRefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, err := parseLsRefsResponse(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := refs["refs/heads/master"]; got != want {
+		t.Errorf("ls-refs: got %s, want %s", got, want)
+	}
+
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(runTestGit(t, m.localDiskPath, "rev-parse", "master")); got != want {
+		t.Errorf("fetch: got %s, want %s", got, want)
+	}
+}
+
+func TestUpstreamCalls_MirrorNotFound(t *testing.T) {
+	upstreamDir := newTestUpstream(t).Path
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer healthy.Close()
+	// A mirror that doesn't have the repository yet.
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	for _, tc := range []struct {
+		name         string
+		upstreams    []*httptest.Server
+		wantCode     codes.Code
+		wantNotFound bool
+	}{
+		{"healthy upstream, not found mirror", []*httptest.Server{healthy, notFound}, codes.OK, false},
+		{"not found upstream, healthy mirror", []*httptest.Server{notFound, healthy}, codes.NotFound, true},
+		{"unreachable upstream, not found and healthy mirrors", []*httptest.Server{closed, notFound, healthy}, codes.OK, false},
+		{"unreachable upstream, not found mirror", []*httptest.Server{closed, notFound}, codes.NotFound, true},
+	} {
+		var urls []*url.URL
+		for _, srv := range tc.upstreams {
+			u, err := url.Parse(srv.URL + "/repo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			urls = append(urls, u)
+		}
+		config := newTestConfig(t)
+		config.MirrorURLs = map[string][]*url.URL{urls[0].String(): urls[1:]}
+		config.NegativeCacheTTL = time.Minute
+		m, err := openManagedRepository(config, urls[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		lsRefs := []*gitprotocolio.ProtocolV2RequestChunk{
+			{Command: "ls-refs"},
+			{EndRequest: true},
+		}
+		if _, err := m.lsRefsUpstream(context.Background(), lsRefs); status.Code(err) != tc.wantCode {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.wantCode)
+		}
+		if got := m.isKnownNotFound(); got != tc.wantNotFound {
+			t.Errorf("%s: got known not found %v, want %v", tc.name, got, tc.wantNotFound)
+		}
+		clearManagedRepositories()
+	}
+}
+
+func TestStats(t *testing.T) {
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	config := newTestConfig(t)
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Stats(); got != (RepoStats{}) {
+		t.Errorf("got %+v for a new repository, want zero", got)
+	}
+
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fetch := []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("want " + want + "\n")},
+		{Argument: []byte("done\n")},
+		{EndRequest: true},
+	}
+	if err := m.serveFetchLocal(context.Background(), fetch, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	got := m.Stats()
+	if got.FetchCount != 1 || got.LastFetchDuration <= 0 || got.LastFetchError != nil {
+		t.Errorf("got fetch stats %+v, want one successful fetch", got)
+	}
+	if got.ServeCount != 1 || got.ServedBytes <= 0 {
+		t.Errorf("got serve stats %+v, want one response with bytes", got)
+	}
+}
+
+func TestGitCommand_ExtraGitConfig(t *testing.T) {
+	config := newTestConfig(t)
+	config.ExtraGitConfig = []string{"goblet.test=value"}
+	b := new(bytes.Buffer)
+	if err := runGitWithStdOut(config, noopOperation{}, b, "", "config", "--get", "goblet.test"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(b.String()); got != "value" {
+		t.Errorf("got %q, want %q", got, "value")
+	}
+}
+
+type recordingOperation struct {
+	mu   *sync.Mutex
+	ops  *[]string
+	name string
+}
+
+func (op recordingOperation) Printf(string, ...interface{}) {}
+
+func (op recordingOperation) Done(error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	*op.ops = append(*op.ops, op.name)
+}
+
+func TestRecoverIfCorrupted(t *testing.T) {
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	config := newTestConfig(t)
+	var mu sync.Mutex
+	ops := []string{}
+	config.LongRunningOperationLogger = func(_ context.Context, name string, _ *url.URL) RunningOperation {
+		return recordingOperation{&mu, &ops, name}
+	}
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.recoverIfCorrupted(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 {
+		t.Fatalf("got operations %v for a healthy repository, want only the fetch", ops)
+	}
+
+	// Corrupt the commit object.
+	object := filepath.Join(m.localDiskPath, "objects", want[:2], want[2:])
+	if err := os.Chmod(object, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(object, []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGit(config, noopOperation{}, m.localDiskPath, "fsck"); err == nil {
+		t.Fatal("got no error from git-fsck of the corrupted repository")
+	}
+
+	if err := m.recoverIfCorrupted(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := ops[len(ops)-1]; got != "Recover" {
+		t.Errorf("got operations %v, want Recover at last", ops)
+	}
+	runTestGit(t, m.localDiskPath, "fsck")
+	if got := strings.TrimSpace(runTestGit(t, m.localDiskPath, "rev-parse", "master")); got != want {
+		t.Errorf("got master %s after the recovery, want %s", got, want)
+	}
+}
+
+func TestFetchUpstream_MaxConcurrentFetches(t *testing.T) {
+	const limit = 2
+	upstreamDir := newTestUpstream(t).Path
+	var mu sync.Mutex
+	running := map[string]bool{}
+	maxRunning := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// "/<n>/repo/..." is the n-th repository.
+		n := strings.SplitN(r.URL.Path, "/", 3)[1]
+		mu.Lock()
+		running[n] = true
+		if len(running) > maxRunning {
+			maxRunning = len(running)
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			delete(running, n)
+			mu.Unlock()
+		}()
+		time.Sleep(20 * time.Millisecond)
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/"+n)
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer upstream.Close()
+
+	config := newTestConfig(t)
+	config.MaxConcurrentFetches = limit
+	defer clearManagedRepositories()
+	var wg sync.WaitGroup
+	for i := 0; i < 3*limit; i++ {
+		u, err := url.Parse(fmt.Sprintf("%s/%d/repo", upstream.URL, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := openManagedRepository(config, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.fetchUpstream(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning > limit {
+		t.Errorf("got %d fetches at the same time, want at most %d", maxRunning, limit)
+	}
+	if maxRunning < limit {
+		t.Errorf("got at most %d fetches at the same time, want %d", maxRunning, limit)
+	}
+}
+
+func TestFetchUpstream_WaitsForSlotWithoutLock(t *testing.T) {
+	config := newTestConfig(t)
+	config.MaxConcurrentFetches = 1
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, newTestUpstream(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := acquireFetchSlot(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- m.fetchUpstream(ctx)
+	}()
+
+	// The repository can be read while its fetch waits for a slot.
+	time.Sleep(50 * time.Millisecond)
+	read := make(chan struct{})
+	go func() {
+		m.LastUpdateTime()
+		close(read)
+	}()
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Error("the fetch waiting for a slot holds the repository lock")
+	}
+	cancel()
+	if err := <-done; status.Code(err) != codes.Canceled {
+		t.Errorf("got %v for the canceled wait, want Canceled", err)
+	}
+	release()
+	<-read
+}
+
+func TestFetchUpstream_InitialSplitFetch(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		disable     bool
+		wantFetches int
+	}{
+		{"split", false, 2},
+		{"single", true, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstreamDir := newTestUpstream(t).Path
+			// A ref that's not fetched by the default initial refspecs.
+			runTestGit(t, upstreamDir, "-c", "user.name=test", "-c", "user.email=test@example.com", "tag", "-a", "-m", "test", "v1", "master")
+			var mu sync.Mutex
+			fetches := 0
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				bs, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if bytes.Contains(bs, []byte("command=fetch")) {
+					mu.Lock()
+					fetches++
+					mu.Unlock()
+				}
+				r.Body = ioutil.NopCloser(bytes.NewReader(bs))
+				serveGitHTTPBackend(w, r, upstreamDir)
+			}))
+			defer upstream.Close()
+			u, err := url.Parse(upstream.URL + "/repo")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config := newTestConfig(t)
+			config.DisableInitialSplitFetch = tc.disable
+			defer clearManagedRepositories()
+			m, err := openManagedRepository(config, u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.fetchUpstream(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if fetches != tc.wantFetches {
+				t.Errorf("got %d fetch commands, want %d", fetches, tc.wantFetches)
+			}
+			runTestGit(t, m.localDiskPath, "rev-parse", "master")
+		})
+	}
+}
+
+func TestRunGitFetch_CredentialNotInArgs(t *testing.T) {
+	const token = "secret-credential"
+	upstreamDir := newTestUpstream(t).Path
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "invalid credential", http.StatusForbidden)
+			return
+		}
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A git wrapper that records the command line.
+	dir := newTempDir(t)
+	argsFile := filepath.Join(dir, "args")
+	wrapper := filepath.Join(dir, "git")
+	script := "#!/bin/sh\necho \"$@\" >> " + argsFile + "\nexec " + gitBinary + " \"$@\"\n"
+	if err := ioutil.WriteFile(wrapper, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	config := newTestConfig(t)
+	config.TokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+	config.GitBinaryPath = wrapper
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(args), "fetch") {
+		t.Errorf("git-fetch is not run through the wrapper: %s", args)
+	}
+	if strings.Contains(string(args), token) {
+		t.Errorf("the credential is in the command line: %s", args)
+	}
+}
+
+func TestHostConfig(t *testing.T) {
+	serverTS := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "server"})
+	githubTS := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "github"})
+	config := newTestConfig(t)
+	config.TokenSource = serverTS
+	config.UpstreamTimeout = time.Minute
+	config.HostConfig = map[string]HostSettings{
+		"github.com": {
+			TokenSource:          githubTS,
+			InitialFetchRefspecs: []string{"refs/heads/*:refs/heads/*"},
+			HTTPVersion:          "HTTP/2",
+		},
+	}
+	defer clearManagedRepositories()
+
+	for _, tc := range []struct {
+		url  string
+		want HostSettings
+	}{
+		{"https://github.com/org/repo", HostSettings{UpstreamTimeout: time.Minute, TokenSource: githubTS, InitialFetchRefspecs: []string{"refs/heads/*:refs/heads/*"}, HTTPVersion: "HTTP/2"}},
+		{"https://gerrit.example.com/repo", HostSettings{UpstreamTimeout: time.Minute, TokenSource: serverTS}},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := openManagedRepository(config, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.settings.UpstreamTimeout != tc.want.UpstreamTimeout || m.settings.TokenSource != tc.want.TokenSource || !reflect.DeepEqual(m.settings.InitialFetchRefspecs, tc.want.InitialFetchRefspecs) || m.settings.HTTPVersion != tc.want.HTTPVersion {
+			t.Errorf("%s: got %+v, want %+v", tc.url, m.settings, tc.want)
+		}
+	}
+}
+
+func TestLsRefsUpstream_FollowsPermanentRedirect(t *testing.T) {
+	upstreamDir := newTestUpstream(t).Path
+	var mu sync.Mutex
+	oldRequests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/old/") {
+			mu.Lock()
+			oldRequests++
+			mu.Unlock()
+			http.Redirect(w, r, "/repo/"+strings.TrimPrefix(r.URL.Path, "/old/"), http.StatusMovedPermanently)
+			return
+		}
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	defer clearManagedRepositories()
+
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := []*gitprotocolio.ProtocolV2RequestChunk{{Command: "ls-refs"}, {EndCapability: true}, {EndArgument: true}}
+	for i := 0; i < 2; i++ {
+		chunks, err := m.lsRefsUpstream(context.Background(), command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refs, err := parseLsRefsResponse(chunks); err != nil {
+			t.Fatal(err)
+		} else if _, ok := refs["refs/heads/master"]; !ok {
+			t.Errorf("got %v, want master", refs)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if oldRequests != 1 {
+		t.Errorf("got %d requests to the old URL, want 1", oldRequests)
+	}
+	want := upstream.URL + "/repo"
+	if got := strings.TrimSpace(runTestGit(t, m.localDiskPath, "config", "remote.origin.url")); got != want {
+		t.Errorf("got origin %s, want %s", got, want)
+	}
+	if got := m.UpstreamURL().String(); got != u.String() {
+		t.Errorf("got the repository URL %s, want the original %s", got, u)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type countingTransport struct {
+	mu       sync.Mutex
+	requests int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requests++
+	t.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestUpstreamHTTPClient(t *testing.T) {
+	upstreamDir := newTestUpstream(t).Path
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveGitHTTPBackend(w, r, upstreamDir)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	defer clearManagedRepositories()
+
+	if got := upstreamHTTPClient(config, HostSettings{}); got != http1Client {
+		t.Errorf("got %v by default, want the HTTP/1.1 client", got)
+	}
+	if got := upstreamHTTPClient(config, HostSettings{HTTPVersion: "HTTP/2"}); got != http2Client {
+		t.Errorf("got %v for HTTP/2, want the HTTP/2 client", got)
+	}
+
+	transport := &countingTransport{}
+	config.UpstreamHTTPClient = &http.Client{Transport: transport}
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := []*gitprotocolio.ProtocolV2RequestChunk{{Command: "ls-refs"}, {EndCapability: true}, {EndArgument: true}}
+	if _, err := m.lsRefsUpstream(context.Background(), command); err != nil {
+		t.Fatal(err)
+	}
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if transport.requests != 1 {
+		t.Errorf("got %d requests through the configured client, want 1", transport.requests)
+	}
+}
+
+type printfOperation struct {
+	lines []string
+}
+
+func (op *printfOperation) Printf(format string, a ...interface{}) {
+	op.lines = append(op.lines, fmt.Sprintf(format, a...))
+}
+
+func (op *printfOperation) Done(error) {}
+
+func TestServeFetchLocal_ContextKillsUploadPack(t *testing.T) {
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	command := []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+		{Argument: []byte("want " + want + "\n")},
+		{Argument: []byte("done\n")},
+		{EndRequest: true},
+	}
+
+	// A git wrapper whose git-upload-pack starts a child that keeps the
+	// output open, as git-pack-objects does, and records the child's PID.
+	dir := newTempDir(t)
+	pidFile := filepath.Join(dir, "pid")
+	wrapper := filepath.Join(dir, "git")
+	script := "#!/bin/sh\ncase \"$*\" in *upload-pack*) sleep 60 & echo $! > " + pidFile + ".tmp; mv " + pidFile + ".tmp " + pidFile + "; wait; exit;; esac\nexec " + gitBinary + " \"$@\"\n"
+	if err := ioutil.WriteFile(wrapper, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.GitBinaryPath = wrapper
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration
+		want    codes.Code
+	}{
+		{"cancel", 0, codes.Canceled},
+		{"deadline", 200 * time.Millisecond, codes.DeadlineExceeded},
+	} {
+		os.Remove(pidFile)
+		ctx, cancel := context.WithCancel(context.Background())
+		if tc.timeout != 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), tc.timeout)
+		}
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- m.serveFetchLocal(ctx, command, ioutil.Discard)
+		}()
+
+		var pid int
+		for deadline := time.Now().Add(10 * time.Second); pid == 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: git-upload-pack is not started", tc.name)
+			}
+			if bs, err := ioutil.ReadFile(pidFile); err == nil {
+				pid, _ = strconv.Atoi(strings.TrimSpace(string(bs)))
+			}
+		}
+		if tc.timeout == 0 {
+			cancel()
+		}
+		select {
+		case err := <-errCh:
+			if status.Code(err) != tc.want {
+				t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: serveFetchLocal doesn't return", tc.name)
+		}
+		cancel()
+		p, err := os.FindProcess(pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(10 * time.Second); p.Signal(syscall.Signal(0)) == nil; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				p.Kill()
+				t.Fatalf("%s: the child of git-upload-pack is running", tc.name)
+			}
+		}
+	}
+}
+
+func TestOperationWriter_Lines(t *testing.T) {
+	op := &printfOperation{}
+	w := &operationWriter{op: op}
+	out := "Counting objects:  50% (1/2)\rCounting objects: 100% (2/2)\rCounting objects: 100% (2/2), done.\n" +
+		"remote: Total 2\r\nFrom https://example.com/repo\n * [new branch] master"
+	// Write in chunks that split the lines in the middle.
+	for i := 0; i < len(out); i += 7 {
+		end := i + 7
+		if end > len(out) {
+			end = len(out)
+		}
+		if n, err := w.Write([]byte(out[i:end])); err != nil || n != end-i {
+			t.Fatalf("Write() = %d, %v, want %d, nil", n, err, end-i)
+		}
+	}
+	w.flush()
+
+	want := []string{
+		"Counting objects:  50% (1/2)\r",
+		"Counting objects: 100% (2/2)\r",
+		"Counting objects: 100% (2/2), done.\n",
+		"remote: Total 2\r\n",
+		"From https://example.com/repo\n",
+		" * [new branch] master",
+	}
+	if !reflect.DeepEqual(op.lines, want) {
+		t.Errorf("got %q, want %q", op.lines, want)
+	}
+	wantTail := []string{"Counting objects: 100% (2/2), done.", "remote: Total 2", "From https://example.com/repo", "* [new branch] master"}
+	if !reflect.DeepEqual(w.tail, wantTail) {
+		t.Errorf("got the tail %q, want %q", w.tail, wantTail)
+	}
+}
+
+func TestFetchUpstream_GitErrorMessage(t *testing.T) {
+	config := newTestConfig(t)
+	u := &url.URL{Scheme: "file", Path: filepath.Join(newTempDir(t), "missing")}
+	defer clearManagedRepositories()
+
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.fetchUpstream(context.Background())
+	if err == nil {
+		t.Fatal("fetchUpstream() succeeded for a missing upstream")
+	}
+	if !strings.Contains(err.Error(), "does not appear to be a git repository") {
+		t.Errorf("got %q, want git's error message", err)
+	}
+}
+
+func TestOpenManagedRepositoryByPath(t *testing.T) {
+	u := newTestUpstream(t)
+	config := newTestConfig(t)
+	defer clearManagedRepositories()
+
+	dir := filepath.Join(config.LocalDiskCacheRoot, "existing")
+	runTestGit(t, "", "init", "--bare", dir)
+	runTestGit(t, dir, "remote", "add", "--mirror=fetch", "origin", u.String())
+	runTestGit(t, dir, "fetch", "origin")
+
+	m, err := OpenManagedRepositoryByPath(config, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.UpstreamURL().String(); got != u.String() {
+		t.Errorf("got upstream %s, want %s", got, u)
+	}
+	var buf bytes.Buffer
+	if err := m.WriteBundle(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("# v2 git bundle\n")) {
+		t.Error("got no bundle header")
+	}
+
+	if _, err := OpenManagedRepositoryByPath(config, filepath.Join(config.LocalDiskCacheRoot, "missing")); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v for a missing directory, want NotFound", err)
+	}
+}
+
+func TestHasAllWants_RefSnapshot(t *testing.T) {
+	u := newTestUpstream(t)
+	config := newTestConfig(t)
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	old := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	if ok, err := m.hasAllWants([]string{old}, map[string]string{"refs/heads/master": old}); err != nil || !ok {
+		t.Fatalf("hasAllWants() = %v, %v for the cached master, want true", ok, err)
+	}
+
+	want := strings.TrimSpace(runTestGit(t, u.Path, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit-tree", "-p", old, "-m", "second", old+"^{tree}"))
+	runTestGit(t, u.Path, "update-ref", "refs/heads/master", want)
+	if ok, err := m.hasAllWants(nil, map[string]string{"refs/heads/master": want}); err != nil || ok {
+		t.Fatalf("hasAllWants() = %v, %v before the fetch, want false", ok, err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !m.hasAllWantsInSnapshot([]string{want}, map[string]string{"refs/heads/master": want}) {
+		t.Error("the snapshot doesn't have the fetched master")
+	}
+}
+
+// BenchmarkHasAllWants_CacheHit checks the wants of concurrent cache hits with
+// the ref snapshot and, for comparison, with git-cat-file.
+func BenchmarkHasAllWants_CacheHit(b *testing.B) {
+	u := newTestUpstream(b)
+	config := newTestConfig(b)
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	want := strings.TrimSpace(runTestGit(b, u.Path, "rev-parse", "master"))
+
+	b.Run("Snapshot", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if ok, err := m.hasAllWants([]string{want}, nil); err != nil || !ok {
+					b.Fatalf("hasAllWants() = %v, %v, want true", ok, err)
+				}
+			}
+		})
+	})
+	b.Run("CatFile", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if resolved, err := m.resolveObjects([]string{want}); err != nil || resolved[want] == "" {
+					b.Fatalf("resolveObjects() = %v, %v, want %s", resolved, err, want)
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Manifest lists the cached repositories for moving the cache to another
+// server. See ExportManifest and ImportManifest.
+type Manifest struct {
+	Repositories []ManifestEntry `json:"repositories"`
+}
+
+// ManifestEntry is a cached repository in a Manifest.
+type ManifestEntry struct {
+	URL            string    `json:"url"`
+	LastUpdateTime time.Time `json:"last_update_time"`
+	ServeCount     int64     `json:"serve_count,omitempty"`
+	ServedBytes    int64     `json:"served_bytes,omitempty"`
+	// Bundle is the path of the repository's bundle relative to the bundle
+	// directory. Empty if no bundle is written.
+	Bundle string `json:"bundle,omitempty"`
+}
+
+// ExportManifest writes the Manifest of the cached repositories to w as JSON.
+// If bundleDir is not empty, a bundle of each repository is written there and
+// referenced from the manifest.
+func ExportManifest(w io.Writer, bundleDir string) error {
+	repos := []ManagedRepository{}
+	ListManagedRepositories(func(m ManagedRepository) {
+		repos = append(repos, m)
+	})
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].UpstreamURL().String() < repos[j].UpstreamURL().String()
+	})
+
+	manifest := &Manifest{Repositories: []ManifestEntry{}}
+	for _, m := range repos {
+		u := m.UpstreamURL()
+		stats := m.Stats()
+		entry := ManifestEntry{
+			URL:            u.String(),
+			LastUpdateTime: m.LastUpdateTime(),
+			ServeCount:     stats.ServeCount,
+			ServedBytes:    stats.ServedBytes,
+		}
+		if bundleDir != "" {
+			entry.Bundle = filepath.Join(hostDirName(u), filepath.FromSlash(u.Path)) + ".bundle"
+			if err := writeBundleFile(m, filepath.Join(bundleDir, entry.Bundle)); err != nil {
+				return fmt.Errorf("cannot write the bundle of %s: %v", u, err)
+			}
+		}
+		manifest.Repositories = append(manifest.Repositories, entry)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(manifest)
+}
+
+func writeBundleFile(m ManagedRepository, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := m.WriteBundle(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// ImportManifest opens the repositories in the Manifest read from r. The
+// bundles referenced from the manifest are read from bundleDir. If fetch is
+// true, the repositories are fetched from the upstream afterwards. A
+// repository that fails is skipped, and the first error is returned after
+// importing the others.
+func ImportManifest(config *ServerConfig, r io.Reader, bundleDir string, fetch bool) error {
+	var manifest Manifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return fmt.Errorf("cannot parse the manifest: %v", err)
+	}
+	var firstErr error
+	for _, entry := range manifest.Repositories {
+		if err := importManifestEntry(config, entry, bundleDir, fetch); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("cannot import %s: %v", entry.URL, err)
+		}
+	}
+	return firstErr
+}
+
+func importManifestEntry(config *ServerConfig, entry ManifestEntry, bundleDir string, fetch bool) error {
+	u, err := url.Parse(entry.URL)
+	if err != nil {
+		return err
+	}
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		return err
+	}
+	if entry.Bundle != "" && bundleDir != "" {
+		if err := m.RecoverFromBundle(filepath.Join(bundleDir, entry.Bundle)); err != nil {
+			return err
+		}
+		// The cache is as new as the bundle.
+		m.mu.Lock()
+		if m.lastUpdate.Before(entry.LastUpdateTime) {
+			m.lastUpdate = entry.LastUpdateTime
+			writeLastUpdateFile(m.config, m.localDiskPath, entry.LastUpdateTime)
+		}
+		m.mu.Unlock()
+	}
+	m.statsMu.Lock()
+	m.stats.ServeCount += entry.ServeCount
+	m.stats.ServedBytes += entry.ServedBytes
+	m.statsMu.Unlock()
+	if fetch {
+		return m.fetchUpstream(context.Background())
+	}
+	return nil
+}
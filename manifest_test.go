@@ -0,0 +1,68 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestManifest_RoundTrip(t *testing.T) {
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	defer clearManagedRepositories()
+
+	src := newTestConfig(t)
+	m, err := openManagedRepository(src, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	lastUpdate := m.LastUpdateTime()
+	bundleDir := newTempDir(t)
+	var manifest bytes.Buffer
+	if err := ExportManifest(&manifest, bundleDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Import into another server's cache. The upstream is gone, so the
+	// refs have to come from the bundle.
+	clearManagedRepositories()
+	runTestGit(t, u.Path, "update-ref", "-d", "refs/heads/master")
+	dst := newTestConfig(t)
+	if err := ImportManifest(dst, &manifest, bundleDir, false); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := lookupManagedRepository(dst, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported == nil {
+		t.Fatalf("%s is not imported", u)
+	}
+	if imported.localDiskPath == m.localDiskPath {
+		t.Fatalf("imported into the source cache %s", m.localDiskPath)
+	}
+	if got := strings.TrimSpace(runTestGit(t, imported.localDiskPath, "rev-parse", "refs/heads/master")); got != want {
+		t.Errorf("got master %s, want %s", got, want)
+	}
+	if got := imported.LastUpdateTime(); !got.Equal(lastUpdate) {
+		t.Errorf("got the last update %v, want %v", got, lastUpdate)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// objectStoresDirName is the directory of the object stores under
+// LocalDiskCacheRoot.
+const objectStoresDirName = ".objects"
+
+// objectStoreLocks maps the directory of a shared object store to the
+// *sync.Mutex that serializes the git commands writing to it.
+var objectStoreLocks sync.Map
+
+// objectStoreDir returns the directory of the object store shared by the
+// repositories in the ObjectStoreGroup of u, or "" if u is not in a group.
+func objectStoreDir(config *ServerConfig, u *url.URL) string {
+	if config.ObjectStoreGroup == nil {
+		return ""
+	}
+	group := config.ObjectStoreGroup(u)
+	if group == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(group))
+	return filepath.Join(config.LocalDiskCacheRoot, objectStoresDirName, hex.EncodeToString(h[:]))
+}
+
+func lockObjectStore(storeDir string) func() {
+	mu, _ := objectStoreLocks.LoadOrStore(storeDir, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// linkObjectStore makes the repository at dir borrow the objects of the shared
+// object store, creating the store if needed. git-fetch then downloads only
+// the objects that are not in the store.
+func linkObjectStore(config *ServerConfig, dir, storeDir string) error {
+	unlock := lockObjectStore(storeDir)
+	defer unlock()
+	if _, err := os.Stat(filepath.Join(storeDir, "objects")); os.IsNotExist(err) {
+		if err := mkdirAll(storeDir, config.CacheDirMode); err != nil {
+			return status.Errorf(codes.Internal, "cannot create a shared object store: %v", err)
+		}
+		args := []string{"init", "--bare", "-q"}
+		if config.CacheDirMode != 0 {
+			args = append(args, fmt.Sprintf("--shared=0%o", cacheFileMode(config)))
+		}
+		if err := runGit(config, noopOperation{}, storeDir, args...); err != nil {
+			return status.Errorf(codes.Internal, "cannot create a shared object store: %v", err)
+		}
+		// A repository can still borrow an object that's no longer
+		// reachable from the store's refs, so the store never drops one.
+		runGit(config, noopOperation{}, storeDir, "config", "gc.pruneExpire", "never")
+	}
+	objects, err := filepath.Abs(filepath.Join(storeDir, "objects"))
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot link the shared object store: %v", err)
+	}
+	if err := writeCacheFile(config, filepath.Join(dir, "objects", "info", "alternates"), []byte(objects+"\n")); err != nil {
+		return status.Errorf(codes.Internal, "cannot link the shared object store: %v", err)
+	}
+	return nil
+}
+
+// shareObjects copies the objects of the repository to its shared object
+// store, under the refs that keep them there, and drops the local copies. The
+// other repositories of the group can borrow them from then on.
+func (r *managedRepository) shareObjects(op RunningOperation, storeDir string) error {
+	// git runs in the store.
+	dir, err := filepath.Abs(r.localDiskPath)
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256([]byte(dir))
+	refspec := fmt.Sprintf("+refs/*:refs/repositories/%s/*", hex.EncodeToString(h[:]))
+
+	unlock := lockObjectStore(storeDir)
+	err = runGit(r.config, op, storeDir, "fetch", "-q", "--prune", "--no-tags", dir, refspec)
+	if err == nil {
+		// The local copies are dropped only if the store has the objects
+		// in a pack.
+		err = runGit(r.config, op, storeDir, "repack", "-d", "-q")
+	}
+	if err == nil {
+		err = runGit(r.config, op, storeDir, "gc", "--auto", "--quiet")
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+	// -l packs only the objects that are not in the store.
+	return runGit(r.config, op, r.localDiskPath, "repack", "-a", "-d", "-l")
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request that ctx belongs to. Every request
+// to HTTPHandler has one, and an operation started without a request has its
+// own. It's empty for other contexts.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// LongRunningOperation is the machine-readable record of a RunningOperation.
+// One is made when the operation starts, one for each progress message, and
+// one when it's done with the duration and the error.
+type LongRunningOperation struct {
+	Action          string `json:"action"`
+	URL             string `json:"url"`
+	RequestID       string `json:"request_id,omitempty"`
+	DurationMs      int    `json:"duration_msec,omitempty"`
+	Error           string `json:"error,omitempty"`
+	ProgressMessage string `json:"progress_message,omitempty"`
+	// Done is set in the last record of the operation.
+	Done bool `json:"done,omitempty"`
+}
+
+// NewJSONOperationLogger returns a LongRunningOperationLogger that writes the
+// LongRunningOperation records to w as JSON lines.
+func NewJSONOperationLogger(w io.Writer) func(context.Context, string, *url.URL) RunningOperation {
+	mu := &sync.Mutex{}
+	enc := json.NewEncoder(w)
+	return func(ctx context.Context, action string, u *url.URL) RunningOperation {
+		op := &jsonOperation{
+			mu:        mu,
+			enc:       enc,
+			action:    action,
+			u:         u.String(),
+			requestID: RequestID(ctx),
+			startTime: time.Now(),
+		}
+		op.write(&LongRunningOperation{Action: action, URL: op.u, RequestID: op.requestID})
+		return op
+	}
+}
+
+type jsonOperation struct {
+	// mu serializes the writes of all the operations to enc.
+	mu        *sync.Mutex
+	enc       *json.Encoder
+	action    string
+	u         string
+	requestID string
+	startTime time.Time
+}
+
+func (op *jsonOperation) write(lro *LongRunningOperation) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.enc.Encode(lro)
+}
+
+func (op *jsonOperation) Printf(format string, a ...interface{}) {
+	op.write(&LongRunningOperation{
+		Action:          op.action,
+		URL:             op.u,
+		RequestID:       op.requestID,
+		ProgressMessage: fmt.Sprintf(format, a...),
+	})
+}
+
+func (op *jsonOperation) Done(err error) {
+	lro := &LongRunningOperation{
+		Action:     op.action,
+		URL:        op.u,
+		RequestID:  op.requestID,
+		DurationMs: int(time.Since(op.startTime) / time.Millisecond),
+		Done:       true,
+	}
+	if err != nil {
+		lro.Error = err.Error()
+	}
+	op.write(lro)
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewJSONOperationLogger_FailedFetch(t *testing.T) {
+	u := &url.URL{Scheme: "file", Path: filepath.Join(newTempDir(t), "missing")}
+	config := newTestConfig(t)
+	var buf bytes.Buffer
+	config.LongRunningOperationLogger = NewJSONOperationLogger(&buf)
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err == nil {
+		t.Fatal("fetchUpstream succeeded for a missing upstream")
+	}
+
+	var last LongRunningOperation
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		last = LongRunningOperation{}
+		if err := dec.Decode(&last); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if last.Action != "FetchUpstream" || last.URL != u.String() || !last.Done {
+		t.Errorf("got the last record %+v, want the end of FetchUpstream for %s", last, u)
+	}
+	if last.Error == "" {
+		t.Error("got no error in the last record")
+	}
+}
+
+func TestNewJSONOperationLogger_RequestID(t *testing.T) {
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	var buf bytes.Buffer
+	config.LongRunningOperationLogger = NewJSONOperationLogger(&buf)
+	defer clearManagedRepositories()
+
+	// The cache is empty, and the fetch command fetches from the upstream.
+	body := pktLine("command=fetch\n") + "0001" + pktLine("want "+want+"\n") + pktLine("done\n") + "0000"
+	req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(body))
+	req.Header.Set("Git-Protocol", "version=2")
+	rec := httptest.NewRecorder()
+	HTTPHandler(config).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	var records []LongRunningOperation
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var lro LongRunningOperation
+		if err := dec.Decode(&lro); err != nil {
+			t.Fatal(err)
+		}
+		if lro.Action == "FetchUpstream" {
+			records = append(records, lro)
+		}
+	}
+	if len(records) < 2 || !records[len(records)-1].Done {
+		t.Fatalf("got the records %+v, want a whole FetchUpstream operation", records)
+	}
+	id := records[0].RequestID
+	if id == "" {
+		t.Fatal("got no request ID")
+	}
+	for _, lro := range records {
+		if lro.RequestID != id {
+			t.Errorf("got the request ID %q in %+v, want %q", lro.RequestID, lro, id)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// rateLimiterPruneInterval is how often idle clients are forgotten.
+	rateLimiterPruneInterval = time.Minute
+)
+
+// RateLimit is a token bucket applied to each client's fetch requests.
+type RateLimit struct {
+	// RequestsPerSecond is how fast a client's bucket is refilled.
+	RequestsPerSecond float64
+
+	// Burst is the size of a client's bucket.
+	Burst int
+
+	// KeyByBasicAuthUser makes the clients that send Basic authentication
+	// identified by the user name instead of the IP address.
+	KeyByBasicAuthUser bool
+}
+
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter holds a token bucket per client. A nil *rateLimiter allows
+// everything.
+type rateLimiter struct {
+	config *RateLimit
+
+	mu        sync.Mutex
+	clients   map[string]*rateLimiterEntry
+	lastPrune time.Time
+}
+
+func newRateLimiter(config *RateLimit) *rateLimiter {
+	if config == nil {
+		return nil
+	}
+	return &rateLimiter{
+		config:    config,
+		clients:   map[string]*rateLimiterEntry{},
+		lastPrune: time.Now(),
+	}
+}
+
+// allow takes a token from the client's bucket. It returns false if the
+// bucket is empty.
+func (l *rateLimiter) allow(r *http.Request) bool {
+	if l == nil {
+		return true
+	}
+	key := l.clientKey(r)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPrune) > rateLimiterPruneInterval {
+		l.prune(now)
+	}
+	e, ok := l.clients[key]
+	if !ok {
+		e = &rateLimiterEntry{limiter: rate.NewLimiter(rate.Limit(l.config.RequestsPerSecond), l.config.Burst)}
+		l.clients[key] = e
+	}
+	e.lastSeen = now
+	return e.limiter.AllowN(now, 1)
+}
+
+// prune forgets the clients whose bucket is refilled. They would get a new
+// full bucket anyway.
+func (l *rateLimiter) prune(now time.Time) {
+	refill := rateLimiterPruneInterval
+	if l.config.RequestsPerSecond > 0 {
+		refill = time.Duration(float64(l.config.Burst) / l.config.RequestsPerSecond * float64(time.Second))
+	}
+	for key, e := range l.clients {
+		if now.Sub(e.lastSeen) > refill {
+			delete(l.clients, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+func (l *rateLimiter) clientKey(r *http.Request) string {
+	if l.config.KeyByBasicAuthUser {
+		if user, _, ok := r.BasicAuth(); ok && user != "" {
+			return "user:" + user
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
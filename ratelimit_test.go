@@ -0,0 +1,82 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimit_ThrottlesAndRecovers(t *testing.T) {
+	u := newTestUpstream(t)
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.RateLimit = &RateLimit{RequestsPerSecond: 10, Burst: 2}
+	defer clearManagedRepositories()
+	h := HTTPHandler(config)
+
+	throttled := func(remoteAddr string) bool {
+		t.Helper()
+		// An empty request that is served without the upstream.
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader("0000"))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Git-Protocol", "version=2")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+		}
+		return strings.Contains(rec.Body.String(), "ERR ")
+	}
+
+	for i := 0; i < 2; i++ {
+		if throttled("192.0.2.1:1234") {
+			t.Fatalf("request %d is throttled within the burst", i)
+		}
+	}
+	if !throttled("192.0.2.1:1235") {
+		t.Error("request beyond the burst is not throttled")
+	}
+	if throttled("192.0.2.2:1234") {
+		t.Error("another client is throttled")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if throttled("192.0.2.1:1234") {
+		t.Error("request after the refill is throttled")
+	}
+}
+
+func TestRateLimit_KeyByBasicAuthUser(t *testing.T) {
+	l := newRateLimiter(&RateLimit{RequestsPerSecond: 1, Burst: 1, KeyByBasicAuthUser: true})
+	newRequest := func(user string) *http.Request {
+		req := httptest.NewRequest("POST", "/repo/git-upload-pack", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.SetBasicAuth(user, "password")
+		return req
+	}
+	if !l.allow(newRequest("alice")) {
+		t.Error("first request of alice is throttled")
+	}
+	if l.allow(newRequest("alice")) {
+		t.Error("second request of alice is not throttled")
+	}
+	if !l.allow(newRequest("bob")) {
+		t.Error("bob from the same IP is throttled")
+	}
+}
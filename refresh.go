@@ -0,0 +1,98 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// RunRefreshProcess starts a background process that fetches the cached
+// repositories that haven't been updated for config.CacheTTL, and the
+// repositories whose config.PinnedRefs are behind the upstream. This makes the
+// next client request less likely to wait for the upstream.
+func RunRefreshProcess(config *ServerConfig) {
+	if (config.CacheTTL <= 0 && len(config.PinnedRefs) == 0) || config.RefreshInterval <= 0 {
+		return
+	}
+	go func() {
+		timer := time.NewTimer(config.RefreshInterval)
+		for {
+			<-timer.C
+			refreshPinnedRepositories(config)
+			if config.CacheTTL > 0 {
+				refreshStaleRepositories(config)
+			}
+			timer.Reset(config.RefreshInterval)
+		}
+	}()
+}
+
+func refreshPinnedRepositories(config *ServerConfig) {
+	for rawURL, refs := range config.PinnedRefs {
+		if err := refreshPinnedRefs(config, rawURL, refs); err != nil {
+			Logf(config, LogLevelError, "Cannot refresh the pinned refs of %s: %v", rawURL, err)
+		}
+	}
+}
+
+// refreshPinnedRefs fetches the repository if one of the refs is behind the
+// upstream. The repository is opened if it's not cached yet.
+func refreshPinnedRefs(config *ServerConfig, rawURL string, refs []string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		return err
+	}
+	if m.isFetching() {
+		return nil
+	}
+	ctx := context.Background()
+	upstream, err := m.upstreamRefs(ctx, refs)
+	if err != nil {
+		return err
+	}
+	if hasUpdate, err := m.hasAnyUpdate(upstream); err != nil || !hasUpdate {
+		return err
+	}
+	return m.fetchUpstream(ctx)
+}
+
+// isPinned returns true if the repository has PinnedRefs.
+func (r *managedRepository) isPinned() bool {
+	_, ok := r.config.PinnedRefs[r.upstreamURL.String()]
+	return ok
+}
+
+func refreshStaleRepositories(config *ServerConfig) {
+	threshold := time.Now().Add(-config.CacheTTL)
+	managedRepos.Range(func(key, value interface{}) bool {
+		m := value.(*managedRepository)
+		if m.config != config {
+			return true
+		}
+		// Do not queue up behind a fetch that is already running. It
+		// will update the repository anyway.
+		if m.isFetching() || m.LastUpdateTime().After(threshold) {
+			return true
+		}
+		m.fetchUpstream(context.Background())
+		return true
+	})
+}
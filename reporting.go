@@ -17,7 +17,7 @@ package goblet
 import (
 	"context"
 	"io"
-	"log"
+	"math/rand"
 	"net/http"
 	"time"
 
@@ -61,27 +61,32 @@ func (h *httpErrorReporter) reportError(err error) {
 		h.w.Header().Add("WWW-Authenticate", "Bearer")
 		h.w.Header().Add("WWW-Authenticate", "Basic realm=goblet")
 	}
+	setFailed(h.w)
 	httpStatus := runtime.HTTPStatusFromCode(code)
 	if message == "" {
 		message = http.StatusText(httpStatus)
 	}
 	http.Error(h.w, message, httpStatus)
 
-	if !serverErrorCodes[code] {
-		return
-	}
-
+	// ErrorReporter receives all errors, including client errors, so that
+	// it can decide what to report. Without it, only server errors are
+	// logged.
 	if h.config.ErrorReporter != nil {
 		h.config.ErrorReporter(h.req, err)
 		return
 	}
-	log.Printf("Error while processing a request: %v", err)
+	if serverErrorCodes[code] {
+		Logf(h.config, LogLevelError, "Error while processing a request: %v", err)
+	}
 }
 
 type gitProtocolHTTPErrorReporter struct {
 	config *ServerConfig
 	req    *http.Request
-	w      http.ResponseWriter
+	w      io.Writer
+	// resp is the response that w writes to. If set, an upstream HTTP
+	// status is passed through when nothing is written yet.
+	resp http.ResponseWriter
 }
 
 func (h *gitProtocolHTTPErrorReporter) reportError(ctx context.Context, startTime time.Time, err error) {
@@ -96,25 +101,77 @@ func (h *gitProtocolHTTPErrorReporter) reportError(ctx context.Context, startTim
 		InboundCommandProcessingTime.M(int64(time.Now().Sub(startTime)/time.Millisecond)),
 	)
 
-	if err != nil {
-		writeError(h.w, err)
-	}
-
-	if !serverErrorCodes[code] {
+	if err == nil {
 		return
 	}
+	if h.resp != nil {
+		setFailed(h.resp)
+	} else {
+		setFailed(h.w)
+	}
+	if ue, ok := err.(*upstreamError); ok {
+		if mw, ok := h.resp.(*monitoringWriter); ok && mw.status == 0 {
+			mw.WriteHeader(ue.code)
+		}
+	}
+	writeError(h.w, err)
 
 	if h.config.ErrorReporter != nil {
 		h.config.ErrorReporter(h.req.WithContext(ctx), err)
 		return
 	}
-	log.Printf("Error while processing a request: %v", err)
+	if serverErrorCodes[code] {
+		Logf(h.config, LogLevelError, "Error while processing a request: %v", err)
+	}
+}
+
+// CacheOutcome tells how the fetches of a request are served. See
+// RequestInfo.
+type CacheOutcome string
+
+const (
+	// CacheHit is a fetch served from the cache without the upstream.
+	CacheHit CacheOutcome = "hit"
+	// CacheMiss is a fetch that waited for an upstream fetch.
+	CacheMiss CacheOutcome = "miss"
+	// CacheBypass is a fetch forwarded to the upstream, such as for the
+	// refs outside of MirrorRefspecs.
+	CacheBypass CacheOutcome = "bypass"
+)
+
+// RequestInfo is passed to RequestLogger with what the request did on the
+// server.
+type RequestInfo struct {
+	// CacheOutcome is empty if the request has no fetch command. If a
+	// request has more than one, a miss takes precedence.
+	CacheOutcome CacheOutcome
+	// FetchWait is how long the request waited for the upstream fetch.
+	FetchWait time.Duration
+}
+
+type requestInfoKey struct{}
+
+// recordCacheOutcome records the outcome of a fetch for the RequestLogger of
+// the request of ctx.
+func recordCacheOutcome(ctx context.Context, outcome CacheOutcome, fetchWait time.Duration) {
+	info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	if !ok {
+		return
+	}
+	if info.CacheOutcome != CacheMiss {
+		info.CacheOutcome = outcome
+	}
+	info.FetchWait += fetchWait
 }
 
-func logHTTPRequest(config *ServerConfig, w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+// logHTTPRequest wraps w to pass the request to RequestLogger when the returned
+// func is called. The returned request carries the RequestInfo.
+func logHTTPRequest(config *ServerConfig, w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
 	startTime := time.Now()
 	monR := &monitoringReader{r: r.Body}
 	r.Body = monR
+	info := &RequestInfo{}
+	r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
 
 	monW := &monitoringWriter{w: w}
 	if f, ok := w.(http.Flusher); ok {
@@ -123,13 +180,30 @@ func logHTTPRequest(config *ServerConfig, w http.ResponseWriter, r *http.Request
 		monW.flush = func() {}
 	}
 
-	return monW, func() {
+	return monW, r, func() {
 		if config.RequestLogger == nil {
 			return
 		}
+		// The errors are always logged.
+		if !monW.failed && monW.status < http.StatusBadRequest && !isSampled(config.RequestLogSampleRate) {
+			return
+		}
 		endTime := time.Now()
 
-		config.RequestLogger(r, monW.status, monR.bytesRead, monW.bytesWritten, endTime.Sub(startTime))
+		config.RequestLogger(r, monW.status, monR.bytesRead, monW.bytesWritten, endTime.Sub(startTime), *info)
+	}
+}
+
+// isSampled returns true for the rate of the calls. Zero is the same as 1.
+func isSampled(rate float64) bool {
+	return rate <= 0 || rate >= 1 || rand.Float64() < rate
+}
+
+// setFailed marks the request as failed if w is the monitoringWriter of the
+// request log.
+func setFailed(w io.Writer) {
+	if mw, ok := w.(*monitoringWriter); ok {
+		mw.failed = true
 	}
 }
 
@@ -145,7 +219,7 @@ func (r *monitoringReader) Read(p []byte) (int, error) {
 }
 
 func (r *monitoringReader) Close() error {
-	return r.Close()
+	return r.r.Close()
 }
 
 type monitoringWriter struct {
@@ -153,6 +227,9 @@ type monitoringWriter struct {
 	w            http.ResponseWriter
 	flush        func()
 	bytesWritten int64
+	// failed is set when an error is returned, which can be in an ERR
+	// packet with 200 OK.
+	failed bool
 }
 
 func (w *monitoringWriter) Flush() {
@@ -0,0 +1,58 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+// RunSeedProcess starts a background process that fetches
+// config.SeedRepositories, so that their first clients don't wait for the
+// initial clone. The repositories are fetched concurrently within
+// config.MaxConcurrentFetches. A failure is logged and doesn't stop the others.
+func RunSeedProcess(config *ServerConfig) {
+	if len(config.SeedRepositories) == 0 {
+		return
+	}
+	go seedRepositories(config)
+}
+
+func seedRepositories(config *ServerConfig) {
+	var wg sync.WaitGroup
+	for _, s := range config.SeedRepositories {
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+			if err := seedRepository(config, s); err != nil {
+				Logf(config, LogLevelError, "Cannot seed %s: %v", s, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+func seedRepository(config *ServerConfig, s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		return err
+	}
+	return m.fetchUpstream(context.Background())
+}
@@ -0,0 +1,40 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSeedRepositories(t *testing.T) {
+	u := newTestUpstream(t)
+	want := strings.TrimSpace(runTestGit(t, u.Path, "rev-parse", "master"))
+	config := newTestConfig(t)
+	config.MaxConcurrentFetches = 1
+	// The broken URL doesn't stop the other seed.
+	config.SeedRepositories = []string{"%zz", u.String()}
+	defer clearManagedRepositories()
+
+	seedRepositories(config)
+
+	localDiskPath, err := getLocalDiskPath(config, u, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(runTestGit(t, localDiskPath, "rev-parse", "refs/heads/master")); got != want {
+		t.Errorf("got master %s in the cache, want %s", got, want)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StorageBackend manages the directories of the cached repositories. Git runs
+// in these directories, so they must be on a local file system, but a backend
+// can, for example, hydrate them from a shared cache on a new node.
+type StorageBackend interface {
+	// Path returns the directory of the repository for a canonical
+	// upstream URL. If the repository is cached in a realm (see
+	// ServerConfig.CacheRealm), the user name of the URL is the realm, and
+	// the directory must be different from the other realms.
+	Path(*url.URL) (string, error)
+
+	// Create creates an empty directory for a new repository.
+	Create(path string) error
+
+	// Open prepares the directory of a repository that's been cached
+	// before. It returns false if the repository doesn't exist. This is
+	// called every time the repository is opened.
+	Open(path string) (bool, error)
+
+	// Delete removes the directory of a repository.
+	Delete(path string) error
+}
+
+// localDiskBackend keeps the repositories under LocalDiskCacheRoot. This is
+// the default StorageBackend.
+type localDiskBackend struct {
+	root string
+	mode os.FileMode
+	// hasher replaces the path of the URL if not nil. See
+	// ServerConfig.CachePathHasher.
+	hasher func(string) string
+}
+
+// Path returns the directory under the host's directory. The host's directory
+// of a realm is "realm@host". It rejects the URLs that would resolve outside of
+// it, such as the ones with "..".
+func (b localDiskBackend) Path(u *url.URL) (string, error) {
+	root := filepath.Clean(b.root)
+	hostDir := filepath.Join(root, realmPrefix(u)+hostDirName(u))
+	p := u.Path
+	if b.hasher != nil {
+		p = b.hasher(path.Clean("/" + p))
+		if p == "" {
+			return "", status.Errorf(codes.Internal, "empty cache path for %s", u)
+		}
+	}
+	localDiskPath := filepath.Join(hostDir, p)
+	if localDiskPath == root || !isSubpath(root, localDiskPath) || !isSubpath(hostDir, localDiskPath) {
+		return "", status.Errorf(codes.InvalidArgument, "invalid repository path: %s", u)
+	}
+	return localDiskPath, nil
+}
+
+// realmPrefix returns the prefix of the host's directory for the realm of u,
+// which is empty for the default realm.
+func realmPrefix(u *url.URL) string {
+	if u.User == nil {
+		return ""
+	}
+	return url.PathEscape(u.User.Username()) + "@"
+}
+
+// legacyPath returns the directory of an older version, which used the host
+// as is, or an empty string if there's none.
+func (b localDiskBackend) legacyPath(u *url.URL) string {
+	if b.hasher != nil {
+		// The hashed paths are newer than the host escaping.
+		return ""
+	}
+	root := filepath.Clean(b.root)
+	hostDir := filepath.Join(root, realmPrefix(u)+u.Host)
+	legacy := filepath.Join(hostDir, u.Path)
+	if legacy == root || !isSubpath(root, legacy) || !isSubpath(hostDir, legacy) {
+		return ""
+	}
+	return legacy
+}
+
+func (b localDiskBackend) Create(path string) error {
+	return mkdirAll(path, b.mode)
+}
+
+func (b localDiskBackend) Open(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (b localDiskBackend) Delete(path string) error {
+	return os.RemoveAll(path)
+}
+
+// hostDirName returns the name of the directory for the host and the port of
+// u. The colons and the brackets are not allowed or awkward on some
+// filesystems, so they are percent-encoded along with "%" itself: "[::1]:8443"
+// is "%5B%3A%3A1%5D%3A8443" and "git.example.com:8443" is
+// "git.example.com%3A8443". Older versions used the host as is, and their
+// directories are moved when the repositories are opened. See
+// migrateLegacyDir.
+func hostDirName(u *url.URL) string {
+	return hostDirReplacer.Replace(u.Host)
+}
+
+var hostDirReplacer = strings.NewReplacer("%", "%25", ":", "%3A", "[", "%5B", "]", "%5D")
+
+// migrateLegacyDir moves the repository directory of an older version, named
+// with the host as is, to dir, the directory of key under the default
+// StorageBackend. It does nothing if the names are the same or if dir already
+// exists. If the move fails, the repository is fetched again. This is called
+// while the repository is initialized, before it's opened.
+func migrateLegacyDir(config *ServerConfig, key *url.URL, dir string) {
+	b, ok := storageBackend(config).(localDiskBackend)
+	if !ok {
+		return
+	}
+	legacy := b.legacyPath(key)
+	if legacy == "" || legacy == dir {
+		return
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		return
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return
+	}
+	if err := mkdirAll(filepath.Dir(dir), b.mode); err != nil {
+		return
+	}
+	os.Rename(legacy, dir)
+}
+
+// HashCachePath is a ServerConfig.CachePathHasher that returns the hex SHA-256
+// of the path, so every repository directory is 64 characters long.
+func HashCachePath(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	return hex.EncodeToString(sum[:])
+}
+
+// isSubpath returns true if child is parent or under parent. Both must be
+// clean.
+func isSubpath(parent, child string) bool {
+	rel, err := filepath.Rel(parent, child)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func storageBackend(config *ServerConfig) StorageBackend {
+	if config.StorageBackend != nil {
+		return config.StorageBackend
+	}
+	return localDiskBackend{config.LocalDiskCacheRoot, config.CacheDirMode, config.CachePathHasher}
+}
+
+// mkdirAll creates dir and its missing parents with mode. If mode is zero,
+// they are 0750 with the umask applied.
+func mkdirAll(dir string, mode os.FileMode) error {
+	if mode == 0 {
+		return os.MkdirAll(dir, 0750)
+	}
+	missing := []string{}
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	for _, d := range missing {
+		if err := os.Chmod(d, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheFileMode returns the permission of the files created in the cache.
+func cacheFileMode(config *ServerConfig) os.FileMode {
+	if config.CacheDirMode == 0 {
+		return 0640
+	}
+	return config.CacheDirMode &^ 0111
+}
+
+// writeCacheFile writes a file in the cache with cacheFileMode.
+func writeCacheFile(config *ServerConfig, path string, data []byte) error {
+	if err := ioutil.WriteFile(path, data, cacheFileMode(config)); err != nil {
+		return err
+	}
+	if config.CacheDirMode == 0 {
+		return nil
+	}
+	return os.Chmod(path, cacheFileMode(config))
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeStorageBackend keeps the repository directories in a map, and records
+// the calls.
+type fakeStorageBackend struct {
+	root string
+
+	mu    sync.Mutex
+	dirs  map[string]string
+	calls []string
+}
+
+func (b *fakeStorageBackend) Path(u *url.URL) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if dir, ok := b.dirs[u.String()]; ok {
+		return dir, nil
+	}
+	dir := filepath.Join(b.root, fmt.Sprintf("repo%d", len(b.dirs)))
+	b.dirs[u.String()] = dir
+	return dir, nil
+}
+
+func (b *fakeStorageBackend) Create(path string) error {
+	b.record("Create", path)
+	return os.Mkdir(path, 0750)
+}
+
+func (b *fakeStorageBackend) Open(path string) (bool, error) {
+	b.record("Open", path)
+	_, err := os.Stat(path)
+	return err == nil, nil
+}
+
+func (b *fakeStorageBackend) Delete(path string) error {
+	b.record("Delete", path)
+	return os.RemoveAll(path)
+}
+
+func (b *fakeStorageBackend) record(method, path string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, method+" "+path)
+}
+
+func TestStorageBackend(t *testing.T) {
+	u := newTestUpstream(t)
+	backend := &fakeStorageBackend{root: newTempDir(t), dirs: map[string]string{}}
+	config := newTestConfig(t)
+	config.StorageBackend = backend
+	defer clearManagedRepositories()
+
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(backend.root, "repo0")
+	if m.localDiskPath != dir {
+		t.Errorf("got the repository at %s, want %s", m.localDiskPath, dir)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, dir, "rev-parse", "master")
+
+	clearManagedRepositories()
+	if m, err = lookupManagedRepository(config, u); err != nil {
+		t.Fatal(err)
+	} else if m == nil {
+		t.Fatal("the repository is not found after a restart")
+	}
+	if evicted, err := m.evict(); err != nil || !evicted {
+		t.Fatalf("evict() = %v, %v", evicted, err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("the repository dir is not deleted: %v", err)
+	}
+
+	want := []string{
+		"Open " + dir,
+		"Create " + dir,
+		"Open " + dir,
+		"Open " + dir,
+		"Delete " + dir,
+	}
+	if !reflect.DeepEqual(backend.calls, want) {
+		t.Errorf("got calls %q, want %q", backend.calls, want)
+	}
+}
+
+func TestCacheDirMode(t *testing.T) {
+	u := newTestUpstream(t)
+	config := newTestConfig(t)
+	// Group-writable, which the usual umask would clear.
+	config.CacheDirMode = 0770
+	defer clearManagedRepositories()
+	m, err := openManagedRepository(config, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]os.FileMode{
+		filepath.Dir(m.localDiskPath):                      0770,
+		m.localDiskPath:                                    0770,
+		filepath.Join(m.localDiskPath, "refs"):             0770,
+		filepath.Join(m.localDiskPath, lastUpdateFileName): 0660,
+		filepath.Join(m.localDiskPath, "config"):           0660,
+	} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != want {
+			t.Errorf("got mode %v for %s, want %v", got, path, want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestRequestAuthorizer_RejectsHost(t *testing.T) {
+	var deniedHost string
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: func(r *http.Request) error {
+			if r.Host == deniedHost {
+				return errors.New("host is not allowed")
+			}
+			return goblettest.TestRequestAuthorizer(r)
+		},
+		TokenSource: goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+	u, err := url.Parse(ts.ProxyServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deniedHost = u.Host
+
+	req, err := http.NewRequest("GET", ts.ProxyServerURL+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestRequestAuthorizer_RejectsCachedRepository(t *testing.T) {
+	const unauthorizedToken = "unauthorized-client-token"
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: func(r *http.Request) error {
+			if r.Header.Get("Authorization") == "Bearer "+unauthorizedToken && strings.HasSuffix(r.URL.Path, "/git-upload-pack") {
+				return errors.New("no access to the repository")
+			}
+			return nil
+		},
+		TokenSource: goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cache the repository with an authorized credential.
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	want = strings.TrimSpace(want)
+	body := "0012command=fetch\n0001" + fmt.Sprintf("%04xwant %s\n", len(want)+10, want) + "0009done\n0000"
+	req, err := http.NewRequest("POST", ts.ProxyServerURL+"/git-upload-pack", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+unauthorizedToken)
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestClone(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "clone", ts.ProxyServerURL, "cloned"); err != nil {
+		t.Fatal(err)
+	}
+
+	cloned := goblettest.GitRepo(filepath.Join(string(client), "cloned"))
+	if got, err := cloned.Run("rev-parse", "HEAD"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if _, err := cloned.Run("fsck"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClone_EmptyUpstream(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "clone", ts.ProxyServerURL, "cloned"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first commit is fetched once the upstream has one.
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloned := goblettest.GitRepo(filepath.Join(string(client), "cloned"))
+	if _, err := cloned.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", "origin"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cloned.Run("rev-parse", "origin/master"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestClone_BundleURI(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		EnableBundleURI:   true,
+	})
+	defer ts.Close()
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	// Caches the repository.
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "clone", ts.ProxyServerURL, "warm"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The commit after the bundle is fetched incrementally.
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "clone", "--bundle-uri="+ts.ProxyServerURL+"/goblet-bundle", ts.ProxyServerURL, "cloned"); err != nil {
+		t.Fatal(err)
+	}
+	cloned := goblettest.GitRepo(filepath.Join(string(client), "cloned"))
+	if got, err := cloned.Run("rev-parse", "HEAD"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if _, err := cloned.Run("fsck"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClone_Shallow(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	pushClient := goblettest.NewLocalGitRepo()
+	defer pushClient.Close()
+	var want string
+	for i := 0; i < 3; i++ {
+		var err error
+		if want, err = pushClient.CreateRandomCommit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pushClient.Run("push", "-f", string(ts.UpstreamGitRepo), "master:master"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "clone", "--depth=1", ts.ProxyServerURL, "cloned"); err != nil {
+		t.Fatal(err)
+	}
+
+	cloned := goblettest.GitRepo(filepath.Join(string(client), "cloned"))
+	if got, err := cloned.Run("rev-parse", "HEAD"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, err := cloned.Run("rev-list", "--count", "HEAD"); err != nil {
+		t.Error(err)
+	} else if strings.TrimSpace(got) != "1" {
+		t.Errorf("got %s commits, want 1", got)
+	}
+
+	// Deepen the clone by one commit.
+	if _, err := cloned.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", "--deepen=1", "origin"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cloned.Run("rev-list", "--count", "HEAD"); err != nil {
+		t.Error(err)
+	} else if strings.TrimSpace(got) != "2" {
+		t.Errorf("got %s commits after deepening, want 2", got)
+	}
+	if _, err := cloned.Run("fsck"); err != nil {
+		t.Error(err)
+	}
+}
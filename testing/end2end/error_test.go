@@ -0,0 +1,64 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorReporter_ParseError(t *testing.T) {
+	var mu sync.Mutex
+	var reported []error
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		ErrorReporter: func(r *http.Request, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported = append(reported, err)
+		},
+	})
+	defer ts.Close()
+
+	// A pkt-line with an invalid length.
+	req, err := http.NewRequest("POST", ts.ProxyServerURL+"/git-upload-pack", strings.NewReader("zzzzcommand=fetch\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	req.Header.Set("Git-Protocol", "version=2")
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reported) != 1 {
+		t.Fatalf("got %d reported errors, want 1: %v", len(reported), reported)
+	}
+	if st, _ := status.FromError(reported[0]); st.Code() != codes.InvalidArgument || !strings.Contains(st.Message(), "cannot parse the request") {
+		t.Errorf("got %v, want an InvalidArgument parse error", reported[0])
+	}
+}
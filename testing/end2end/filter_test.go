@@ -0,0 +1,65 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestFetch_BlobNoneFilter(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	pushClient := goblettest.NewLocalGitRepo()
+	defer pushClient.Close()
+	if err := ioutil.WriteFile(filepath.Join(string(pushClient), "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pushClient.Run("add", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pushClient.CreateRandomCommit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pushClient.Run("push", "-f", string(ts.UpstreamGitRepo), "master:master"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "clone", "--bare", "--filter=blob:none", ts.ProxyServerURL, "cloned"); err != nil {
+		t.Fatal(err)
+	}
+
+	cloned := goblettest.GitRepo(filepath.Join(string(client), "cloned"))
+	objects, err := cloned.Run("cat-file", "--batch-all-objects", "--batch-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(objects, " commit ") {
+		t.Errorf("got objects %q, want a commit", objects)
+	}
+	if strings.Contains(objects, " blob ") {
+		t.Errorf("got objects %q, want no blobs", objects)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestMetrics_CacheHitPerHost(t *testing.T) {
+	v := &view.View{
+		Name:        "test_cache_hits_total",
+		TagKeys:     []tag.Key{goblet.UpstreamHostKey},
+		Measure:     goblet.CacheHitCount,
+		Aggregation: view.Count(),
+	}
+	if err := view.Register(v); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(v)
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first fetch populates the cache and the second fetch is served
+	// from it.
+	for i := 0; i < 2; i++ {
+		client := goblettest.NewLocalGitRepo()
+		defer client.Close()
+		if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := view.RetrieveData(v.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		for _, tg := range row.Tags {
+			if tg.Key == goblet.UpstreamHostKey && tg.Value == u.Host {
+				if c := row.Data.(*view.CountData).Value; c < 1 {
+					t.Errorf("got %d cache hits, want at least 1", c)
+				}
+				return
+			}
+		}
+	}
+	t.Errorf("no cache hit recorded for %s: %v", u.Host, rows)
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestPush_AllowPush(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		TokenSource: goblettest.TestTokenSource,
+		AllowPush:   true,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The push is forwarded with the client's credential, and the upstream
+	// accepts only the server token.
+	tok, err := goblettest.TestTokenSource.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authHeader := "http.extraHeader=Authorization: Bearer " + tok.AccessToken
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	want, err := client.CreateRandomCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("-c", authHeader, "push", ts.ProxyServerURL, "master:refs/heads/pushed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := ts.UpstreamGitRepo.Run("rev-parse", "refs/heads/pushed"); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("got %s in the upstream, want %s", got, want)
+	}
+
+	fetcher := goblettest.NewLocalGitRepo()
+	defer fetcher.Close()
+	if _, err := fetcher.Run("-c", authHeader, "fetch", ts.ProxyServerURL, "refs/heads/pushed"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fetcher.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("got %s through the proxy, want %s", got, want)
+	}
+}
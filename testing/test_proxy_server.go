@@ -64,7 +64,12 @@ type TestServerConfig struct {
 	RequestAuthorizer func(r *http.Request) error
 	TokenSource       oauth2.TokenSource
 	ErrorReporter     func(*http.Request, error)
-	RequestLogger     func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration)
+	RequestLogger     func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration, info goblet.RequestInfo)
+
+	ProtocolV1Fallback bool
+	AllowPush          bool
+	// EnableBundleURI sets BundleURIBase to the proxy server URL.
+	EnableBundleURI bool
 }
 
 func NewTestServer(config *TestServerConfig) *TestServer {
@@ -73,6 +78,7 @@ func NewTestServer(config *TestServerConfig) *TestServer {
 		s.UpstreamGitRepo = NewLocalBareGitRepo()
 		s.UpstreamGitRepo.Run("config", "http.receivepack", "1")
 		s.UpstreamGitRepo.Run("config", "uploadpack.allowfilter", "1")
+		s.UpstreamGitRepo.Run("config", "uploadpack.allowrefinwant", "1")
 		s.UpstreamGitRepo.Run("config", "receive.advertisepushoptions", "1")
 
 		s.upstreamServer = httptest.NewServer(http.HandlerFunc(s.upstreamServerHandler))
@@ -84,6 +90,7 @@ func NewTestServer(config *TestServerConfig) *TestServer {
 		if err != nil {
 			log.Fatal(err)
 		}
+		enableBundleURI := config.EnableBundleURI
 		config := &goblet.ServerConfig{
 			LocalDiskCacheRoot: dir,
 			URLCanonializer:    s.testURLCanonicalizer,
@@ -91,9 +98,15 @@ func NewTestServer(config *TestServerConfig) *TestServer {
 			TokenSource:        config.TokenSource,
 			ErrorReporter:      config.ErrorReporter,
 			RequestLogger:      config.RequestLogger,
+			ProtocolV1Fallback: config.ProtocolV1Fallback,
+			AllowPush:          config.AllowPush,
+		}
+		s.proxyServer = httptest.NewUnstartedServer(goblet.HTTPHandler(config))
+		s.ProxyServerURL = "http://" + s.proxyServer.Listener.Addr().String()
+		if enableBundleURI {
+			config.BundleURIBase = s.ProxyServerURL
 		}
-		s.proxyServer = httptest.NewServer(goblet.HTTPHandler(config))
-		s.ProxyServerURL = s.proxyServer.URL
+		s.proxyServer.Start()
 	}
 	return s
 }
@@ -0,0 +1,67 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"net/http"
+
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/status"
+)
+
+// traceFormat propagates the trace context in the W3C Trace Context headers,
+// which OpenTelemetry uses by default.
+var traceFormat = &tracecontext.HTTPFormat{}
+
+func tracer(config *ServerConfig) trace.Tracer {
+	if config.Tracer != nil {
+		return config.Tracer
+	}
+	return trace.DefaultTracer
+}
+
+// startRequestSpan starts a span for an incoming request. The span is a child
+// of the client's span if the request carries its trace context.
+func startRequestSpan(config *ServerConfig, r *http.Request, name string) (context.Context, *trace.Span) {
+	t := tracer(config)
+	if sc, ok := traceFormat.SpanContextFromRequest(r); ok {
+		return t.StartSpanWithRemoteParent(r.Context(), name, sc, trace.WithSpanKind(trace.SpanKindServer))
+	}
+	return t.StartSpan(r.Context(), name, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// injectSpan adds the trace context of ctx to an outgoing request.
+func injectSpan(config *ServerConfig, ctx context.Context, req *http.Request) {
+	if span := tracer(config).FromContext(ctx); span != nil {
+		traceFormat.SpanContextToRequest(span.SpanContext(), req)
+	}
+}
+
+// detachSpan returns a context that carries the span of ctx but is never
+// canceled. This is for work that outlives the request, such as a fetch
+// shared with the other clients.
+func detachSpan(config *ServerConfig, ctx context.Context) context.Context {
+	t := tracer(config)
+	return withRequestID(t.NewContext(context.Background(), t.FromContext(ctx)), RequestID(ctx))
+}
+
+func endSpan(span *trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(trace.Status{Code: int32(status.Code(err)), Message: err.Error()})
+	}
+	span.End()
+}
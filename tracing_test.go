@@ -0,0 +1,151 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// sampledTracer samples every span regardless of the sampling decision of the
+// parent.
+type sampledTracer struct {
+	trace.Tracer
+}
+
+func (t sampledTracer) StartSpan(ctx context.Context, name string, o ...trace.StartOption) (context.Context, *trace.Span) {
+	return t.Tracer.StartSpan(ctx, name, append(o, trace.WithSampler(trace.AlwaysSample()))...)
+}
+
+func (t sampledTracer) StartSpanWithRemoteParent(ctx context.Context, name string, parent trace.SpanContext, o ...trace.StartOption) (context.Context, *trace.Span) {
+	return t.Tracer.StartSpanWithRemoteParent(ctx, name, parent, append(o, trace.WithSampler(trace.AlwaysSample()))...)
+}
+
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (e *memoryExporter) ExportSpan(s *trace.SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+func (e *memoryExporter) spansOf(traceID trace.TraceID) map[string]*trace.SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	spans := map[string]*trace.SpanData{}
+	for _, s := range e.spans {
+		if s.TraceID == traceID {
+			spans[s.Name] = s
+		}
+	}
+	return spans
+}
+
+func TestUploadPackHandler_Spans(t *testing.T) {
+	exporter := &memoryExporter{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+
+	upstreamURL := newTestUpstream(t)
+	var mu sync.Mutex
+	upstreamTraceparents := []string{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		upstreamTraceparents = append(upstreamTraceparents, r.Header.Get("traceparent"))
+		mu.Unlock()
+		serveGitHTTPBackend(w, r, upstreamURL.Path)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t)
+	config.URLCanonializer = func(*url.URL) (*url.URL, error) { return u, nil }
+	config.Tracer = sampledTracer{trace.DefaultTracer}
+	defer clearManagedRepositories()
+
+	// The client's span is not sampled. The spans are sampled anyway by
+	// the injected tracer.
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const clientSpanID = "00f067aa0ba902b7"
+	req := httptest.NewRequest("POST", "/repo/git-upload-pack", strings.NewReader(pktLine("command=ls-refs\n")+"00010000"))
+	req.Header.Set("Git-Protocol", "version=2")
+	req.Header.Set("traceparent", "00-"+traceID+"-"+clientSpanID+"-00")
+	rec := httptest.NewRecorder()
+	HTTPHandler(config).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	// The empty cache is fetched in the background.
+	bs, err := hex.DecodeString(traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tid trace.TraceID
+	copy(tid[:], bs)
+	var spans map[string]*trace.SpanData
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		spans = exporter.spansOf(tid)
+		if len(spans) == 3 {
+			break
+		}
+	}
+
+	root, ok := spans["goblet.UploadPack"]
+	if !ok {
+		t.Fatalf("no upload-pack span: %v", spans)
+	}
+	if got := root.ParentSpanID.String(); got != clientSpanID {
+		t.Errorf("upload-pack span: got parent %s, want the client span %s", got, clientSpanID)
+	}
+	if got := root.Attributes["goblet.command"]; got != "ls-refs" {
+		t.Errorf("upload-pack span: got command %v, want ls-refs", got)
+	}
+	if got := root.Attributes["goblet.host"]; got != u.Host {
+		t.Errorf("upload-pack span: got host %v, want %s", got, u.Host)
+	}
+	for _, name := range []string{"goblet.LsRefsUpstream", "goblet.FetchUpstream"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span: %v", name, spans)
+			continue
+		}
+		if s.ParentSpanID != root.SpanID {
+			t.Errorf("%s span: got parent %s, want the upload-pack span %s", name, s.ParentSpanID, root.SpanID)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if lsRefs, ok := spans["goblet.LsRefsUpstream"]; ok && len(upstreamTraceparents) > 0 {
+		if !strings.Contains(upstreamTraceparents[0], lsRefs.SpanID.String()) {
+			t.Errorf("got traceparent %q for the upstream ls-refs, want the span %s", upstreamTraceparents[0], lsRefs.SpanID)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+
+	"golang.org/x/oauth2"
+)
+
+var gitVersionPattern = regexp.MustCompile(`^git version (\d+)\.(\d+)`)
+
+// ValidateConfig checks that the server can run with the config: the cache
+// root is a writable directory, the git binary runs with ExtraGitConfig and
+// supports Git protocol v2, and the TokenSource, if any, yields a token. Run
+// this before taking traffic.
+func ValidateConfig(config *ServerConfig) error {
+	if config.LocalDiskCacheRoot == "" {
+		return fmt.Errorf("LocalDiskCacheRoot is not set")
+	}
+	if fi, err := os.Stat(config.LocalDiskCacheRoot); err != nil {
+		return fmt.Errorf("cannot access the cache root: %v", err)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("the cache root %s is not a directory", config.LocalDiskCacheRoot)
+	}
+	if err := checkCacheRootWritable(config.LocalDiskCacheRoot); err != nil {
+		return err
+	}
+	if config.CacheDirMode&^os.ModePerm != 0 || (config.CacheDirMode != 0 && config.CacheDirMode&0700 != 0700) {
+		return fmt.Errorf("invalid CacheDirMode %v: it must be a permission that the owner can read, write, and search", config.CacheDirMode)
+	}
+
+	if config.GitBinaryPath != "" {
+		if _, err := exec.LookPath(config.GitBinaryPath); err != nil {
+			return fmt.Errorf("cannot use GitBinaryPath %s: %v", config.GitBinaryPath, err)
+		}
+	} else if gitBinary == "" {
+		return fmt.Errorf("cannot find the git binary in PATH")
+	}
+	out := new(bytes.Buffer)
+	if err := runGitWithStdOut(config, noopOperation{}, out, "", "version"); err != nil {
+		return err
+	}
+	if !supportsProtocolV2(out.String()) {
+		return fmt.Errorf("git does not support protocol v2 (needs 2.18 or later): %s", bytes.TrimSpace(out.Bytes()))
+	}
+	if err := checkHTTPVersion(config.UpstreamHTTPVersion); err != nil {
+		return fmt.Errorf("invalid UpstreamHTTPVersion: %v", err)
+	}
+	for host, hs := range config.HostConfig {
+		if err := checkHTTPVersion(hs.HTTPVersion); err != nil {
+			return fmt.Errorf("invalid HTTPVersion for %s: %v", host, err)
+		}
+	}
+	if config.GzipLevel < gzip.HuffmanOnly || config.GzipLevel > gzip.BestCompression {
+		return fmt.Errorf("invalid GzipLevel %d", config.GzipLevel)
+	}
+	if config.RequestLogSampleRate < 0 || config.RequestLogSampleRate > 1 {
+		return fmt.Errorf("invalid RequestLogSampleRate %v", config.RequestLogSampleRate)
+	}
+	for _, pattern := range append(append([]string{}, config.AllowedHosts...), config.DeniedHosts...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid host pattern %q: %v", pattern, err)
+		}
+	}
+	for name := range config.UpstreamExtraHeaders {
+		if isReservedUpstreamHeader(name) {
+			return fmt.Errorf("UpstreamExtraHeaders cannot set %s", name)
+		}
+	}
+	tokenSources := map[string]oauth2.TokenSource{}
+	if config.TokenSource != nil {
+		tokenSources["TokenSource"] = config.TokenSource
+	}
+	for host, hs := range config.HostConfig {
+		if hs.TokenSource != nil {
+			tokenSources["the TokenSource for "+host] = hs.TokenSource
+		}
+	}
+	if len(tokenSources) != 0 && !gitVersionAtLeast(out.String(), 2, 31) {
+		return fmt.Errorf("git cannot take the upstream credential from the environment (needs 2.31 or later): %s", bytes.TrimSpace(out.Bytes()))
+	}
+	if len(config.ExtraGitConfig) != 0 {
+		// "git version" doesn't parse the config.
+		if err := runGitWithStdOut(config, noopOperation{}, ioutil.Discard, "", "config", "--list"); err != nil {
+			return fmt.Errorf("invalid ExtraGitConfig %q: %v", config.ExtraGitConfig, err)
+		}
+	}
+
+	for name, ts := range tokenSources {
+		if _, err := ts.Token(); err != nil {
+			return fmt.Errorf("cannot obtain a token from %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// checkHTTPVersion accepts the values of git's http.version that the server
+// supports.
+func checkHTTPVersion(v string) error {
+	switch v {
+	case "", "HTTP/1.1", "HTTP/2":
+		return nil
+	}
+	return fmt.Errorf("%q is not HTTP/1.1 or HTTP/2", v)
+}
+
+// checkCacheRootWritable creates and removes a file in the cache root.
+func checkCacheRootWritable(root string) error {
+	f, err := ioutil.TempFile(root, ".goblet-check")
+	if err != nil {
+		return fmt.Errorf("the cache root is not writable: %v", err)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return fmt.Errorf("cannot remove a file in the cache root: %v", err)
+	}
+	return nil
+}
+
+// supportsProtocolV2 returns true if the "git version" output is 2.18 or
+// later, which added Git protocol v2.
+func supportsProtocolV2(version string) bool {
+	return gitVersionAtLeast(version, 2, 18)
+}
+
+// gitVersionAtLeast returns true if the "git version" output is
+// wantMajor.wantMinor or later.
+func gitVersionAtLeast(version string, wantMajor, wantMinor int) bool {
+	m := gitVersionPattern.FindStringSubmatch(version)
+	if m == nil {
+		return false
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major > wantMajor || (major == wantMajor && minor >= wantMinor)
+}
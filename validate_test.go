@@ -0,0 +1,95 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	if err := ValidateConfig(newTestConfig(t)); err != nil {
+		t.Errorf("got %v for a valid config", err)
+	}
+
+	missingRoot := newTestConfig(t)
+	missingRoot.LocalDiskCacheRoot = filepath.Join(missingRoot.LocalDiskCacheRoot, "missing")
+	fileRoot := newTestConfig(t)
+	fileRoot.LocalDiskCacheRoot = filepath.Join(fileRoot.LocalDiskCacheRoot, "file")
+	if err := ioutil.WriteFile(fileRoot.LocalDiskCacheRoot, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	badToken := newTestConfig(t)
+	badToken.TokenSource = &fakeTokenSource{err: errors.New("no credential")}
+	badGitBinary := newTestConfig(t)
+	badGitBinary.GitBinaryPath = "/nonexistent/git"
+	badGitConfig := newTestConfig(t)
+	badGitConfig.ExtraGitConfig = []string{"nosection=1"}
+	badHTTPVersion := newTestConfig(t)
+	badHTTPVersion.HostConfig = map[string]HostSettings{"git.example.com": {HTTPVersion: "HTTP/3"}}
+	badHostPattern := newTestConfig(t)
+	badHostPattern.DeniedHosts = []string{"[a-"}
+	badGzipLevel := newTestConfig(t)
+	badGzipLevel.GzipLevel = 10
+	badSampleRate := newTestConfig(t)
+	badSampleRate.RequestLogSampleRate = 1.5
+	badCacheDirMode := newTestConfig(t)
+	badCacheDirMode.CacheDirMode = 0600
+	badExtraHeader := newTestConfig(t)
+	badExtraHeader.UpstreamExtraHeaders = map[string]string{"authorization": "Bearer other"}
+	for name, tc := range map[string]struct {
+		config *ServerConfig
+		want   string
+	}{
+		"empty cache root":   {&ServerConfig{}, "LocalDiskCacheRoot"},
+		"missing cache root": {missingRoot, "cache root"},
+		"file cache root":    {fileRoot, "cache root"},
+		"bad TokenSource":    {badToken, "TokenSource"},
+		"bad GitBinaryPath":  {badGitBinary, "/nonexistent/git"},
+		"bad ExtraGitConfig": {badGitConfig, "ExtraGitConfig"},
+		"bad HTTPVersion":    {badHTTPVersion, "HTTP/3"},
+		"bad host pattern":   {badHostPattern, "[a-"},
+		"bad GzipLevel":      {badGzipLevel, "GzipLevel"},
+		"bad sample rate":    {badSampleRate, "RequestLogSampleRate"},
+		"bad CacheDirMode":   {badCacheDirMode, "CacheDirMode"},
+		"bad extra header":   {badExtraHeader, "UpstreamExtraHeaders"},
+	} {
+		if err := ValidateConfig(tc.config); err == nil {
+			t.Errorf("%s: got no error", name)
+		} else if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %q, want an error mentioning %q", name, err, tc.want)
+		}
+	}
+}
+
+func TestSupportsProtocolV2(t *testing.T) {
+	for version, want := range map[string]bool{
+		"git version 2.39.5\n":             true,
+		"git version 2.18.0":               true,
+		"git version 2.17.1":               false,
+		"git version 1.9.5":                false,
+		"git version 3.0.0":                true,
+		"git version 2.21.0.windows.1":     true,
+		"git version 2.20.1 (Apple Git-1)": true,
+		"unexpected":                       false,
+	} {
+		if got := supportsProtocolV2(version); got != want {
+			t.Errorf("supportsProtocolV2(%q) = %v, want %v", version, got, want)
+		}
+	}
+}